@@ -0,0 +1,203 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/transport"
+)
+
+// connectionLimits of concurrent connections from inbounds, 0 is unlimited
+type connectionLimits struct {
+	Global         int `json:"global"`
+	PerInbound     int `json:"perInbound"`
+	PerSource      int `json:"perSource"`
+	PerDestination int `json:"perDestination"`
+}
+
+type admissionRejected struct {
+	Global      int64 `json:"global"`
+	Inbound     int64 `json:"inbound"`
+	Source      int64 `json:"source"`
+	Destination int64 `json:"destination"`
+}
+
+// admissionControl count connections per key while they last, refusing new ones over limits
+type admissionControl struct {
+	sync.Mutex
+	limits       connectionLimits
+	active       int
+	inbounds     map[string]int
+	sources      map[string]int
+	destinations map[string]int
+	admitted     int64
+	rejected     admissionRejected
+}
+
+type admissionStats struct {
+	Limits       connectionLimits  `json:"limits"`
+	Active       int               `json:"active"`
+	Inbounds     map[string]int    `json:"inbounds"`
+	Sources      map[string]int    `json:"sources"`
+	Destinations map[string]int    `json:"destinations"`
+	Admitted     int64             `json:"admitted"`
+	Rejected     admissionRejected `json:"rejected"`
+}
+
+type admittedKey struct{}
+
+/*
+SetConnectionLimits set limits of concurrent connections from inbounds, as JSON
+{global, perInbound, perSource, perDestination}, 0 or missing is unlimited.
+New limits apply to new connections at once, existing ones are never cut.
+*/
+func (v *V2RayPoint) SetConnectionLimits(limitsJSON string) error {
+	var limits connectionLimits
+	if len(limitsJSON) > 0 {
+		if err := json.Unmarshal([]byte(limitsJSON), &limits); err != nil {
+			return err
+		}
+	}
+	if limits.Global < 0 || limits.PerInbound < 0 || limits.PerSource < 0 || limits.PerDestination < 0 {
+		return fmt.Errorf("negative connection limit")
+	}
+
+	v.admission.Lock()
+	v.admission.limits = limits
+	v.admission.Unlock()
+	log.Printf("connection limits: %+v", limits)
+	return nil
+}
+
+/*GetAdmissionStats return active connections and rejection counters as JSON*/
+func (v *V2RayPoint) GetAdmissionStats() string {
+	a := &v.admission
+	a.Lock()
+	stats := &admissionStats{
+		Limits:       a.limits,
+		Active:       a.active,
+		Inbounds:     copyCounts(a.inbounds),
+		Sources:      copyCounts(a.sources),
+		Destinations: copyCounts(a.destinations),
+		Admitted:     a.admitted,
+		Rejected:     a.rejected,
+	}
+	a.Unlock()
+
+	b, err := json.Marshal(stats)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return string(b)
+}
+
+// dispatchOnly make admission a dispatch filter, connections are admitted before
+// they reach any outbound, the inbound has accepted them and sniffing is done by then
+func (a *admissionControl) dispatchOnly() {}
+
+func (a *admissionControl) filter(ctx context.Context, tag string, link *transport.Link) (context.Context, *transport.Link, error) {
+	// loopback outbounds dispatch the same connection again
+	if ctx.Value(admittedKey{}) != nil {
+		return ctx, link, nil
+	}
+	// probes and delay tests have no inbound
+	inbound := session.InboundFromContext(ctx)
+	if inbound == nil {
+		return ctx, link, nil
+	}
+	source := ""
+	if inbound.Source.IsValid() {
+		source = inbound.Source.Address.String()
+	}
+	destination := targetDomain(ctx)
+
+	a.Lock()
+	defer a.Unlock()
+	if a.inbounds == nil {
+		a.inbounds = make(map[string]int)
+		a.sources = make(map[string]int)
+		a.destinations = make(map[string]int)
+	}
+	l := a.limits
+	switch {
+	case l.Global > 0 && a.active >= l.Global:
+		a.rejected.Global++
+		return ctx, link, fmt.Errorf("global connection limit %d reached", l.Global)
+	case l.PerInbound > 0 && a.inbounds[inbound.Tag] >= l.PerInbound:
+		a.rejected.Inbound++
+		return ctx, link, fmt.Errorf("connection limit %d of inbound %s reached", l.PerInbound, inbound.Tag)
+	case l.PerSource > 0 && len(source) > 0 && a.sources[source] >= l.PerSource:
+		a.rejected.Source++
+		return ctx, link, fmt.Errorf("connection limit %d of source %s reached", l.PerSource, source)
+	case l.PerDestination > 0 && len(destination) > 0 && a.destinations[destination] >= l.PerDestination:
+		a.rejected.Destination++
+		return ctx, link, fmt.Errorf("connection limit %d of destination %s reached", l.PerDestination, destination)
+	}
+
+	a.admitted++
+	a.active++
+	a.inbounds[inbound.Tag]++
+	// a connection without a valid source or destination is limited by the rest
+	if len(source) > 0 {
+		a.sources[source]++
+	}
+	if len(destination) > 0 {
+		a.destinations[destination]++
+	}
+
+	w := &releaseWriter{Writer: link.Writer}
+	w.release = func() {
+		a.Lock()
+		a.active--
+		decCount(a.inbounds, inbound.Tag)
+		if len(source) > 0 {
+			decCount(a.sources, source)
+		}
+		if len(destination) > 0 {
+			decCount(a.destinations, destination)
+		}
+		a.Unlock()
+	}
+	return context.WithValue(ctx, admittedKey{}, true), &transport.Link{Reader: link.Reader, Writer: w}, nil
+}
+
+// releaseWriter call release once the outbound is done with the connection,
+// which is when it closes or interrupts the downlink
+type releaseWriter struct {
+	buf.Writer
+	once    sync.Once
+	release func()
+}
+
+func (w *releaseWriter) Close() error {
+	w.once.Do(w.release)
+	return common.Close(w.Writer)
+}
+
+func (w *releaseWriter) Interrupt() {
+	w.once.Do(w.release)
+	common.Interrupt(w.Writer)
+}
+
+func decCount(m map[string]int, key string) {
+	if m[key] <= 1 {
+		delete(m, key)
+	} else {
+		m[key]--
+	}
+}
+
+func copyCounts(m map[string]int) map[string]int {
+	c := make(map[string]int, len(m))
+	for k, n := range m {
+		c[k] = n
+	}
+	return c
+}
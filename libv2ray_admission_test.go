@@ -0,0 +1,178 @@
+package libv2ray
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/xtls/xray-core/common"
+	v2net "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+func inboundContext(tag string, source string, domain string) context.Context {
+	return session.ContextWithInbound(domainContext(domain), &session.Inbound{
+		Tag:    tag,
+		Source: v2net.TCPDestination(v2net.ParseAddress(source), 40000),
+	})
+}
+
+func testLink() *transport.Link {
+	r, w := pipe.New()
+	return &transport.Link{Reader: r, Writer: w}
+}
+
+func TestAdmissionControl(t *testing.T) {
+	a := &admissionControl{limits: connectionLimits{Global: 3, PerInbound: 2, PerSource: 1, PerDestination: 2}}
+	admit := func(ctx context.Context) (*transport.Link, error) {
+		_, link, err := a.filter(ctx, "proxy", testLink())
+		return link, err
+	}
+
+	first, err := admit(inboundContext("socks", "10.0.0.1", "a.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admit(inboundContext("socks", "10.0.0.1", "b.com")); err == nil {
+		t.Error("expect per source limit")
+	}
+	if _, err := admit(inboundContext("socks", "10.0.0.2", "a.com")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admit(inboundContext("socks", "10.0.0.3", "c.com")); err == nil {
+		t.Error("expect per inbound limit")
+	}
+	if _, err := admit(inboundContext("http", "10.0.0.3", "a.com")); err == nil {
+		t.Error("expect per destination limit")
+	}
+	if _, err := admit(inboundContext("http", "10.0.0.3", "c.com")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admit(inboundContext("http", "10.0.0.4", "d.com")); err == nil {
+		t.Error("expect global limit")
+	}
+	if r := a.rejected; r.Global != 1 || r.Inbound != 1 || r.Source != 1 || r.Destination != 1 {
+		t.Errorf("unexpected rejections: %+v", r)
+	}
+
+	// closing releases once, however often the outbound closes
+	common.Close(first.Writer)
+	common.Interrupt(first.Writer)
+	if a.active != 2 || a.sources["10.0.0.1"] != 0 || a.destinations["a.com"] != 1 {
+		t.Errorf("not released: active %d, sources %v", a.active, a.sources)
+	}
+	if _, err := admit(inboundContext("http", "10.0.0.1", "b.com")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAdmissionControlPassThrough(t *testing.T) {
+	a := &admissionControl{limits: connectionLimits{Global: 1}}
+	ctx, _, err := a.filter(inboundContext("socks", "10.0.0.1", "a.com"), "proxy", testLink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same connection dispatched again by a chained outbound
+	if _, _, err := a.filter(ctx, "next", testLink()); err != nil {
+		t.Error(err)
+	}
+	// no inbound, a probe
+	if _, _, err := a.filter(domainContext("a.com"), "proxy", testLink()); err != nil {
+		t.Error(err)
+	}
+	if a.admitted != 1 {
+		t.Errorf("admitted %d, want 1", a.admitted)
+	}
+
+	// no source to count by
+	ctx = session.ContextWithInbound(domainContext("a.com"), &session.Inbound{Tag: "socks"})
+	if _, _, err := a.filter(ctx, "proxy", testLink()); err == nil {
+		t.Error("expect global limit")
+	}
+	a.limits.Global = 0
+	if _, _, err := a.filter(ctx, "proxy", testLink()); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := a.sources[""]; found || len(a.sources) != 1 {
+		t.Errorf("unexpected sources %v", a.sources)
+	}
+}
+
+func TestAdmissionUntaggedDefault(t *testing.T) {
+	server := smartServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		b := make([]byte, 4)
+		io.ReadFull(conn, b)
+		conn.Write([]byte("pong"))
+	})
+	socksPort := closedPort(t)
+	config, err := loadCoreConfig(fmt.Sprintf(`{
+		"inbounds": [{"tag": "socks", "listen": "127.0.0.1", "port": %d, "protocol": "socks"}],
+		"outbounds": [{"protocol": "freedom", "settings": {"redirect": "127.0.0.1:%d"}}]
+	}`, socksPort, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &admissionControl{limits: connectionLimits{Global: 1}}
+	inst, err := config.newInstance(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	if answer, err := smartExchange(t, fmt.Sprintf("127.0.0.1:%d", socksPort), "localhost:1001"); answer != "pong" {
+		t.Fatalf("connection failed: %q %v", answer, err)
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.admitted != 1 {
+		t.Errorf("connection to the untagged default not admitted: %d", a.admitted)
+	}
+}
+
+func TestFilterOutbounds(t *testing.T) {
+	config, err := loadCoreConfig(`{"outbounds": [
+		{"tag": "direct", "protocol": "freedom"},
+		{"tag": "block", "protocol": "blackhole"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := config.newInstance(&protocolClassifier{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	ohm := inst.GetFeature(outbound.ManagerType()).(outbound.Manager)
+	def, ok := ohm.GetDefaultHandler().(*filteredOutbound)
+	if !ok || def.Tag() != "direct" {
+		t.Errorf("default outbound lost: %v", ohm.GetDefaultHandler())
+	}
+	if _, ok := ohm.GetHandler("block").(*filteredOutbound); !ok {
+		t.Error("block not filtered")
+	}
+}
+
+func TestAdmissionDualPath(t *testing.T) {
+	// one session over two paths is one connection, a second path must not be refused
+	a := &admissionControl{limits: connectionLimits{Global: 1, PerDestination: 1}}
+	conn, v := startDualPath(t, a)
+	checkDualPath(t, conn, v, []string{"a", "b", "c", "d"})
+
+	a.Lock()
+	defer a.Unlock()
+	if a.admitted != 1 || a.active != 1 || a.destinations["127.0.0.1"] != 1 {
+		t.Errorf("admitted %d, active %d, destinations %v", a.admitted, a.active, a.destinations)
+	}
+	if a.rejected != (admissionRejected{}) {
+		t.Errorf("rejected %+v", a.rejected)
+	}
+}
@@ -0,0 +1,322 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	v2conf "github.com/xtls/xray-core/infra/conf"
+	"github.com/xtls/xray-core/transport"
+)
+
+// balancingStrategy picks one of the candidate outbound tags for a connection
+type balancingStrategy interface {
+	PickOutbound(ctx context.Context, candidates []string) string
+}
+
+// dispatchObserver is implemented by strategies that need to know
+// how many connections are alive on each outbound, a connection ends
+// when its link is closed, not when Dispatch returns as it does for mux
+type dispatchObserver interface {
+	begin(tag string)
+	end(tag string)
+}
+
+type balancingStrategyCreator func(settings []byte) (balancingStrategy, error)
+
+// balancingStrategies are the strategies provided by this library,
+// in addition to the ones built into xray (random, roundRobin, leastPing, leastLoad)
+var balancingStrategies = make(map[string]balancingStrategyCreator)
+
+func registerBalancingStrategy(name string, creator balancingStrategyCreator) {
+	balancingStrategies[strings.ToLower(name)] = creator
+}
+
+func init() {
+	registerBalancingStrategy("sticky", func([]byte) (balancingStrategy, error) {
+		return &stickyStrategy{}, nil
+	})
+	registerBalancingStrategy("weighted", newWeightedStrategy)
+	leastLoad := func([]byte) (balancingStrategy, error) {
+		return &leastConnStrategy{active: make(map[string]int)}, nil
+	}
+	// the hyphen keeps it apart from xray's leastLoad,
+	// leastConn is an alias kept for configs written before
+	registerBalancingStrategy("least-load", leastLoad)
+	registerBalancingStrategy("leastConn", leastLoad)
+}
+
+// libBalancer is a balancer using a strategy of this library.
+// It is an outbound to the core, routing rules with its balancerTag
+// are rewritten to use it as outboundTag.
+type libBalancer struct {
+	tag         string
+	selectors   []string
+	fallbackTag string
+	strategyTyp string
+	strategy    balancingStrategy
+	ohm         outbound.Manager
+}
+
+func (b *libBalancer) init(ohm outbound.Manager) {
+	b.ohm = ohm
+}
+
+// Tag implements outbound.Handler.
+func (b *libBalancer) Tag() string {
+	return b.tag
+}
+
+// Start implements common.Runnable.
+func (b *libBalancer) Start() error {
+	return nil
+}
+
+// Close implements common.Closable.
+func (b *libBalancer) Close() error {
+	return nil
+}
+
+// Candidates return selected outbound tags, excluding outbounds of this library
+func (b *libBalancer) Candidates() []string {
+	tags := make([]string, 0)
+	hs, ok := b.ohm.(outbound.HandlerSelector)
+	if !ok {
+		return tags
+	}
+	for _, tag := range hs.Select(b.selectors) {
+		if _, isLib := unfiltered(b.ohm.GetHandler(tag)).(libOutbound); !isLib {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// PickOutbound return the tag picked by strategy, or fallbackTag if nothing to pick
+func (b *libBalancer) PickOutbound(ctx context.Context) string {
+	candidates := b.Candidates()
+	if len(candidates) > 0 {
+		if tag := b.strategy.PickOutbound(ctx, candidates); len(tag) > 0 {
+			return tag
+		}
+	}
+	return b.fallbackTag
+}
+
+// Dispatch implements outbound.Handler.
+func (b *libBalancer) Dispatch(ctx context.Context, link *transport.Link) {
+	tag := b.PickOutbound(ctx)
+	h := b.ohm.GetHandler(tag)
+	if h == nil {
+		log.Printf("balancer %s: no outbound to dispatch", b.tag)
+		common.Interrupt(link.Writer)
+		common.Interrupt(link.Reader)
+		return
+	}
+
+	if o, ok := b.strategy.(dispatchObserver); ok {
+		o.begin(tag)
+		link = &transport.Link{
+			Reader: link.Reader,
+			Writer: &releaseWriter{Writer: link.Writer, release: func() { o.end(tag) }},
+		}
+	}
+	h.Dispatch(ctx, link)
+}
+
+// extractBalancers take balancers using strategies of this library out of config
+func extractBalancers(config *v2conf.Config) ([]*libBalancer, error) {
+	if config.RouterConfig == nil {
+		return nil, nil
+	}
+
+	var balancers []*libBalancer
+	tags := make(map[string]bool)
+	kept := make([]*v2conf.BalancingRule, 0, len(config.RouterConfig.Balancers))
+	for _, rule := range config.RouterConfig.Balancers {
+		typ := strings.ToLower(rule.Strategy.Type)
+		creator, found := balancingStrategies[typ]
+		if !found {
+			kept = append(kept, rule)
+			continue
+		}
+		if len(rule.Tag) == 0 || len(rule.Selectors) == 0 {
+			return nil, fmt.Errorf("balancer %q: empty tag or selector", rule.Tag)
+		}
+
+		settings := []byte("{}")
+		if rule.Strategy.Settings != nil {
+			settings = *rule.Strategy.Settings
+		}
+		strategy, err := creator(settings)
+		if err != nil {
+			return nil, fmt.Errorf("balancer %s: %v", rule.Tag, err)
+		}
+		balancers = append(balancers, &libBalancer{
+			tag:         rule.Tag,
+			selectors:   rule.Selectors,
+			fallbackTag: rule.FallbackTag,
+			strategyTyp: typ,
+			strategy:    strategy,
+		})
+		tags[rule.Tag] = true
+	}
+	if len(balancers) == 0 {
+		return nil, nil
+	}
+	config.RouterConfig.Balancers = kept
+
+	for i, raw := range config.RouterConfig.RuleList {
+		var rule map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &rule); err != nil {
+			return nil, err
+		}
+		var btag string
+		if err := json.Unmarshal(rule["balancerTag"], &btag); err != nil || !tags[btag] {
+			continue
+		}
+		delete(rule, "balancerTag")
+		rule["outboundTag"], _ = json.Marshal(btag)
+		b, err := json.Marshal(rule)
+		if err != nil {
+			return nil, err
+		}
+		config.RouterConfig.RuleList[i] = b
+	}
+	return balancers, nil
+}
+
+// targetDomain return the domain of destination if known, sniffed one first
+func targetDomain(ctx context.Context) string {
+	ob := session.OutboundFromContext(ctx)
+	if ob == nil {
+		return ""
+	}
+	if ob.RouteTarget.IsValid() && ob.RouteTarget.Address.Family().IsDomain() {
+		return ob.RouteTarget.Address.Domain()
+	}
+	if ob.Target.IsValid() {
+		if ob.Target.Address.Family().IsDomain() {
+			return ob.Target.Address.Domain()
+		}
+		return ob.Target.Address.String()
+	}
+	return ""
+}
+
+// stickyStrategy keep a destination domain on the same outbound,
+// using rendezvous hashing so that a changed candidate list moves as few domains as possible
+type stickyStrategy struct{}
+
+func (s *stickyStrategy) PickOutbound(ctx context.Context, candidates []string) string {
+	key := targetDomain(ctx)
+	if len(key) == 0 {
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	var picked string
+	var best uint64
+	for _, tag := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(tag))
+		if score := h.Sum64(); len(picked) == 0 || score > best {
+			picked, best = tag, score
+		}
+	}
+	return picked
+}
+
+// weightedStrategy pick randomly by static weights, matched by the longest tag prefix.
+// settings: {"weights": {"proxy-hk": 3, "proxy-us": 1}}, unmatched tags weight 1.
+type weightedStrategy struct {
+	weights map[string]int
+}
+
+func newWeightedStrategy(settings []byte) (balancingStrategy, error) {
+	var s struct {
+		Weights map[string]int `json:"weights"`
+	}
+	if err := json.Unmarshal(settings, &s); err != nil {
+		return nil, err
+	}
+	for prefix, w := range s.Weights {
+		if w < 0 {
+			return nil, fmt.Errorf("negative weight for %s", prefix)
+		}
+	}
+	return &weightedStrategy{weights: s.Weights}, nil
+}
+
+func (s *weightedStrategy) weight(tag string) int {
+	matched, w := -1, 1
+	for prefix, value := range s.weights {
+		if strings.HasPrefix(tag, prefix) && len(prefix) > matched {
+			matched, w = len(prefix), value
+		}
+	}
+	return w
+}
+
+func (s *weightedStrategy) PickOutbound(_ context.Context, candidates []string) string {
+	total := 0
+	for _, tag := range candidates {
+		total += s.weight(tag)
+	}
+	if total == 0 {
+		return ""
+	}
+	n := rand.Intn(total)
+	for _, tag := range candidates {
+		if n -= s.weight(tag); n < 0 {
+			return tag
+		}
+	}
+	return ""
+}
+
+// leastConnStrategy pick the outbound with fewest alive connections, it is least-load.
+// Not to be confused with xray's leastLoad, which works on observatory results.
+type leastConnStrategy struct {
+	sync.Mutex
+	active map[string]int
+}
+
+func (s *leastConnStrategy) PickOutbound(_ context.Context, candidates []string) string {
+	s.Lock()
+	defer s.Unlock()
+
+	// start from a random position to spread ties
+	offset := rand.Intn(len(candidates))
+	picked := ""
+	for i := range candidates {
+		tag := candidates[(i+offset)%len(candidates)]
+		if len(picked) == 0 || s.active[tag] < s.active[picked] {
+			picked = tag
+		}
+	}
+	return picked
+}
+
+func (s *leastConnStrategy) begin(tag string) {
+	s.Lock()
+	s.active[tag]++
+	s.Unlock()
+}
+
+func (s *leastConnStrategy) end(tag string) {
+	s.Lock()
+	if s.active[tag]--; s.active[tag] <= 0 {
+		delete(s.active, tag)
+	}
+	s.Unlock()
+}
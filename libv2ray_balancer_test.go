@@ -0,0 +1,235 @@
+package libv2ray
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	v2serial "github.com/xtls/xray-core/infra/conf/serial"
+	"github.com/xtls/xray-core/transport"
+
+	v2net "github.com/xtls/xray-core/common/net"
+)
+
+type fakeOutbound struct {
+	tag      string
+	mu       sync.Mutex
+	count    int
+	links    []*transport.Link
+	blocking chan struct{}
+}
+
+func (h *fakeOutbound) Tag() string  { return h.tag }
+func (h *fakeOutbound) Start() error { return nil }
+func (h *fakeOutbound) Close() error { return nil }
+func (h *fakeOutbound) Dispatch(ctx context.Context, link *transport.Link) {
+	h.mu.Lock()
+	h.count++
+	h.links = append(h.links, link)
+	h.mu.Unlock()
+	if h.blocking != nil {
+		<-h.blocking
+	}
+}
+
+type fakeOutboundManager struct {
+	outbound.Manager
+	handlers map[string]outbound.Handler
+}
+
+func newFakeOutboundManager(tags ...string) *fakeOutboundManager {
+	m := &fakeOutboundManager{handlers: make(map[string]outbound.Handler)}
+	for _, tag := range tags {
+		m.handlers[tag] = &fakeOutbound{tag: tag}
+	}
+	return m
+}
+
+func (m *fakeOutboundManager) GetHandler(tag string) outbound.Handler {
+	return m.handlers[tag]
+}
+
+func (m *fakeOutboundManager) Select(selectors []string) []string {
+	tags := make([]string, 0)
+	for tag := range m.handlers {
+		for _, s := range selectors {
+			if strings.HasPrefix(tag, s) {
+				tags = append(tags, tag)
+				break
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func domainContext(domain string) context.Context {
+	return session.ContextWithOutbound(context.Background(), &session.Outbound{
+		Target: v2net.TCPDestination(v2net.DomainAddress(domain), 443),
+	})
+}
+
+func newTestBalancer(t *testing.T, typ string, settings string, ohm *fakeOutboundManager) *libBalancer {
+	strategy, err := balancingStrategies[strings.ToLower(typ)]([]byte(settings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &libBalancer{tag: "balancer", selectors: []string{"proxy"}, strategy: strategy}
+	b.init(ohm)
+	ohm.handlers[b.tag] = b
+	return b
+}
+
+func TestStickyStrategy(t *testing.T) {
+	ohm := newFakeOutboundManager("proxy-a", "proxy-b", "proxy-c", "direct")
+	b := newTestBalancer(t, "sticky", "{}", ohm)
+
+	for _, domain := range []string{"www.example.com", "github.com", "a.b.c.d"} {
+		picked := b.PickOutbound(domainContext(domain))
+		if !strings.HasPrefix(picked, "proxy") {
+			t.Fatalf("picked %s out of selector", picked)
+		}
+		for i := 0; i < 10; i++ {
+			if again := b.PickOutbound(domainContext(domain)); again != picked {
+				t.Errorf("%s moved from %s to %s", domain, picked, again)
+			}
+		}
+
+		// domains on the other outbounds must stay when one outbound is gone
+		removed := "proxy-a"
+		if picked == removed {
+			removed = "proxy-b"
+		}
+		h := ohm.handlers[removed]
+		delete(ohm.handlers, removed)
+		if again := b.PickOutbound(domainContext(domain)); again != picked {
+			t.Errorf("%s moved from %s to %s after %s removed", domain, picked, again, removed)
+		}
+		ohm.handlers[removed] = h
+	}
+}
+
+func TestWeightedStrategy(t *testing.T) {
+	ohm := newFakeOutboundManager("proxy-a", "proxy-b", "proxy-c")
+	b := newTestBalancer(t, "weighted", `{"weights": {"proxy-a": 3, "proxy-c": 0}}`, ohm)
+
+	count := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		count[b.PickOutbound(context.Background())]++
+	}
+	if count["proxy-c"] != 0 {
+		t.Errorf("zero weight outbound picked %d times", count["proxy-c"])
+	}
+	if ratio := float64(count["proxy-a"]) / float64(count["proxy-b"]); ratio < 2.5 || ratio > 3.5 {
+		t.Errorf("unexpected ratio %v: %v", ratio, count)
+	}
+
+	if _, err := newWeightedStrategy([]byte(`{"weights": {"proxy": -1}}`)); err == nil {
+		t.Error("negative weight accepted")
+	}
+}
+
+func TestLeastConnStrategy(t *testing.T) {
+	ohm := newFakeOutboundManager("proxy-a", "proxy-b")
+	block := make(chan struct{})
+	for _, h := range ohm.handlers {
+		h.(*fakeOutbound).blocking = block
+	}
+	b := newTestBalancer(t, "least-load", "{}", ohm)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		tag := b.PickOutbound(context.Background())
+		b.strategy.(dispatchObserver).begin(tag)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer b.strategy.(dispatchObserver).end(tag)
+			ohm.handlers[tag].Dispatch(context.Background(), nil)
+		}()
+	}
+
+	s := b.strategy.(*leastConnStrategy)
+	s.Lock()
+	if s.active["proxy-a"] != 3 || s.active["proxy-b"] != 3 {
+		t.Errorf("unbalanced connections: %v", s.active)
+	}
+	s.Unlock()
+
+	close(block)
+	wg.Wait()
+	if len(s.active) != 0 {
+		t.Errorf("connections left: %v", s.active)
+	}
+}
+
+func TestLeastConnStrategyMux(t *testing.T) {
+	// like mux, outbounds return from Dispatch while their connections go on,
+	// by the alias leastConn
+	ohm := newFakeOutboundManager("proxy-a", "proxy-b")
+	b := newTestBalancer(t, "leastConn", "{}", ohm)
+	for i := 0; i < 4; i++ {
+		b.Dispatch(context.Background(), testLink())
+	}
+
+	s := b.strategy.(*leastConnStrategy)
+	s.Lock()
+	if s.active["proxy-a"] != 2 || s.active["proxy-b"] != 2 {
+		t.Errorf("unbalanced connections: %v", s.active)
+	}
+	s.Unlock()
+
+	for _, h := range ohm.handlers {
+		if h, ok := h.(*fakeOutbound); ok {
+			for _, link := range h.links {
+				common.Close(link.Writer)
+				// closed twice, counted once
+				common.Interrupt(link.Writer)
+			}
+		}
+	}
+	if len(s.active) != 0 {
+		t.Errorf("connections left: %v", s.active)
+	}
+}
+
+func TestExtractBalancers(t *testing.T) {
+	config, err := v2serial.DecodeJSONConfig(strings.NewReader(`{
+		"outbounds": [{"tag": "proxy-a", "protocol": "freedom"}, {"tag": "proxy-b", "protocol": "freedom"}],
+		"routing": {
+			"balancers": [
+				{"tag": "sticky", "selector": ["proxy"], "strategy": {"type": "sticky"}},
+				{"tag": "random", "selector": ["proxy"], "strategy": {"type": "random"}}
+			],
+			"rules": [
+				{"type": "field", "domain": ["example.com"], "balancerTag": "sticky"},
+				{"type": "field", "port": "443", "balancerTag": "random"}
+			]
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balancers, err := extractBalancers(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balancers) != 1 || balancers[0].tag != "sticky" {
+		t.Fatalf("unexpected balancers: %v", balancers)
+	}
+	if len(config.RouterConfig.Balancers) != 1 || config.RouterConfig.Balancers[0].Tag != "random" {
+		t.Errorf("builtin balancer should be kept")
+	}
+	if !strings.Contains(string(config.RouterConfig.RuleList[0]), `"outboundTag":"sticky"`) {
+		t.Errorf("rule not rewritten: %s", config.RouterConfig.RuleList[0])
+	}
+	if _, err := config.Build(); err != nil {
+		t.Error(err)
+	}
+}
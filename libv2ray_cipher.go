@@ -0,0 +1,155 @@
+package libv2ray
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// the largest payload of a VMess or Shadowsocks chunk
+const cipherBenchmarkChunk = 16 * 1024
+
+type aeadCipher struct {
+	name    string
+	keySize int
+	new     func(key []byte) (cipher.AEAD, error)
+	// settings that select this AEAD, as "<protocol>:<value>"
+	settings []string
+}
+
+var aeadCiphers = []*aeadCipher{
+	{"aes-128-gcm", 16, newGCM, []string{"vmess:aes-128-gcm", "shadowsocks:aes-128-gcm", "shadowsocks2022:2022-blake3-aes-128-gcm"}},
+	{"aes-256-gcm", 32, newGCM, []string{"shadowsocks:aes-256-gcm", "shadowsocks2022:2022-blake3-aes-256-gcm"}},
+	{"chacha20-poly1305", chacha20poly1305.KeySize, chacha20poly1305.New, []string{"vmess:chacha20-poly1305", "shadowsocks:chacha20-ietf-poly1305", "shadowsocks2022:2022-blake3-chacha20-poly1305"}},
+	{"xchacha20-poly1305", chacha20poly1305.KeySize, chacha20poly1305.NewX, []string{"shadowsocks:xchacha20-ietf-poly1305"}},
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type cipherResult struct {
+	Cipher      string   `json:"cipher"`
+	Settings    []string `json:"settings"`
+	EncryptMBps float64  `json:"encryptMBps"`
+	DecryptMBps float64  `json:"decryptMBps"`
+}
+
+type cipherBenchmark struct {
+	AESHardware bool              `json:"aesHardware"`
+	ChunkSize   int               `json:"chunkSize"`
+	Results     []*cipherResult   `json:"results"`
+	Recommended map[string]string `json:"recommended"`
+}
+
+/*
+BenchmarkCiphers measure encrypt and decrypt throughput of the AEADs used by
+VMess and Shadowsocks for about durationMs in total, and recommend the fastest
+setting of each protocol, e.g. {"vmess": "chacha20-poly1305", "shadowsocks": "aes-128-gcm", ...}.
+Run it while the core is idle, it keeps a CPU core busy.
+*/
+func BenchmarkCiphers(durationMs int64) string {
+	if durationMs <= 0 {
+		durationMs = 1000
+	}
+	perRun := time.Duration(durationMs) * time.Millisecond / time.Duration(2*len(aeadCiphers))
+
+	result := &cipherBenchmark{
+		AESHardware: hasAESHardware(),
+		ChunkSize:   cipherBenchmarkChunk,
+		Results:     make([]*cipherResult, 0, len(aeadCiphers)),
+		Recommended: make(map[string]string),
+	}
+	best := make(map[string]float64)
+	for _, c := range aeadCiphers {
+		r, err := benchmarkAEAD(c, perRun)
+		if err != nil {
+			log.Printf("benchmark %s: %v", c.name, err)
+			continue
+		}
+		result.Results = append(result.Results, r)
+
+		score := (r.EncryptMBps + r.DecryptMBps) / 2
+		for _, setting := range c.settings {
+			protocol, value, _ := strings.Cut(setting, ":")
+			if score > best[protocol] {
+				best[protocol] = score
+				result.Recommended[protocol] = value
+			}
+		}
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return string(b)
+}
+
+func benchmarkAEAD(c *aeadCipher, d time.Duration) (*cipherResult, error) {
+	key := make([]byte, c.keySize)
+	rand.Read(key)
+	aead, err := c.new(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	plain := make([]byte, cipherBenchmarkChunk)
+	rand.Read(plain)
+	sealed := aead.Seal(nil, nonce, plain, nil)
+
+	out := make([]byte, 0, len(sealed))
+	encrypt := measureThroughput(d, func() {
+		aead.Seal(out[:0], nonce, plain, nil)
+	})
+	var openErr error
+	decrypt := measureThroughput(d, func() {
+		if _, err := aead.Open(out[:0], nonce, sealed, nil); err != nil {
+			openErr = err
+		}
+	})
+	if openErr != nil {
+		return nil, openErr
+	}
+	return &cipherResult{
+		Cipher:      c.name,
+		Settings:    c.settings,
+		EncryptMBps: encrypt,
+		DecryptMBps: decrypt,
+	}, nil
+}
+
+// measureThroughput run f on chunks for about d, return MB/s
+func measureThroughput(d time.Duration, f func()) float64 {
+	var bytes int64
+	start := time.Now()
+	for time.Since(start) < d || bytes == 0 {
+		// check the clock every few chunks only
+		for i := 0; i < 16; i++ {
+			f()
+		}
+		bytes += 16 * cipherBenchmarkChunk
+	}
+	mbps := float64(bytes) / 1e6 / time.Since(start).Seconds()
+	return math.Round(mbps*10) / 10
+}
+
+// hasAESHardware is what Go uses to pick the constant time AES-GCM implementation
+func hasAESHardware() bool {
+	return (cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ) ||
+		(cpu.ARM64.HasAES && cpu.ARM64.HasPMULL) ||
+		(cpu.S390X.HasAES && cpu.S390X.HasGHASH)
+}
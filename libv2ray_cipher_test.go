@@ -0,0 +1,27 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBenchmarkCiphers(t *testing.T) {
+	var result cipherBenchmark
+	if err := json.Unmarshal([]byte(BenchmarkCiphers(200)), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Results) != len(aeadCiphers) {
+		t.Fatalf("expect %d results, got %d", len(aeadCiphers), len(result.Results))
+	}
+	for _, r := range result.Results {
+		if r.EncryptMBps <= 0 || r.DecryptMBps <= 0 {
+			t.Errorf("no throughput of %s: %+v", r.Cipher, r)
+		}
+	}
+	for _, protocol := range []string{"vmess", "shadowsocks", "shadowsocks2022"} {
+		if len(result.Recommended[protocol]) == 0 {
+			t.Errorf("nothing recommended for %s", protocol)
+		}
+	}
+	t.Log(result.Recommended)
+}
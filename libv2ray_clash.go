@@ -0,0 +1,421 @@
+package libv2ray
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type clashReality struct {
+	PublicKey string `yaml:"public-key"`
+	ShortID   string `yaml:"short-id,omitempty"`
+}
+
+type clashWS struct {
+	Path    string            `yaml:"path,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+type clashGRPC struct {
+	ServiceName string `yaml:"grpc-service-name,omitempty"`
+}
+
+type clashH2 struct {
+	Host []string `yaml:"host,omitempty"`
+	Path string   `yaml:"path,omitempty"`
+}
+
+// clashProxy is a proxy of Clash.Meta, fields it has and we do not are kept in Extra
+type clashProxy struct {
+	Name              string                 `yaml:"name"`
+	Type              string                 `yaml:"type"`
+	Server            string                 `yaml:"server"`
+	Port              int                    `yaml:"port"`
+	UUID              string                 `yaml:"uuid,omitempty"`
+	AlterID           *int                   `yaml:"alterId,omitempty"`
+	Cipher            string                 `yaml:"cipher,omitempty"`
+	Flow              string                 `yaml:"flow,omitempty"`
+	Username          string                 `yaml:"username,omitempty"`
+	Password          string                 `yaml:"password,omitempty"`
+	UDP               bool                   `yaml:"udp,omitempty"`
+	TLS               bool                   `yaml:"tls,omitempty"`
+	ServerName        string                 `yaml:"servername,omitempty"`
+	SNI               string                 `yaml:"sni,omitempty"`
+	ALPN              []string               `yaml:"alpn,omitempty"`
+	SkipCertVerify    bool                   `yaml:"skip-cert-verify,omitempty"`
+	ClientFingerprint string                 `yaml:"client-fingerprint,omitempty"`
+	Reality           *clashReality          `yaml:"reality-opts,omitempty"`
+	Network           string                 `yaml:"network,omitempty"`
+	WS                *clashWS               `yaml:"ws-opts,omitempty"`
+	GRPC              *clashGRPC             `yaml:"grpc-opts,omitempty"`
+	H2                *clashH2               `yaml:"h2-opts,omitempty"`
+	Extra             map[string]interface{} `yaml:",inline"`
+}
+
+type clashConfig struct {
+	Proxies     []*clashProxy            `yaml:"proxies"`
+	ProxyGroups []map[string]interface{} `yaml:"proxy-groups,omitempty"`
+	Rules       []string                 `yaml:"rules"`
+}
+
+// xray protocols and Clash proxy types
+var clashTypes = map[string]string{
+	"vmess": "vmess", "vless": "vless", "trojan": "trojan",
+	"shadowsocks": "ss", "socks": "socks5", "http": "http",
+}
+
+/*
+ExportClashConfig convert outbounds and simple routing rules of a xray config to
+Clash.Meta YAML with proxies and rules. Returns JSON {"config": yaml, "unsupported": [...]}
+listing outbounds, fields and rules that have no Clash equivalent and were left out.
+*/
+func ExportClashConfig(content string) (string, error) {
+	p, err := profileFromXray(content)
+	if err != nil {
+		return "", err
+	}
+	config := p.clashConfig()
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return p.result(string(b))
+}
+
+/*
+ImportClashConfig convert proxies and rules of a Clash or Clash.Meta YAML config to
+a xray config. Returns JSON {"config": xray json, "unsupported": [...]}, proxy groups
+and rules of other types are listed in unsupported.
+*/
+func ImportClashConfig(content string) (string, error) {
+	var config clashConfig
+	if err := yaml.Unmarshal([]byte(content), &config); err != nil {
+		return "", err
+	}
+	p, err := profileFromClash(&config)
+	if err != nil {
+		return "", err
+	}
+	xray, err := p.xrayConfig()
+	if err != nil {
+		return "", err
+	}
+	return p.result(xray)
+}
+
+func (p *exportProfile) clashConfig() *clashConfig {
+	config := &clashConfig{Proxies: []*clashProxy{}, Rules: []string{}}
+	targets := make(map[string]string)
+	for _, proxy := range p.Proxies {
+		switch proxy.Protocol {
+		case "freedom":
+			targets[proxy.Tag] = "DIRECT"
+		case "blackhole":
+			targets[proxy.Tag] = "REJECT"
+		default:
+			if cp := p.clashProxy(proxy); cp != nil {
+				config.Proxies = append(config.Proxies, cp)
+				targets[proxy.Tag] = proxy.Tag
+			}
+		}
+	}
+
+	for _, rule := range p.Rules {
+		target, found := targets[rule.Outbound]
+		if !found {
+			p.unsupported("rule %d: outbound %s not exported", rule.Index, rule.Outbound)
+			continue
+		}
+		if lines, err := clashRules(rule, target); err != nil {
+			p.unsupported("rule %d: %v", rule.Index, err)
+		} else {
+			config.Rules = append(config.Rules, lines...)
+		}
+	}
+	if final, found := targets[p.Final]; found {
+		config.Rules = append(config.Rules, "MATCH,"+final)
+	}
+	return config
+}
+
+func (p *exportProfile) clashProxy(proxy *exportProxy) *clashProxy {
+	cp := &clashProxy{
+		Name: proxy.Tag, Type: clashTypes[proxy.Protocol], Server: proxy.Server, Port: proxy.Port,
+		UUID: proxy.UUID, Flow: proxy.Flow, Username: proxy.Username, Password: proxy.Password,
+		UDP: true, ALPN: proxy.ALPN, SkipCertVerify: proxy.Insecure, ClientFingerprint: proxy.Fingerprint,
+	}
+	switch proxy.Protocol {
+	case "vmess":
+		alterID := proxy.AlterID
+		cp.AlterID, cp.Cipher = &alterID, proxy.Cipher
+		if len(cp.Cipher) == 0 {
+			cp.Cipher = "auto"
+		}
+	case "shadowsocks":
+		cp.Cipher = proxy.Cipher
+	case "trojan":
+		if !proxy.TLS {
+			p.unsupported("outbound %s: trojan without TLS", proxy.Tag)
+			return nil
+		}
+	}
+	if proxy.TLS {
+		if proxy.Protocol == "trojan" {
+			cp.SNI = proxy.ServerName
+		} else {
+			cp.TLS, cp.ServerName = true, proxy.ServerName
+		}
+	}
+	if proxy.Reality {
+		cp.Reality = &clashReality{PublicKey: proxy.PublicKey, ShortID: proxy.ShortID}
+	}
+
+	if proxy.Transport != "tcp" && (proxy.Protocol == "shadowsocks" || proxy.Protocol == "socks" || proxy.Protocol == "http") {
+		p.unsupported("outbound %s: transport %s of %s", proxy.Tag, proxy.Transport, proxy.Protocol)
+		return nil
+	}
+	switch proxy.Transport {
+	case "ws":
+		cp.Network, cp.WS = "ws", &clashWS{Path: proxy.Path}
+		if len(proxy.Host) > 0 {
+			cp.WS.Headers = map[string]string{"Host": proxy.Host}
+		}
+	case "grpc":
+		cp.Network, cp.GRPC = "grpc", &clashGRPC{ServiceName: proxy.ServiceName}
+	case "http":
+		cp.Network, cp.H2 = "h2", &clashH2{Path: proxy.Path}
+		if len(proxy.Host) > 0 {
+			cp.H2.Host = []string{proxy.Host}
+		}
+	}
+	return cp
+}
+
+// clashRules write a rule as Clash rules, one per value. Clash rules match one field,
+// rules matching several together are not simple rules.
+func clashRules(rule *exportRule, target string) ([]string, error) {
+	fields := 0
+	for _, n := range []int{len(rule.Domains), len(rule.IPs), len(rule.Ports), len(rule.Network)} {
+		if n > 0 {
+			fields++
+		}
+	}
+	if fields > 1 {
+		return nil, fmt.Errorf("matches several fields together")
+	}
+
+	var lines []string
+	add := func(typ, value string) {
+		lines = append(lines, typ+","+value+","+target)
+	}
+	for _, d := range rule.Domains {
+		kind, value, found := strings.Cut(d, ":")
+		if !found {
+			kind, value = "keyword", d
+		}
+		switch kind {
+		case "full":
+			add("DOMAIN", value)
+		case "domain":
+			add("DOMAIN-SUFFIX", value)
+		case "keyword":
+			add("DOMAIN-KEYWORD", value)
+		case "regexp":
+			add("DOMAIN-REGEX", value)
+		case "geosite":
+			add("GEOSITE", value)
+		default:
+			return nil, fmt.Errorf("domain %s", d)
+		}
+	}
+	for _, ip := range rule.IPs {
+		switch {
+		case strings.HasPrefix(ip, "geoip:!"):
+			return nil, fmt.Errorf("ip %s", ip)
+		case strings.HasPrefix(ip, "geoip:"):
+			code := strings.TrimPrefix(ip, "geoip:")
+			if code != "private" {
+				code = strings.ToUpper(code)
+			}
+			add("GEOIP", code)
+		case strings.HasPrefix(ip, "ext:"):
+			return nil, fmt.Errorf("ip %s", ip)
+		case strings.Contains(ip, ":"):
+			add("IP-CIDR6", cidr(ip))
+		default:
+			add("IP-CIDR", cidr(ip))
+		}
+	}
+	for _, port := range rule.Ports {
+		add("DST-PORT", port)
+	}
+	if len(rule.Network) > 0 {
+		for _, network := range strings.Split(rule.Network, ",") {
+			add("NETWORK", network)
+		}
+	}
+	return lines, nil
+}
+
+func profileFromClash(config *clashConfig) (*exportProfile, error) {
+	p := &exportProfile{}
+	for _, cp := range config.Proxies {
+		if proxy := p.proxyFromClash(cp); proxy != nil {
+			if p.proxy(proxy.Tag) != nil {
+				p.unsupported("proxy %s: duplicate name", proxy.Tag)
+				continue
+			}
+			p.Proxies = append(p.Proxies, proxy)
+		}
+	}
+	for _, group := range config.ProxyGroups {
+		p.unsupported("proxy-group %v", group["name"])
+	}
+
+	// DIRECT and REJECT become outbounds once a rule uses them
+	target := func(name string) string {
+		var proxy *exportProxy
+		switch strings.ToUpper(name) {
+		case "DIRECT":
+			proxy = &exportProxy{Tag: "direct", Protocol: "freedom"}
+		case "REJECT", "REJECT-DROP":
+			proxy = &exportProxy{Tag: "block", Protocol: "blackhole"}
+		default:
+			if p.proxy(name) != nil {
+				return name
+			}
+			return ""
+		}
+		if p.proxy(proxy.Tag) == nil {
+			p.Proxies = append(p.Proxies, proxy)
+		}
+		return proxy.Tag
+	}
+
+	var last *exportRule
+	lastKind := ""
+	for i, line := range config.Rules {
+		fields := strings.Split(line, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		typ := strings.ToUpper(fields[0])
+		if (typ == "MATCH" || typ == "FINAL") && len(fields) >= 2 {
+			if p.Final = target(fields[1]); len(p.Final) == 0 {
+				p.unsupported("rule %s: unknown target", line)
+			}
+			continue
+		}
+		if len(fields) < 3 {
+			p.unsupported("rule %s", line)
+			continue
+		}
+		value, outbound := fields[1], target(fields[2])
+		if len(outbound) == 0 {
+			p.unsupported("rule %s: unknown target", line)
+			continue
+		}
+
+		rule := &exportRule{Outbound: outbound, Index: i}
+		kind := "domain"
+		switch typ {
+		case "DOMAIN":
+			rule.Domains = []string{"full:" + value}
+		case "DOMAIN-SUFFIX":
+			rule.Domains = []string{"domain:" + value}
+		case "DOMAIN-KEYWORD":
+			rule.Domains = []string{"keyword:" + value}
+		case "DOMAIN-REGEX":
+			rule.Domains = []string{"regexp:" + value}
+		case "GEOSITE":
+			rule.Domains = []string{"geosite:" + strings.ToLower(value)}
+		case "IP-CIDR", "IP-CIDR6":
+			kind, rule.IPs = "ip", []string{value}
+		case "GEOIP":
+			kind, rule.IPs = "ip", []string{"geoip:" + strings.ToLower(value)}
+		case "DST-PORT":
+			kind, rule.Ports = "port", []string{value}
+		case "NETWORK":
+			kind, rule.Network = "network", strings.ToLower(value)
+		default:
+			p.unsupported("rule %s", line)
+			continue
+		}
+		// consecutive rules of a kind going to the same place are one xray rule
+		if last != nil && lastKind == kind && kind != "network" && last.Outbound == outbound {
+			last.Domains = append(last.Domains, rule.Domains...)
+			last.IPs = append(last.IPs, rule.IPs...)
+			last.Ports = append(last.Ports, rule.Ports...)
+			continue
+		}
+		p.Rules = append(p.Rules, rule)
+		last, lastKind = rule, kind
+	}
+
+	if len(p.Proxies) == 0 {
+		return nil, fmt.Errorf("no proxy to import")
+	}
+	if len(p.Final) == 0 {
+		p.Final = p.Proxies[0].Tag
+	}
+	return p, nil
+}
+
+func (p *exportProfile) proxyFromClash(cp *clashProxy) *exportProxy {
+	proxy := &exportProxy{
+		Tag: cp.Name, Server: cp.Server, Port: cp.Port, UUID: cp.UUID, Cipher: cp.Cipher, Flow: cp.Flow,
+		Username: cp.Username, Password: cp.Password, ALPN: cp.ALPN, Insecure: cp.SkipCertVerify,
+		Fingerprint: cp.ClientFingerprint, Transport: "tcp",
+	}
+	for protocol, typ := range clashTypes {
+		if strings.EqualFold(cp.Type, typ) {
+			proxy.Protocol = protocol
+		}
+	}
+	if len(proxy.Protocol) == 0 {
+		p.unsupported("proxy %s: type %s", cp.Name, cp.Type)
+		return nil
+	}
+	for _, key := range sortedKeys(cp.Extra) {
+		p.unsupported("proxy %s: %s", cp.Name, key)
+	}
+	if cp.AlterID != nil {
+		proxy.AlterID = *cp.AlterID
+	}
+	proxy.TLS = cp.TLS || proxy.Protocol == "trojan"
+	proxy.ServerName = cp.ServerName
+	if len(cp.SNI) > 0 {
+		proxy.ServerName = cp.SNI
+	}
+	if cp.Reality != nil {
+		proxy.TLS, proxy.Reality = true, true
+		proxy.PublicKey, proxy.ShortID = cp.Reality.PublicKey, cp.Reality.ShortID
+	}
+
+	switch strings.ToLower(cp.Network) {
+	case "", "tcp":
+	case "ws":
+		proxy.Transport = "ws"
+		if cp.WS != nil {
+			proxy.Path, proxy.Host = cp.WS.Path, cp.WS.Headers["Host"]
+		}
+	case "grpc":
+		proxy.Transport = "grpc"
+		if cp.GRPC != nil {
+			proxy.ServiceName = cp.GRPC.ServiceName
+		}
+	case "h2":
+		proxy.Transport = "http"
+		if cp.H2 != nil {
+			proxy.Path = cp.H2.Path
+			if len(cp.H2.Host) > 0 {
+				proxy.Host = cp.H2.Host[0]
+			}
+		}
+	default:
+		p.unsupported("proxy %s: network %s", cp.Name, cp.Network)
+		return nil
+	}
+	return proxy
+}
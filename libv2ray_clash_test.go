@@ -0,0 +1,96 @@
+package libv2ray
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExportClashConfig(t *testing.T) {
+	r, err := decodeExportResult(ExportClashConfig(exportXrayConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Unsupported) > 0 {
+		t.Fatal(r.Unsupported)
+	}
+	for _, want := range []string{
+		"name: proxy", "type: ss", "client-fingerprint: chrome", "public-key: Z84J2IelR9ch3k8VtlVhhs5ycBUlXA7wHBWcBrjqnAw",
+		"skip-cert-verify: true", "grpc-service-name: tun", "Host: cdn.example.com",
+		"GEOSITE,category-ads-all,REJECT", "DOMAIN-SUFFIX,example.org,ws", "DOMAIN,www.example.net,ws",
+		"DOMAIN-KEYWORD,video,ws", "GEOIP,private,DIRECT", "IP-CIDR,10.0.0.1/32,DIRECT", "IP-CIDR6,fd00::/8,DIRECT",
+		"GEOIP,CN,DIRECT", "DST-PORT,1000-2000,ss", "NETWORK,udp,grpc", "MATCH,proxy",
+	} {
+		if !strings.Contains(r.Config, want) {
+			t.Errorf("%q missing in\n%s", want, r.Config)
+		}
+	}
+
+	// export, import and export again gives the same Clash config
+	imported, err := decodeExportResult(ImportClashConfig(r.Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported.Unsupported) > 0 {
+		t.Fatal(imported.Unsupported)
+	}
+	again, err := decodeExportResult(ExportClashConfig(imported.Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Config != r.Config {
+		t.Errorf("round trip changed the config:\n%s\n%s", r.Config, again.Config)
+	}
+
+	r, err = decodeExportResult(ExportClashConfig(exportUnsupportedConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectUnsupported(t, r.Unsupported, "mux", "transport kcp", "rule 0: matches several fields", "rule 2: ip geoip:!cn",
+		"rule 4: matches several fields")
+}
+
+func TestImportClashConfig(t *testing.T) {
+	r, err := decodeExportResult(ImportClashConfig(`
+proxies:
+  - {name: hk, type: trojan, server: hk.example.com, port: 443, password: secret, sni: hk.example.com, udp: true}
+  - {name: jp, type: vmess, server: jp.example.com, port: 443, uuid: b831381d-6324-4d53-ad4f-8cda48b30811,
+     alterId: 0, cipher: auto, tls: true, network: ws, ws-opts: {path: /ray}, smux: {enabled: true}}
+  - {name: hy, type: hysteria2, server: hy.example.com, port: 443, password: secret}
+proxy-groups:
+  - {name: auto, type: url-test, proxies: [hk, jp]}
+rules:
+  - DOMAIN-SUFFIX,google.com,hk
+  - DOMAIN-SUFFIX,youtube.com,hk
+  - DOMAIN-KEYWORD,ads,REJECT
+  - IP-CIDR,192.168.0.0/16,DIRECT,no-resolve
+  - PROCESS-NAME,curl,DIRECT
+  - DOMAIN,auto.example.com,auto
+  - MATCH,jp
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectUnsupported(t, r.Unsupported, "proxy jp: smux", "proxy hy: type hysteria2", "proxy-group auto",
+		"PROCESS-NAME,curl,DIRECT", "DOMAIN,auto.example.com,auto: unknown target")
+
+	if _, err := loadCoreConfig(r.Config); err != nil {
+		t.Fatal(err)
+	}
+	p, err := profileFromXray(r.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []string
+	for _, proxy := range p.Proxies {
+		tags = append(tags, proxy.Tag)
+	}
+	if strings.Join(tags, ",") != "jp,hk,block,direct" {
+		t.Errorf("outbounds %v", tags)
+	}
+	if len(p.Rules) != 3 || strings.Join(p.Rules[0].Domains, ",") != "domain:google.com,domain:youtube.com" {
+		t.Errorf("%+v", p.Rules)
+	}
+	if hk := p.proxy("hk"); !hk.TLS || hk.ServerName != "hk.example.com" {
+		t.Errorf("%+v", hk)
+	}
+}
@@ -0,0 +1,423 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtls/xray-core/app/dispatcher"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/session"
+	v2core "github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/dns"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/features/policy"
+	"github.com/xtls/xray-core/features/routing"
+	v2stats "github.com/xtls/xray-core/features/stats"
+	v2conf "github.com/xtls/xray-core/infra/conf"
+	v2json "github.com/xtls/xray-core/infra/conf/json"
+	v2serial "github.com/xtls/xray-core/infra/conf/serial"
+	"github.com/xtls/xray-core/transport"
+)
+
+// libOutbound is an outbound implemented by this library,
+// it is added to the core instance after the core is created.
+type libOutbound interface {
+	outbound.Handler
+	init(ohm outbound.Manager)
+}
+
+// outboundFilter sees connections from inbounds on their way to the routed outbound.
+// It may reject them, or return a context and link to follow them.
+// A context carrying redirectOutbound sends the connection to that outbound instead.
+type outboundFilter interface {
+	filter(ctx context.Context, tag string, link *transport.Link) (context.Context, *transport.Link, error)
+}
+
+// dispatchFilter is an outboundFilter run by the dispatcher, once for each connection
+// before any outbound gets it, the default one included whatever its tag
+type dispatchFilter interface {
+	outboundFilter
+	dispatchOnly()
+}
+
+type redirectKey struct{}
+
+func redirectOutbound(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, redirectKey{}, tag)
+}
+
+// libProtocols are outbound protocols implemented by this library
+var libProtocols = map[string]bool{"fallback": true, "dualpath": true}
+
+// coreConfig is a json config with the extensions implemented by this library
+// taken out, so that xray itself only sees what it knows. Outbounds of this library
+// stay in json, indexes there match the config content, they are only left out of core.
+type coreConfig struct {
+	json        *v2conf.Config
+	core        *v2core.Config
+	outbounds   []libOutbound
+	expressions *expressionRouter
+}
+
+func loadCoreConfig(content string) (*coreConfig, error) {
+	jsonConfig, err := v2serial.DecodeJSONConfig(strings.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &coreConfig{json: jsonConfig}
+	balancers, err := extractBalancers(jsonConfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range balancers {
+		c.outbounds = append(c.outbounds, b)
+	}
+	monitors, err := extractReverseMonitors(jsonConfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range monitors {
+		c.outbounds = append(c.outbounds, m)
+	}
+	groups, err := extractFallbackGroups(jsonConfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		c.outbounds = append(c.outbounds, g)
+	}
+	dualPaths, err := extractDualPaths(jsonConfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dualPaths {
+		c.outbounds = append(c.outbounds, d)
+	}
+	var coreRules []json.RawMessage
+	if c.expressions, coreRules, err = extractExpressionRules(jsonConfig); err != nil {
+		return nil, err
+	}
+
+	if err := checkOutboundCycles(c.outbounds); err != nil {
+		return nil, err
+	}
+
+	built := *jsonConfig
+	built.OutboundConfigs = make([]v2conf.OutboundDetourConfig, 0, len(jsonConfig.OutboundConfigs))
+	for _, ob := range jsonConfig.OutboundConfigs {
+		if !libProtocols[strings.ToLower(ob.Protocol)] {
+			built.OutboundConfigs = append(built.OutboundConfigs, ob)
+		}
+	}
+	if c.expressions != nil {
+		routerConfig := *jsonConfig.RouterConfig
+		routerConfig.RuleList = coreRules
+		built.RouterConfig = &routerConfig
+	}
+	if c.core, err = built.Build(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// outboundMembers return the outbounds an outbound of this library goes over by tag
+func outboundMembers(h libOutbound) []string {
+	switch o := h.(type) {
+	case *fallbackGroup:
+		return o.members
+	case *dualPath:
+		return o.paths[:]
+	}
+	return nil
+}
+
+// checkOutboundCycles fail if outbounds of this library go over each other in a loop
+func checkOutboundCycles(outbounds []libOutbound) error {
+	members := make(map[string][]string)
+	for _, h := range outbounds {
+		if m := outboundMembers(h); len(m) > 0 {
+			members[h.Tag()] = m
+		}
+	}
+	// 1 while visiting, 2 once done
+	state := make(map[string]int)
+	var visit func(tag string, path []string) error
+	visit = func(tag string, path []string) error {
+		switch state[tag] {
+		case 1:
+			return fmt.Errorf("outbounds go over each other: %s", strings.Join(append(path, tag), " -> "))
+		case 2:
+			return nil
+		}
+		state[tag] = 1
+		for _, m := range members[tag] {
+			if err := visit(m, append(path, tag)); err != nil {
+				return err
+			}
+		}
+		state[tag] = 2
+		return nil
+	}
+	for _, h := range outbounds {
+		if err := visit(h.Tag(), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newInstance create the core and attach outbounds of this library,
+// tagged outbounds are put behind filters. Outbounds of this library are filtered
+// themselves, what they dispatch to their members is filtered already.
+// Dispatch filters are run by the dispatcher instead.
+func (c *coreConfig) newInstance(all ...outboundFilter) (*v2core.Instance, error) {
+	var filters, dispatchFilters []outboundFilter
+	for _, f := range all {
+		if _, ok := f.(dispatchFilter); ok {
+			dispatchFilters = append(dispatchFilters, f)
+		} else {
+			filters = append(filters, f)
+		}
+	}
+
+	inst, err := v2core.New(c.core)
+	if err != nil {
+		return nil, err
+	}
+
+	ohm := inst.GetFeature(outbound.ManagerType()).(outbound.Manager)
+	for _, h := range c.outbounds {
+		h.init(ohm)
+		if err := ohm.AddHandler(context.Background(), h); err != nil {
+			inst.Close()
+			return nil, err
+		}
+	}
+	router, _ := inst.GetFeature(routing.RouterType()).(routing.Router)
+	if c.expressions != nil {
+		client, _ := inst.GetFeature(dns.ClientType()).(dns.Client)
+		c.expressions.init(router, client)
+		router = c.expressions
+	}
+	dispatched := &dispatchedOutbounds{Manager: ohm, filters: dispatchFilters}
+	if err := redispatch(inst, &tracingRouter{Router: router}, dispatched); err != nil {
+		inst.Close()
+		return nil, err
+	}
+	if len(filters) > 0 {
+		if err := filterOutbounds(ohm, filters); err != nil {
+			inst.Close()
+			return nil, err
+		}
+	}
+	return inst, nil
+}
+
+// redispatch make the dispatcher of inst pick routes from router and outbounds from ohm
+func redispatch(inst *v2core.Instance, router routing.Router, ohm outbound.Manager) error {
+	d, ok := inst.GetFeature(routing.DispatcherType()).(*dispatcher.DefaultDispatcher)
+	if !ok {
+		return errors.New("dispatcher can not be replaced")
+	}
+	return d.Init(&dispatcher.Config{},
+		ohm,
+		router,
+		inst.GetFeature(policy.ManagerType()).(policy.Manager),
+		inst.GetFeature(v2stats.ManagerType()).(v2stats.Manager),
+		inst.GetFeature(dns.ClientType()).(dns.Client))
+}
+
+// dispatchedOutbounds is the outbound manager as the dispatcher sees it,
+// handlers it gives out run dispatch filters first
+type dispatchedOutbounds struct {
+	outbound.Manager
+	filters []outboundFilter
+}
+
+// GetHandler implements outbound.Manager.
+func (m *dispatchedOutbounds) GetHandler(tag string) outbound.Handler {
+	return m.dispatched(m.Manager.GetHandler(tag))
+}
+
+// GetDefaultHandler implements outbound.Manager.
+func (m *dispatchedOutbounds) GetDefaultHandler() outbound.Handler {
+	return m.dispatched(m.Manager.GetDefaultHandler())
+}
+
+func (m *dispatchedOutbounds) dispatched(h outbound.Handler) outbound.Handler {
+	if h == nil || len(m.filters) == 0 {
+		return h
+	}
+	return &dispatchedOutbound{Handler: h, filters: m.filters}
+}
+
+// dispatchedOutbound is an outbound handed out by the dispatcher
+type dispatchedOutbound struct {
+	outbound.Handler
+	filters []outboundFilter
+}
+
+// Dispatch implements outbound.Handler.
+func (h *dispatchedOutbound) Dispatch(ctx context.Context, link *transport.Link) {
+	ctx, link, ok := runFilters(ctx, h.Tag(), link, h.filters)
+	if ok {
+		h.Handler.Dispatch(ctx, link)
+	}
+}
+
+// runFilters pass a connection through filters, one refusing it closes it
+func runFilters(ctx context.Context, tag string, link *transport.Link, filters []outboundFilter) (context.Context, *transport.Link, bool) {
+	for _, f := range filters {
+		var err error
+		if ctx, link, err = f.filter(ctx, tag, link); err != nil {
+			log.Printf("outbound %s: %v", tag, err)
+			session.SubmitOutboundErrorToOriginator(ctx, err)
+			common.Interrupt(link.Writer)
+			common.Interrupt(link.Reader)
+			return ctx, link, false
+		}
+	}
+	return ctx, link, true
+}
+
+// filteredOutbound is an outbound behind filters
+type filteredOutbound struct {
+	outbound.Handler
+	filters []outboundFilter
+	ohm     outbound.Manager
+}
+
+// Dispatch implements outbound.Handler.
+func (h *filteredOutbound) Dispatch(ctx context.Context, link *transport.Link) {
+	ctx, link, ok := runFilters(ctx, h.Tag(), link, h.filters)
+	if !ok {
+		return
+	}
+	if tag, _ := ctx.Value(redirectKey{}).(string); len(tag) > 0 && tag != h.Tag() {
+		if r := h.ohm.GetHandler(tag); r != nil {
+			// redirected once, outbounds chained after it go where they are told
+			r.Dispatch(redirectOutbound(ctx, ""), link)
+			return
+		}
+		log.Printf("outbound %s: no outbound %s to redirect to", h.Tag(), tag)
+	}
+	outboundTraceFromContext(ctx).dispatched(h.Tag())
+	h.Handler.Dispatch(ctx, link)
+}
+
+// unfiltered return the outbound behind filters
+func unfiltered(h outbound.Handler) outbound.Handler {
+	if f, ok := h.(*filteredOutbound); ok {
+		return f.Handler
+	}
+	return h
+}
+
+// countingReader count bytes read from a link
+type countingReader struct {
+	buf.Reader
+	bytes *int64
+}
+
+func (r *countingReader) ReadMultiBuffer() (buf.MultiBuffer, error) {
+	mb, err := r.Reader.ReadMultiBuffer()
+	atomic.AddInt64(r.bytes, int64(mb.Len()))
+	return mb, err
+}
+
+// ReadMultiBufferTimeout keep the timeout reader of the pipe usable by outbounds
+func (r *countingReader) ReadMultiBufferTimeout(timeout time.Duration) (buf.MultiBuffer, error) {
+	tr, ok := r.Reader.(buf.TimeoutReader)
+	if !ok {
+		return r.ReadMultiBuffer()
+	}
+	mb, err := tr.ReadMultiBufferTimeout(timeout)
+	atomic.AddInt64(r.bytes, int64(mb.Len()))
+	return mb, err
+}
+
+func (r *countingReader) Interrupt() {
+	common.Interrupt(r.Reader)
+}
+
+// countingWriter count bytes written to a link, and the unix time of the last write if last is set
+type countingWriter struct {
+	buf.Writer
+	bytes *int64
+	last  *int64
+}
+
+func (w *countingWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	atomic.AddInt64(w.bytes, int64(mb.Len()))
+	if w.last != nil {
+		atomic.StoreInt64(w.last, time.Now().Unix())
+	}
+	return w.Writer.WriteMultiBuffer(mb)
+}
+
+func (w *countingWriter) Close() error {
+	return common.Close(w.Writer)
+}
+
+func (w *countingWriter) Interrupt() {
+	common.Interrupt(w.Writer)
+}
+
+// filterOutbounds replace tagged outbounds with filtered ones, the default one first
+// so that it stays the default. An untagged default outbound can not be replaced.
+func filterOutbounds(ohm outbound.Manager, filters []outboundFilter) error {
+	hs, ok := ohm.(outbound.HandlerSelector)
+	if !ok {
+		return nil
+	}
+	tags := hs.Select([]string{""})
+	if def := ohm.GetDefaultHandler(); def != nil && len(def.Tag()) > 0 {
+		tags = append([]string{def.Tag()}, tags...)
+	}
+
+	ctx := context.Background()
+	for _, tag := range tags {
+		h := ohm.GetHandler(tag)
+		if _, done := h.(*filteredOutbound); done || h == nil {
+			continue
+		}
+		if err := ohm.RemoveHandler(ctx, tag); err != nil {
+			return err
+		}
+		if err := ohm.AddHandler(ctx, &filteredOutbound{Handler: h, filters: filters, ohm: ohm}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeConfigMap decode a json config for editing, comments are allowed as in xray
+func decodeConfigMap(content string) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	decoder := json.NewDecoder(&v2json.Reader{Reader: strings.NewReader(content)})
+	decoder.UseNumber()
+	if err := decoder.Decode(&m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// configOutbounds return outbounds of a decoded config map
+func configOutbounds(m map[string]interface{}) []map[string]interface{} {
+	list, _ := m["outbounds"].([]interface{})
+	outbounds := make([]map[string]interface{}, 0, len(list))
+	for _, o := range list {
+		if ob, ok := o.(map[string]interface{}); ok {
+			outbounds = append(outbounds, ob)
+		}
+	}
+	return outbounds
+}
@@ -0,0 +1,167 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// edits within this period are applied as one reload, editors write files in several steps
+const configFileDebounce = 500 * time.Millisecond
+
+/*
+SetConfigFiles Load config from files instead of ConfigureFileContent, one path per line.
+Several files are merged in order as xray does with multiple -config: later files replace
+top level sections, inbounds and outbounds with the same tag are replaced, other inbounds
+are appended and other outbounds prepended, or appended if the file name contains "tail".
+Files are watched, edits are validated and applied through ReloadConfig,
+an invalid edit leaves the running config alone. ConfigureFileContent is left
+as the host set it, empty paths stop watching and bring it back in use.
+*/
+func (v *V2RayPoint) SetConfigFiles(paths string) error {
+	files := splitConfigPaths(paths)
+	if len(files) == 0 {
+		v.stopConfigWatcher()
+		v.v2rayOP.Lock()
+		v.configFiles = false
+		v.fileContent = ""
+		v.v2rayOP.Unlock()
+		return nil
+	}
+	content, err := mergeConfigFiles(files)
+	if err != nil {
+		return err
+	}
+	config, err := loadCoreConfig(content)
+	if err != nil {
+		return err
+	}
+
+	v.v2rayOP.Lock()
+	fromFiles, fileContent := v.configFiles, v.fileContent
+	if !fromFiles {
+		// the config in use until the files are
+		v.fileContent = v.ConfigureFileContent
+	}
+	v.configFiles = true
+	err = v.reloadConfig(config, content, "")
+	if err != nil {
+		v.configFiles, v.fileContent = fromFiles, fileContent
+	}
+	v.v2rayOP.Unlock()
+	if err != nil {
+		return err
+	}
+	return v.startConfigWatcher(files, v.reloadConfigFiles)
+}
+
+// reloadConfigFiles merge watched files again, called after they settle down
+func (v *V2RayPoint) reloadConfigFiles(files []string) {
+	content, err := mergeConfigFiles(files)
+	if err != nil {
+		log.Printf("config files not reloaded: %v", err)
+		v.SupportSet.OnEmitStatus(0, fmt.Sprintf("Config error: %v", err))
+		return
+	}
+	v.v2rayOP.Lock()
+	unchanged := content == v.configContent()
+	v.v2rayOP.Unlock()
+	if unchanged {
+		return
+	}
+	log.Printf("config files changed: %v", files)
+	if err := v.ReloadConfig(content, ""); err != nil {
+		v.SupportSet.OnEmitStatus(0, fmt.Sprintf("Config error: %v", err))
+	}
+}
+
+func splitConfigPaths(paths string) []string {
+	files := make([]string, 0)
+	for _, p := range strings.Split(paths, "\n") {
+		p = strings.TrimSpace(p)
+		if len(p) == 0 {
+			continue
+		}
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+		files = append(files, p)
+	}
+	return files
+}
+
+// mergeConfigFiles read json config files and merge them into one config
+func mergeConfigFiles(files []string) (string, error) {
+	if len(files) == 0 {
+		return "", errors.New("no config file")
+	}
+	var merged map[string]interface{}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		m, err := decodeConfigMap(string(b))
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", file, err)
+		}
+		if merged == nil {
+			merged = m
+			continue
+		}
+		mergeConfigMap(merged, m, strings.Contains(strings.ToLower(filepath.Base(file)), "tail"))
+	}
+
+	b, err := json.Marshal(merged)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func mergeConfigMap(c map[string]interface{}, o map[string]interface{}, tail bool) {
+	for key, value := range o {
+		switch key {
+		case "inbounds":
+			c[key] = mergeTagged(c[key], value, true)
+		case "outbounds":
+			c[key] = mergeTagged(c[key], value, tail)
+		default:
+			c[key] = value
+		}
+	}
+}
+
+// mergeTagged replace items of the same tag, add the others to the end or the front
+func mergeTagged(current interface{}, override interface{}, appendNew bool) []interface{} {
+	list, _ := current.([]interface{})
+	others, _ := override.([]interface{})
+	prepends := make([]interface{}, 0)
+	for _, item := range others {
+		tag := ""
+		if m, ok := item.(map[string]interface{}); ok {
+			tag, _ = m["tag"].(string)
+		}
+		found := false
+		for i, existing := range list {
+			if m, ok := existing.(map[string]interface{}); ok && len(tag) > 0 && m["tag"] == tag {
+				list[i] = item
+				found = true
+				break
+			}
+		}
+		switch {
+		case found:
+		case appendNew:
+			list = append(list, item)
+		default:
+			prepends = append(prepends, item)
+		}
+	}
+	return append(prepends, list...)
+}
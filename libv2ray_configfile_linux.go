@@ -0,0 +1,135 @@
+package libv2ray
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+type configWatcher struct {
+	fd   int
+	dirs map[int]string
+	done chan struct{}
+}
+
+// startConfigWatcher watch directories of files, so that editors replacing them by rename are seen
+func (v *V2RayPoint) startConfigWatcher(files []string, changed func([]string)) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	w := &configWatcher{fd: fd, dirs: make(map[int]string), done: make(chan struct{})}
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		wd, err := unix.InotifyAddWatch(fd, dir,
+			unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_CREATE|unix.IN_DELETE)
+		if err != nil {
+			unix.Close(fd)
+			return err
+		}
+		w.dirs[wd] = dir
+	}
+
+	v.v2rayOP.Lock()
+	if v.fileWatcher != nil {
+		close(v.fileWatcher.done)
+	}
+	v.fileWatcher = w
+	v.v2rayOP.Unlock()
+
+	go w.run(files, changed)
+	log.Printf("watching config files: %v", files)
+	return nil
+}
+
+func (v *V2RayPoint) stopConfigWatcher() {
+	v.v2rayOP.Lock()
+	defer v.v2rayOP.Unlock()
+	if v.fileWatcher != nil {
+		close(v.fileWatcher.done)
+		v.fileWatcher = nil
+	}
+}
+
+func (w *configWatcher) run(files []string, changed func([]string)) {
+	defer unix.Close(w.fd)
+
+	watched := make(map[string]bool, len(files))
+	for _, file := range files {
+		watched[file] = true
+	}
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		select {
+		case <-w.done:
+			log.Println("config watcher stopped")
+			return
+		default:
+		}
+
+		// wake up from time to time to check if stopped
+		fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+		if _, err := unix.Poll(fds, 1000); err != nil && !errors.Is(err, unix.EINTR) {
+			log.Printf("config watcher err: %v", err)
+			return
+		}
+		n, err := unix.Read(w.fd, buf)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				continue
+			}
+			log.Printf("config watcher err: %v", err)
+			return
+		}
+		if !w.touches(buf[:n], watched) {
+			continue
+		}
+
+		if timer == nil {
+			timer = time.AfterFunc(configFileDebounce, func() {
+				select {
+				case <-w.done:
+				default:
+					changed(files)
+				}
+			})
+		} else {
+			timer.Reset(configFileDebounce)
+		}
+	}
+}
+
+// touches report if any inotify event in b is about a watched file
+func (w *configWatcher) touches(b []byte, watched map[string]bool) bool {
+	found := false
+	for len(b) >= unix.SizeofInotifyEvent {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&b[0]))
+		end := unix.SizeofInotifyEvent + int(event.Len)
+		if end > len(b) {
+			break
+		}
+		name := string(b[unix.SizeofInotifyEvent:end])
+		for i := 0; i < len(name); i++ {
+			if name[i] == 0 {
+				name = name[:i]
+				break
+			}
+		}
+		if event.Mask&unix.IN_Q_OVERFLOW != 0 || watched[filepath.Join(w.dirs[int(event.Wd)], name)] {
+			found = true
+		}
+		b = b[end:]
+	}
+	return found
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package libv2ray
+
+import "log"
+
+type configWatcher struct{}
+
+// startConfigWatcher inotify is only available on Linux, files are read once elsewhere
+func (v *V2RayPoint) startConfigWatcher(files []string, changed func([]string)) error {
+	log.Println("config file watcher not supported on this platform")
+	return nil
+}
+
+func (v *V2RayPoint) stopConfigWatcher() {
+}
@@ -0,0 +1,93 @@
+package libv2ray
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMergeConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	base := writeConfigFile(t, dir, "base.json", `{
+		// comments are allowed
+		"log": {"loglevel": "warning"},
+		"inbounds": [{"tag": "socks", "protocol": "socks", "port": 10808}],
+		"outbounds": [{"tag": "proxy", "protocol": "vmess"}, {"tag": "direct", "protocol": "freedom"}]}`)
+	override := writeConfigFile(t, dir, "override.json", `{
+		"log": {"loglevel": "debug"},
+		"inbounds": [{"tag": "socks", "protocol": "socks", "port": 1080}, {"tag": "http", "protocol": "http", "port": 1081}],
+		"outbounds": [{"tag": "proxy", "protocol": "freedom"}, {"tag": "first", "protocol": "freedom"}]}`)
+	tail := writeConfigFile(t, dir, "tail.json", `{"outbounds": [{"tag": "last", "protocol": "blackhole"}]}`)
+
+	content, err := mergeConfigFiles([]string{base, override, tail})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadCoreConfig(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := make([]string, 0)
+	for _, ob := range config.json.OutboundConfigs {
+		tags = append(tags, ob.Tag+":"+ob.Protocol)
+	}
+	if got := strings.Join(tags, ","); got != "first:freedom,proxy:freedom,direct:freedom,last:blackhole" {
+		t.Errorf("unexpected outbounds %s", got)
+	}
+	if ibs := config.json.InboundConfigs; len(ibs) != 2 || ibs[0].PortList.Range[0].From != 1080 {
+		t.Errorf("unexpected inbounds %+v", ibs)
+	}
+	if config.json.LogConfig.LogLevel != "debug" {
+		t.Errorf("log not replaced: %s", config.json.LogConfig.LogLevel)
+	}
+
+	if _, err := mergeConfigFiles([]string{base, filepath.Join(dir, "missing.json")}); err == nil {
+		t.Error("expect error of missing file")
+	}
+}
+
+func TestSetConfigFiles(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "android" {
+		t.Skip("inotify only")
+	}
+	dir := t.TempDir()
+	path := writeConfigFile(t, dir, "config.json", `{"outbounds": [{"tag": "direct", "protocol": "freedom"}]}`)
+
+	v := &V2RayPoint{}
+	if err := v.SetConfigFiles(path + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	defer v.SetConfigFiles("")
+	if !strings.Contains(v.fileContent, `"direct"`) || len(v.ConfigureFileContent) > 0 {
+		t.Fatalf("config not loaded apart: %q %q", v.fileContent, v.ConfigureFileContent)
+	}
+
+	// editors save to a temporary file and rename it over the original
+	tmp := writeConfigFile(t, dir, ".config.json.swp", `{"outbounds": [{"tag": "edited", "protocol": "freedom"}]}`)
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		v.v2rayOP.Lock()
+		content := v.configContent()
+		v.v2rayOP.Unlock()
+		if strings.Contains(content, `"edited"`) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("edit not reloaded")
+}
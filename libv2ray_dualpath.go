@@ -0,0 +1,339 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	v2conf "github.com/xtls/xray-core/infra/conf"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+const (
+	// how long an answer is remembered to drop its copy from the other path
+	dualPathWindow = 2 * time.Second
+	// what may wait for a slow path before its packets are dropped
+	dualPathQueueLimit = 64 << 10
+)
+
+// dualPath is an outbound of protocol "dualpath", sending each UDP packet over
+// both of its outbounds and keeping the first copy of each answer.
+// {"tag": "game", "protocol": "dualpath", "settings": {"outbounds": ["proxy-hk", "proxy-jp"]}}
+// TCP connections only go over the first outbound.
+type dualPath struct {
+	tag   string
+	paths [2]string
+	ohm   outbound.Manager
+
+	sync.Mutex
+	answers    int64
+	duplicates int64
+	stats      [2]dualPathStats
+}
+
+type dualPathStats struct {
+	Tag      string  `json:"tag"`
+	Sent     int64   `json:"sent"`
+	Received int64   `json:"received"`
+	Wins     int64   `json:"wins"`
+	WinRate  float64 `json:"winRate"`
+}
+
+type dualPathStatus struct {
+	Tag        string           `json:"tag"`
+	Answers    int64            `json:"answers"`
+	Duplicates int64            `json:"duplicates"`
+	Paths      []*dualPathStats `json:"paths"`
+}
+
+/*
+GetDualPathStatus return packets sent and answers won by each path of dualpath outbounds
+in the running config as JSON, empty string if core is not running.
+*/
+func (v *V2RayPoint) GetDualPathStatus() string {
+	_, config := v.runningCore()
+	if config == nil {
+		return ""
+	}
+
+	outbounds := make([]*dualPathStatus, 0)
+	for _, h := range config.outbounds {
+		if d, ok := h.(*dualPath); ok {
+			outbounds = append(outbounds, d.status())
+		}
+	}
+	b, err := json.Marshal(map[string]interface{}{"outbounds": outbounds})
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return string(b)
+}
+
+func (d *dualPath) init(ohm outbound.Manager) {
+	d.ohm = ohm
+}
+
+// Tag implements outbound.Handler.
+func (d *dualPath) Tag() string {
+	return d.tag
+}
+
+// Start implements common.Runnable.
+func (d *dualPath) Start() error {
+	return nil
+}
+
+// Close implements common.Closable.
+func (d *dualPath) Close() error {
+	return nil
+}
+
+// Dispatch implements outbound.Handler.
+func (d *dualPath) Dispatch(ctx context.Context, link *transport.Link) {
+	ob := session.OutboundFromContext(ctx)
+	if ob == nil || ob.Target.Network != net.Network_UDP {
+		if h := d.ohm.GetHandler(d.paths[0]); h != nil {
+			h.Dispatch(ctx, link)
+			return
+		}
+		session.SubmitOutboundErrorToOriginator(ctx, fmt.Errorf("dualpath %s: no outbound %s", d.tag, d.paths[0]))
+		common.Interrupt(link.Writer)
+		common.Interrupt(link.Reader)
+		return
+	}
+
+	c := &dualPathConn{group: d, link: link, done: make(chan struct{})}
+	var handlers [2]outbound.Handler
+	for i, tag := range d.paths {
+		if handlers[i] = d.ohm.GetHandler(tag); handlers[i] == nil {
+			log.Printf("dualpath %s: no outbound %s", d.tag, tag)
+			c.end(i, true)
+			continue
+		}
+		c.uplinks[i], c.writers[i] = pipe.New(pipe.WithSizeLimit(dualPathQueueLimit), pipe.DiscardOverflow())
+	}
+	go c.pump()
+	for i, h := range handlers {
+		if h == nil {
+			continue
+		}
+		// each path gets its own session, outbounds may change it
+		pathOb := *ob
+		go h.Dispatch(session.ContextWithOutbound(ctx, &pathOb), &transport.Link{
+			Reader: &dualPathReader{Reader: c.uplinks[i], conn: c, path: i},
+			Writer: &dualPathWriter{conn: c, path: i},
+		})
+	}
+	<-c.done
+}
+
+func (d *dualPath) status() *dualPathStatus {
+	d.Lock()
+	defer d.Unlock()
+	s := &dualPathStatus{Tag: d.tag, Answers: d.answers, Duplicates: d.duplicates}
+	for i, tag := range d.paths {
+		p := d.stats[i]
+		p.Tag = tag
+		if d.answers > 0 {
+			p.WinRate = float64(p.Wins) / float64(d.answers)
+		}
+		s.Paths = append(s.Paths, &p)
+	}
+	return s
+}
+
+// dualPathConn is a UDP connection going over both paths at once
+type dualPathConn struct {
+	group   *dualPath
+	link    *transport.Link
+	uplinks [2]*pipe.Reader
+	writers [2]*pipe.Writer
+
+	sync.Mutex
+	seen        map[uint64]*[2]int
+	older       map[uint64]*[2]int
+	rotated     time.Time
+	ended       [2]bool
+	interrupted bool
+	done        chan struct{}
+}
+
+// pump copy each packet from the client to both paths
+func (c *dualPathConn) pump() {
+	for {
+		mb, err := c.link.Reader.ReadMultiBuffer()
+		if !mb.IsEmpty() {
+			d := c.group
+			for i, w := range c.writers {
+				if w == nil {
+					continue
+				}
+				d.Lock()
+				d.stats[i].Sent += int64(len(mb))
+				d.Unlock()
+				w.WriteMultiBuffer(copyMultiBuffer(mb))
+			}
+			buf.ReleaseMulti(mb)
+		}
+		if err != nil {
+			for _, w := range c.writers {
+				if w != nil {
+					w.Close()
+				}
+			}
+			return
+		}
+	}
+}
+
+// first tell if b is not a copy of an answer the other path already gave.
+// Answers are counted by payload and source on each path, so that a server
+// answering the same payload twice gets both copies through.
+func (c *dualPathConn) first(path int, b *buf.Buffer) bool {
+	h := fnv.New64a()
+	h.Write(b.Bytes())
+	if b.UDP != nil {
+		h.Write([]byte(b.UDP.NetAddr()))
+	}
+	key := h.Sum64()
+
+	c.Lock()
+	defer c.Unlock()
+	if now := time.Now(); c.seen == nil || now.Sub(c.rotated) > dualPathWindow {
+		c.older, c.seen, c.rotated = c.seen, make(map[uint64]*[2]int), now
+	}
+	counts, found := c.seen[key]
+	if !found {
+		if counts, found = c.older[key]; found {
+			delete(c.older, key)
+		} else {
+			counts = new([2]int)
+		}
+		c.seen[key] = counts
+	}
+	counts[path]++
+	return counts[path] > counts[1-path]
+}
+
+// end a path, the client connection ends with the last one
+func (c *dualPathConn) end(path int, interrupted bool) {
+	c.Lock()
+	if c.ended[path] {
+		c.Unlock()
+		return
+	}
+	c.ended[path] = true
+	c.interrupted = c.interrupted || interrupted
+	last := c.ended[0] && c.ended[1]
+	c.Unlock()
+	if !last {
+		return
+	}
+
+	if c.interrupted {
+		common.Interrupt(c.link.Writer)
+	} else {
+		common.Close(c.link.Writer)
+	}
+	common.Interrupt(c.link.Reader)
+	close(c.done)
+}
+
+// dualPathReader is the uplink of one path, stopping it leaves the other path running
+type dualPathReader struct {
+	*pipe.Reader
+	conn *dualPathConn
+	path int
+}
+
+func (r *dualPathReader) Interrupt() {
+	r.Reader.Interrupt()
+	r.conn.end(r.path, true)
+}
+
+// dualPathWriter is the downlink of one path, dropping answers the other path already gave
+type dualPathWriter struct {
+	conn *dualPathConn
+	path int
+}
+
+func (w *dualPathWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	d := w.conn.group
+	kept := make(buf.MultiBuffer, 0, len(mb))
+	for _, b := range mb {
+		first := w.conn.first(w.path, b)
+		d.Lock()
+		d.stats[w.path].Received++
+		if first {
+			d.answers++
+			d.stats[w.path].Wins++
+		} else {
+			d.duplicates++
+		}
+		d.Unlock()
+		if first {
+			kept = append(kept, b)
+		} else {
+			b.Release()
+		}
+	}
+	if kept.IsEmpty() {
+		return nil
+	}
+	return w.conn.link.Writer.WriteMultiBuffer(kept)
+}
+
+func (w *dualPathWriter) Close() error {
+	w.conn.end(w.path, false)
+	return nil
+}
+
+func (w *dualPathWriter) Interrupt() {
+	w.conn.end(w.path, true)
+}
+
+// extractDualPaths create dualpaths for outbounds of protocol dualpath in config
+func extractDualPaths(config *v2conf.Config) ([]*dualPath, error) {
+	var outbounds []*dualPath
+	for i, ob := range config.OutboundConfigs {
+		if !strings.EqualFold(ob.Protocol, "dualpath") {
+			continue
+		}
+		if i == 0 {
+			return nil, fmt.Errorf("dualpath %q: can not be the first outbound", ob.Tag)
+		}
+		if len(ob.Tag) == 0 {
+			return nil, fmt.Errorf("dualpath outbound without tag")
+		}
+		var settings struct {
+			Outbounds []string `json:"outbounds"`
+		}
+		if ob.Settings != nil {
+			if err := json.Unmarshal(*ob.Settings, &settings); err != nil {
+				return nil, fmt.Errorf("dualpath %s: %v", ob.Tag, err)
+			}
+		}
+		if len(settings.Outbounds) != 2 {
+			return nil, fmt.Errorf("dualpath %s: need 2 outbounds, got %d", ob.Tag, len(settings.Outbounds))
+		}
+		for _, tag := range settings.Outbounds {
+			if tag == ob.Tag {
+				return nil, fmt.Errorf("dualpath %s: goes over itself", ob.Tag)
+			}
+		}
+		outbounds = append(outbounds, &dualPath{tag: ob.Tag, paths: [2]string{settings.Outbounds[0], settings.Outbounds[1]}})
+	}
+	return outbounds, nil
+}
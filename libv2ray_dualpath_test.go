@@ -0,0 +1,196 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpEcho start a local UDP server answering each packet with itself
+func udpEcho(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(b[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// lossShim start a UDP relay to target dropping every dropEvery packet
+// from the client, answers are relayed back after delay
+func lossShim(t *testing.T, target *net.UDPAddr, dropEvery int, delay time.Duration) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		upstream.Close()
+	})
+	client := make(chan *net.UDPAddr, 1)
+	go func() {
+		b := make([]byte, 2048)
+		for count := 1; ; count++ {
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			select {
+			case client <- addr:
+			default:
+			}
+			if dropEvery > 0 && count%dropEvery == 0 {
+				continue
+			}
+			upstream.Write(b[:n])
+		}
+	}()
+	go func() {
+		addr := <-client
+		b := make([]byte, 2048)
+		for {
+			n, err := upstream.Read(b)
+			if err != nil {
+				return
+			}
+			time.Sleep(delay)
+			conn.WriteToUDP(b[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// startDualPath start a core sending UDP over a lossy and a slow path, outbounds behind filters,
+// packets are answered by echo servers behind both
+func startDualPath(t *testing.T, filters ...outboundFilter) (*net.UDPConn, *V2RayPoint) {
+	t.Helper()
+	lossy := lossShim(t, udpEcho(t), 2, 0)
+	slow := lossShim(t, udpEcho(t), 0, 50*time.Millisecond)
+	inboundPort := closedPort(t)
+
+	config, err := loadCoreConfig(fmt.Sprintf(`{
+		"inbounds": [{"listen": "127.0.0.1", "port": %d, "protocol": "dokodemo-door",
+			"settings": {"address": "127.0.0.1", "port": 5001, "network": "udp"}}],
+		"outbounds": [
+			{"tag": "direct", "protocol": "freedom"},
+			{"tag": "lossy", "protocol": "freedom", "settings": {"redirect": "127.0.0.1:%d"}},
+			{"tag": "slow", "protocol": "freedom", "settings": {"redirect": "127.0.0.1:%d"}},
+			{"tag": "game", "protocol": "dualpath", "settings": {"outbounds": ["lossy", "slow"]}}
+		],
+		"routing": {"rules": [{"type": "field", "port": "5000-5100", "outboundTag": "game"}]}
+	}`, inboundPort, lossy, slow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := config.newInstance(filters...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { inst.Close() })
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: inboundPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, &V2RayPoint{config: config}
+}
+
+// checkDualPath send packets one by one, each must be answered once
+func checkDualPath(t *testing.T, conn *net.UDPConn, v *V2RayPoint, packets []string) *dualPathStatus {
+	t.Helper()
+	b := make([]byte, 2048)
+	for _, packet := range packets {
+		conn.Write([]byte(packet))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(b)
+		if err != nil || string(b[:n]) != packet {
+			t.Fatalf("answer to %q: %q %v", packet, b[:n], err)
+		}
+	}
+	// the copy coming late over the slow path is dropped
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := conn.Read(b); err == nil {
+		t.Errorf("duplicate answer %q", b[:n])
+	}
+
+	var status struct {
+		Outbounds []*dualPathStatus `json:"outbounds"`
+	}
+	if err := json.Unmarshal([]byte(v.GetDualPathStatus()), &status); err != nil || len(status.Outbounds) != 1 {
+		t.Fatalf("%s %v", v.GetDualPathStatus(), err)
+	}
+	game, count := status.Outbounds[0], int64(len(packets))
+	if game.Answers != count || game.Duplicates != count/2 {
+		t.Errorf("%+v", game)
+	}
+	if lossy := game.Paths[0]; lossy.Tag != "lossy" || lossy.Sent != count || lossy.Received != count/2 {
+		t.Errorf("lossy %+v", lossy)
+	}
+	if slow := game.Paths[1]; slow.Tag != "slow" || slow.Sent != count || slow.Received != count {
+		t.Errorf("slow %+v", slow)
+	}
+	return game
+}
+
+func TestDualPath(t *testing.T) {
+	conn, v := startDualPath(t)
+	packets := make([]string, 10)
+	for i := range packets {
+		packets[i] = fmt.Sprintf("packet %d", i)
+	}
+	game := checkDualPath(t, conn, v, packets)
+	if lossy := game.Paths[0]; lossy.Wins != 5 || lossy.WinRate != 0.5 {
+		t.Errorf("lossy %+v", lossy)
+	}
+	if slow := game.Paths[1]; slow.Wins != 5 {
+		t.Errorf("slow %+v", slow)
+	}
+}
+
+func TestDualPathRepeatedPayload(t *testing.T) {
+	conn, v := startDualPath(t)
+	// a game sending the same keepalive gets each of its answers,
+	// which path won a copy can not be told apart
+	packets := make([]string, 10)
+	for i := range packets {
+		packets[i] = "ping"
+	}
+	checkDualPath(t, conn, v, packets)
+}
+
+func TestExtractDualPathsInvalid(t *testing.T) {
+	for _, outbounds := range []string{
+		`{"tag": "game", "protocol": "dualpath", "settings": {"outbounds": ["a", "b"]}}, {"tag": "direct", "protocol": "freedom"}`,
+		`{"tag": "direct", "protocol": "freedom"}, {"tag": "game", "protocol": "dualpath", "settings": {"outbounds": ["direct"]}}`,
+		`{"tag": "direct", "protocol": "freedom"}, {"tag": "game", "protocol": "dualpath", "settings": {"outbounds": ["direct", "game"]}}`,
+		`{"tag": "direct", "protocol": "freedom"}, {"protocol": "dualpath", "settings": {"outbounds": ["direct", "direct"]}}`,
+		`{"tag": "direct", "protocol": "freedom"}, {"tag": "game", "protocol": "dualpath", "settings": {"outbounds": ["direct", "auto"]}},
+			{"tag": "auto", "protocol": "fallback", "settings": {"outbounds": ["game", "direct"]}}`,
+	} {
+		if _, err := loadCoreConfig(`{"outbounds": [` + outbounds + `]}`); err == nil {
+			t.Errorf("expect error for %s", outbounds)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// exportProxy is an outbound in the terms xray, Clash and sing-box share
+type exportProxy struct {
+	Tag      string
+	Protocol string // vmess, vless, trojan, shadowsocks, socks, http, freedom or blackhole
+	Server   string
+	Port     int
+	UUID     string
+	AlterID  int
+	Cipher   string // vmess security or shadowsocks method
+	Flow     string
+	Username string
+	Password string
+
+	Transport   string // tcp, ws, grpc or http
+	Path        string
+	Host        string
+	ServiceName string
+
+	TLS         bool
+	Reality     bool
+	ServerName  string
+	ALPN        []string
+	Fingerprint string
+	Insecure    bool
+	PublicKey   string
+	ShortID     string
+}
+
+// exportRule is a field rule, domains and IPs written the way xray does
+type exportRule struct {
+	Domains  []string
+	IPs      []string
+	Ports    []string // single ports and from-to ranges
+	Network  string
+	Outbound string
+	Index    int // where the rule was in the config it came from
+}
+
+// exportProfile is what converts between formats, with what was left behind
+type exportProfile struct {
+	Proxies     []*exportProxy
+	Rules       []*exportRule
+	Final       string
+	Unsupported []string
+}
+
+type exportResult struct {
+	Config      string   `json:"config"`
+	Unsupported []string `json:"unsupported"`
+}
+
+func (p *exportProfile) unsupported(format string, args ...interface{}) {
+	p.Unsupported = append(p.Unsupported, fmt.Sprintf(format, args...))
+}
+
+func (p *exportProfile) proxy(tag string) *exportProxy {
+	for _, proxy := range p.Proxies {
+		if proxy.Tag == tag {
+			return proxy
+		}
+	}
+	return nil
+}
+
+// result marshal the converted config with what has no equivalent
+func (p *exportProfile) result(config string) (string, error) {
+	unsupported := p.Unsupported
+	if unsupported == nil {
+		unsupported = []string{}
+	}
+	b, err := json.Marshal(&exportResult{Config: config, Unsupported: unsupported})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+type xrayUser struct {
+	ID         string `json:"id,omitempty"`
+	AlterID    int    `json:"alterId,omitempty"`
+	Security   string `json:"security,omitempty"`
+	Encryption string `json:"encryption,omitempty"`
+	Flow       string `json:"flow,omitempty"`
+	User       string `json:"user,omitempty"`
+	Pass       string `json:"pass,omitempty"`
+}
+
+type xrayServer struct {
+	Address  string      `json:"address"`
+	Port     int         `json:"port"`
+	Method   string      `json:"method,omitempty"`
+	Password string      `json:"password,omitempty"`
+	Users    []*xrayUser `json:"users,omitempty"`
+}
+
+type xraySettings struct {
+	Vnext   []*xrayServer `json:"vnext,omitempty"`
+	Servers []*xrayServer `json:"servers,omitempty"`
+}
+
+type xrayTLS struct {
+	ServerName    string   `json:"serverName,omitempty"`
+	ALPN          []string `json:"alpn,omitempty"`
+	Fingerprint   string   `json:"fingerprint,omitempty"`
+	AllowInsecure bool     `json:"allowInsecure,omitempty"`
+}
+
+type xrayReality struct {
+	ServerName  string `json:"serverName,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	PublicKey   string `json:"publicKey,omitempty"`
+	ShortID     string `json:"shortId,omitempty"`
+}
+
+type xrayWS struct {
+	Path    string            `json:"path,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type xrayGRPC struct {
+	ServiceName string `json:"serviceName,omitempty"`
+}
+
+type xrayHTTP struct {
+	Path string   `json:"path,omitempty"`
+	Host []string `json:"host,omitempty"`
+}
+
+type xrayStream struct {
+	Network  string       `json:"network,omitempty"`
+	Security string       `json:"security,omitempty"`
+	TLS      *xrayTLS     `json:"tlsSettings,omitempty"`
+	Reality  *xrayReality `json:"realitySettings,omitempty"`
+	WS       *xrayWS      `json:"wsSettings,omitempty"`
+	GRPC     *xrayGRPC    `json:"grpcSettings,omitempty"`
+	HTTP     *xrayHTTP    `json:"httpSettings,omitempty"`
+}
+
+type xrayOutbound struct {
+	Tag            string        `json:"tag"`
+	Protocol       string        `json:"protocol"`
+	Settings       *xraySettings `json:"settings,omitempty"`
+	StreamSettings *xrayStream   `json:"streamSettings,omitempty"`
+}
+
+type xrayRule struct {
+	Type        string   `json:"type"`
+	Domain      []string `json:"domain,omitempty"`
+	IP          []string `json:"ip,omitempty"`
+	Port        string   `json:"port,omitempty"`
+	Network     string   `json:"network,omitempty"`
+	OutboundTag string   `json:"outboundTag"`
+}
+
+// outbound and rule keys the exporters know what to do with
+var (
+	exportOutboundKeys = map[string]bool{"tag": true, "protocol": true, "settings": true, "streamSettings": true}
+	exportStreamKeys   = map[string]bool{"network": true, "security": true, "tlsSettings": true,
+		"realitySettings": true, "wsSettings": true, "grpcSettings": true, "httpSettings": true}
+	exportRuleKeys = map[string]bool{"type": true, "domain": true, "domains": true, "ip": true,
+		"port": true, "network": true, "outboundTag": true, "ruleTag": true}
+)
+
+// profileFromXray take outbounds and field rules from a xray config
+func profileFromXray(content string) (*exportProfile, error) {
+	m, err := decodeConfigMap(content)
+	if err != nil {
+		return nil, err
+	}
+	p := &exportProfile{}
+	for i, ob := range configOutbounds(m) {
+		proxy := proxyFromXray(p, ob)
+		if proxy == nil {
+			continue
+		}
+		if len(proxy.Tag) == 0 {
+			proxy.Tag = fmt.Sprintf("%s-%d", proxy.Protocol, i)
+		}
+		if p.proxy(proxy.Tag) != nil {
+			p.unsupported("outbound %s: duplicate tag", proxy.Tag)
+			continue
+		}
+		p.Proxies = append(p.Proxies, proxy)
+	}
+	if len(p.Proxies) == 0 {
+		return nil, fmt.Errorf("no outbound to export")
+	}
+	// xray sends what no rule matches to the first outbound
+	p.Final = p.Proxies[0].Tag
+
+	routing, _ := m["routing"].(map[string]interface{})
+	rules, _ := routing["rules"].([]interface{})
+	for i, r := range rules {
+		raw, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if rule := ruleFromXray(p, i, raw); rule != nil {
+			p.Rules = append(p.Rules, rule)
+		}
+	}
+	return p, nil
+}
+
+func proxyFromXray(p *exportProfile, raw map[string]interface{}) *exportProxy {
+	var ob xrayOutbound
+	b, _ := json.Marshal(raw)
+	if err := json.Unmarshal(b, &ob); err != nil {
+		p.unsupported("outbound %v: %v", raw["tag"], err)
+		return nil
+	}
+	proxy := &exportProxy{Tag: ob.Tag, Protocol: strings.ToLower(ob.Protocol), Transport: "tcp"}
+	name := ob.Tag
+	if len(name) == 0 {
+		name = proxy.Protocol
+	}
+	switch proxy.Protocol {
+	case "freedom", "blackhole":
+		return proxy
+	case "vmess", "vless", "trojan", "shadowsocks", "socks", "http":
+	default:
+		p.unsupported("outbound %s: protocol %s", name, ob.Protocol)
+		return nil
+	}
+	for _, key := range sortedKeys(raw) {
+		if !exportOutboundKeys[key] {
+			p.unsupported("outbound %s: %s", name, key)
+		}
+	}
+
+	var servers []*xrayServer
+	if ob.Settings != nil {
+		servers = append(ob.Settings.Vnext, ob.Settings.Servers...)
+	}
+	if len(servers) == 0 || len(servers[0].Address) == 0 {
+		p.unsupported("outbound %s: no server", name)
+		return nil
+	}
+	if len(servers) > 1 || len(servers[0].Users) > 1 {
+		p.unsupported("outbound %s: servers and users after the first", name)
+	}
+	s := servers[0]
+	proxy.Server, proxy.Port, proxy.Password, proxy.Cipher = s.Address, s.Port, s.Password, s.Method
+	if len(s.Users) > 0 {
+		u := s.Users[0]
+		proxy.UUID, proxy.AlterID, proxy.Flow = u.ID, u.AlterID, u.Flow
+		proxy.Username, proxy.Password = u.User, u.Pass
+		if proxy.Protocol == "vmess" {
+			proxy.Cipher = u.Security
+		}
+	}
+
+	if ss := ob.StreamSettings; ss != nil {
+		stream, _ := raw["streamSettings"].(map[string]interface{})
+		for _, key := range sortedKeys(stream) {
+			if !exportStreamKeys[key] {
+				p.unsupported("outbound %s: streamSettings.%s", name, key)
+			}
+		}
+		switch network := strings.ToLower(ss.Network); network {
+		case "", "tcp":
+		case "ws", "websocket":
+			proxy.Transport = "ws"
+			if ss.WS != nil {
+				proxy.Path, proxy.Host = ss.WS.Path, ss.WS.Headers["Host"]
+			}
+		case "grpc", "gun":
+			proxy.Transport = "grpc"
+			if ss.GRPC != nil {
+				proxy.ServiceName = ss.GRPC.ServiceName
+			}
+		case "h2", "http":
+			proxy.Transport = "http"
+			if ss.HTTP != nil {
+				proxy.Path = ss.HTTP.Path
+				if len(ss.HTTP.Host) > 0 {
+					proxy.Host = ss.HTTP.Host[0]
+				}
+			}
+		default:
+			p.unsupported("outbound %s: transport %s", name, ss.Network)
+			return nil
+		}
+		switch strings.ToLower(ss.Security) {
+		case "", "none":
+		case "tls":
+			proxy.TLS = true
+			if t := ss.TLS; t != nil {
+				proxy.ServerName, proxy.ALPN, proxy.Fingerprint, proxy.Insecure = t.ServerName, t.ALPN, t.Fingerprint, t.AllowInsecure
+			}
+		case "reality":
+			proxy.TLS, proxy.Reality = true, true
+			if r := ss.Reality; r != nil {
+				proxy.ServerName, proxy.Fingerprint, proxy.PublicKey, proxy.ShortID = r.ServerName, r.Fingerprint, r.PublicKey, r.ShortID
+			}
+		default:
+			p.unsupported("outbound %s: security %s", name, ss.Security)
+			return nil
+		}
+	}
+	return proxy
+}
+
+func ruleFromXray(p *exportProfile, i int, raw map[string]interface{}) *exportRule {
+	for _, key := range sortedKeys(raw) {
+		if !exportRuleKeys[key] {
+			p.unsupported("rule %d: %s", i, key)
+			return nil
+		}
+	}
+	if typ, _ := raw["type"].(string); len(typ) > 0 && typ != "field" {
+		p.unsupported("rule %d: type %s", i, typ)
+		return nil
+	}
+	rule := &exportRule{Index: i}
+	rule.Outbound, _ = raw["outboundTag"].(string)
+	if p.proxy(rule.Outbound) == nil {
+		p.unsupported("rule %d: outbound %q not exported", i, rule.Outbound)
+		return nil
+	}
+	for _, key := range []string{"domain", "domains"} {
+		list, _ := raw[key].([]interface{})
+		for _, d := range list {
+			rule.Domains = append(rule.Domains, fmt.Sprint(d))
+		}
+	}
+	list, _ := raw["ip"].([]interface{})
+	for _, ip := range list {
+		rule.IPs = append(rule.IPs, fmt.Sprint(ip))
+	}
+	if port, found := raw["port"]; found {
+		rule.Ports = splitList(fmt.Sprint(port))
+	}
+	if network, found := raw["network"]; found {
+		rule.Network = strings.ToLower(strings.ReplaceAll(fmt.Sprint(network), " ", ""))
+	}
+	if len(rule.Domains) == 0 && len(rule.IPs) == 0 && len(rule.Ports) == 0 && len(rule.Network) == 0 {
+		p.unsupported("rule %d: nothing to match", i)
+		return nil
+	}
+	return rule
+}
+
+// xrayConfig write the profile as a xray config, the final outbound first
+func (p *exportProfile) xrayConfig() (string, error) {
+	outbounds := make([]*xrayOutbound, 0, len(p.Proxies))
+	for _, proxy := range p.Proxies {
+		ob := proxy.xrayOutbound()
+		if proxy.Tag == p.Final {
+			outbounds = append([]*xrayOutbound{ob}, outbounds...)
+		} else {
+			outbounds = append(outbounds, ob)
+		}
+	}
+	rules := make([]*xrayRule, 0, len(p.Rules))
+	for _, r := range p.Rules {
+		rules = append(rules, &xrayRule{
+			Type: "field", Domain: r.Domains, IP: r.IPs, Port: strings.Join(r.Ports, ","),
+			Network: r.Network, OutboundTag: r.Outbound,
+		})
+	}
+	config := map[string]interface{}{
+		"outbounds": outbounds,
+		"routing":   map[string]interface{}{"domainStrategy": "AsIs", "rules": rules},
+	}
+	b, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (proxy *exportProxy) xrayOutbound() *xrayOutbound {
+	ob := &xrayOutbound{Tag: proxy.Tag, Protocol: proxy.Protocol}
+	switch proxy.Protocol {
+	case "freedom", "blackhole":
+		return ob
+	case "vmess", "vless":
+		user := &xrayUser{ID: proxy.UUID, AlterID: proxy.AlterID, Flow: proxy.Flow}
+		if proxy.Protocol == "vmess" {
+			user.Security = proxy.Cipher
+		} else {
+			user.Encryption = "none"
+		}
+		ob.Settings = &xraySettings{Vnext: []*xrayServer{{Address: proxy.Server, Port: proxy.Port, Users: []*xrayUser{user}}}}
+	case "trojan", "shadowsocks":
+		ob.Settings = &xraySettings{Servers: []*xrayServer{{Address: proxy.Server, Port: proxy.Port, Method: proxy.Cipher, Password: proxy.Password}}}
+	default:
+		server := &xrayServer{Address: proxy.Server, Port: proxy.Port}
+		if len(proxy.Username) > 0 || len(proxy.Password) > 0 {
+			server.Users = []*xrayUser{{User: proxy.Username, Pass: proxy.Password}}
+		}
+		ob.Settings = &xraySettings{Servers: []*xrayServer{server}}
+	}
+
+	ss := &xrayStream{Network: proxy.Transport}
+	switch proxy.Transport {
+	case "ws":
+		ss.WS = &xrayWS{Path: proxy.Path}
+		if len(proxy.Host) > 0 {
+			ss.WS.Headers = map[string]string{"Host": proxy.Host}
+		}
+	case "grpc":
+		ss.GRPC = &xrayGRPC{ServiceName: proxy.ServiceName}
+	case "http":
+		ss.HTTP = &xrayHTTP{Path: proxy.Path}
+		if len(proxy.Host) > 0 {
+			ss.HTTP.Host = []string{proxy.Host}
+		}
+	}
+	switch {
+	case proxy.Reality:
+		ss.Security = "reality"
+		ss.Reality = &xrayReality{proxy.ServerName, proxy.Fingerprint, proxy.PublicKey, proxy.ShortID}
+	case proxy.TLS:
+		ss.Security = "tls"
+		ss.TLS = &xrayTLS{proxy.ServerName, proxy.ALPN, proxy.Fingerprint, proxy.Insecure}
+	}
+	ob.StreamSettings = ss
+	return ob
+}
+
+// splitPortRange split "1000-2000" in its bounds, a single port is both
+func splitPortRange(port string) (int, int, error) {
+	from, to, found := strings.Cut(port, "-")
+	if !found {
+		to = from
+	}
+	f, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return 0, 0, err
+	}
+	t, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return 0, 0, err
+	}
+	return f, t, nil
+}
+
+// cidr write an IP as a one address CIDR, a CIDR as is
+func cidr(ip string) string {
+	if strings.Contains(ip, "/") {
+		return ip
+	}
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,104 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const exportXrayConfig = `{
+	"outbounds": [
+		{"tag": "proxy", "protocol": "vless", "settings": {"vnext": [{"address": "vless.example.com", "port": 443,
+			"users": [{"id": "27848739-7e62-4138-9fd3-098a63964b6b", "encryption": "none", "flow": "xtls-rprx-vision"}]}]},
+			"streamSettings": {"network": "tcp", "security": "reality", "realitySettings": {"serverName": "www.example.com",
+				"fingerprint": "chrome", "publicKey": "Z84J2IelR9ch3k8VtlVhhs5ycBUlXA7wHBWcBrjqnAw", "shortId": "6ba85179e30d4fc2"}}},
+		{"tag": "ws", "protocol": "vmess", "settings": {"vnext": [{"address": "vmess.example.com", "port": 8443,
+			"users": [{"id": "b831381d-6324-4d53-ad4f-8cda48b30811", "security": "aes-128-gcm"}]}]},
+			"streamSettings": {"network": "ws", "security": "tls", "tlsSettings": {"serverName": "vmess.example.com", "alpn": ["http/1.1"]},
+				"wsSettings": {"path": "/ray", "headers": {"Host": "cdn.example.com"}}}},
+		{"tag": "grpc", "protocol": "trojan", "settings": {"servers": [{"address": "trojan.example.com", "port": 443, "password": "secret"}]},
+			"streamSettings": {"network": "grpc", "security": "tls", "tlsSettings": {"allowInsecure": true}, "grpcSettings": {"serviceName": "tun"}}},
+		{"tag": "ss", "protocol": "shadowsocks", "settings": {"servers": [{"address": "1.2.3.4", "port": 8388,
+			"method": "2022-blake3-aes-128-gcm", "password": "c2VjcmV0c2VjcmV0c2VjcmV0"}]}},
+		{"tag": "direct", "protocol": "freedom"},
+		{"tag": "block", "protocol": "blackhole"}
+	],
+	"routing": {"rules": [
+		{"type": "field", "domain": ["geosite:category-ads-all"], "outboundTag": "block"},
+		{"type": "field", "domain": ["domain:example.org", "full:www.example.net", "keyword:video"], "outboundTag": "ws"},
+		{"type": "field", "ip": ["geoip:private", "10.0.0.1", "fd00::/8"], "outboundTag": "direct"},
+		{"type": "field", "ip": ["geoip:cn"], "outboundTag": "direct"},
+		{"type": "field", "port": "53,1000-2000", "outboundTag": "ss"},
+		{"type": "field", "network": "udp", "outboundTag": "grpc"}
+	]}
+}`
+
+const exportUnsupportedConfig = `{
+	"outbounds": [
+		{"tag": "proxy", "protocol": "vmess", "mux": {"enabled": true},
+			"settings": {"vnext": [{"address": "vmess.example.com", "port": 443, "users": [{"id": "b831381d-6324-4d53-ad4f-8cda48b30811"}]}]}},
+		{"tag": "kcp", "protocol": "vmess", "settings": {"vnext": [{"address": "kcp.example.com", "port": 443,
+			"users": [{"id": "b831381d-6324-4d53-ad4f-8cda48b30811"}]}]}, "streamSettings": {"network": "kcp"}},
+		{"tag": "wg", "protocol": "wireguard", "settings": {}},
+		{"tag": "direct", "protocol": "freedom"}
+	],
+	"routing": {"rules": [
+		{"type": "field", "domain": ["domain:example.org"], "port": "443", "outboundTag": "direct"},
+		{"type": "field", "domain": ["domain:example.com"], "balancerTag": "balancer"},
+		{"type": "field", "ip": ["geoip:!cn"], "outboundTag": "direct"},
+		{"type": "field", "domain": ["domain:kcp.example.com"], "outboundTag": "kcp"},
+		{"type": "field", "domain": ["domain:example.net"], "ip": ["10.0.0.0/8"], "outboundTag": "direct"}
+	]}
+}`
+
+func decodeExportResult(result string, err error) (*exportResult, error) {
+	if err != nil {
+		return nil, err
+	}
+	var r exportResult
+	if err := json.Unmarshal([]byte(result), &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// expectUnsupported check every want is reported by some entry
+func expectUnsupported(t *testing.T, unsupported []string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		found := false
+		for _, u := range unsupported {
+			found = found || strings.Contains(u, w)
+		}
+		if !found {
+			t.Errorf("%q not reported in %q", w, unsupported)
+		}
+	}
+}
+
+func TestProfileFromXray(t *testing.T) {
+	p, err := profileFromXray(exportXrayConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Proxies) != 6 || len(p.Rules) != 6 || p.Final != "proxy" || len(p.Unsupported) > 0 {
+		t.Fatalf("%d proxies %d rules final %s: %v", len(p.Proxies), len(p.Rules), p.Final, p.Unsupported)
+	}
+	proxy := p.proxy("proxy")
+	if !proxy.Reality || proxy.Flow != "xtls-rprx-vision" || proxy.Fingerprint != "chrome" || proxy.ShortID != "6ba85179e30d4fc2" {
+		t.Errorf("%+v", proxy)
+	}
+	if ws := p.proxy("ws"); ws.Transport != "ws" || ws.Host != "cdn.example.com" || ws.Cipher != "aes-128-gcm" {
+		t.Errorf("%+v", ws)
+	}
+
+	p, err = profileFromXray(exportUnsupportedConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectUnsupported(t, p.Unsupported, "outbound proxy: mux", "outbound kcp: transport kcp",
+		"outbound wg: protocol wireguard", "rule 1: balancerTag", "rule 3: outbound \"kcp\"")
+	if len(p.Proxies) != 2 || len(p.Rules) != 3 {
+		t.Errorf("%d proxies %d rules", len(p.Proxies), len(p.Rules))
+	}
+}
@@ -0,0 +1,478 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/xtls/xray-core/app/router"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/dns"
+	"github.com/xtls/xray-core/features/routing"
+	routing_dns "github.com/xtls/xray-core/features/routing/dns"
+	routing_session "github.com/xtls/xray-core/features/routing/session"
+	v2conf "github.com/xtls/xray-core/infra/conf"
+)
+
+const (
+	maxExpressionLen   = 4096
+	maxExpressionDepth = 32
+)
+
+// expression fields and the field rule keys they are matched by
+var expressionFields = map[string]string{
+	"domain": "domain", "ip": "ip", "port": "port", "network": "network",
+	"inbound": "inboundTag", "source": "source", "sourceport": "sourcePort",
+	"protocol": "protocol", "user": "user", "process": "process", "uid": "uid",
+}
+
+type exprNode interface {
+	eval(ctx routing.Context) bool
+}
+
+type exprAnd struct{ a, b exprNode }
+type exprOr struct{ a, b exprNode }
+type exprNot struct{ x exprNode }
+
+// exprMatch is a comparison, matched the way a field rule of xray does
+type exprMatch struct{ cond router.Condition }
+
+func (e *exprAnd) eval(ctx routing.Context) bool   { return e.a.eval(ctx) && e.b.eval(ctx) }
+func (e *exprOr) eval(ctx routing.Context) bool    { return e.a.eval(ctx) || e.b.eval(ctx) }
+func (e *exprNot) eval(ctx routing.Context) bool   { return !e.x.eval(ctx) }
+func (e *exprMatch) eval(ctx routing.Context) bool { return e.cond.Apply(ctx) }
+
+// expressionRule is a routing rule of type "expression"
+type expressionRule struct {
+	expr        exprNode
+	outboundTag string
+	ruleTag     string
+	// xray matches the rule in its place by this attribute, and routes it to this tag
+	placeholder string
+	hits        int64
+}
+
+// expressionRouter is the router the dispatcher goes through when there are expression rules.
+// It evaluates only the expressions, the router of xray picks among them and its own rules.
+type expressionRouter struct {
+	routing.Router
+	rules        []*expressionRule
+	placeholders map[string]*expressionRule
+	ipOnDemand   bool
+	ipIfNonMatch bool
+	dns          dns.Client
+}
+
+// expressionRoute is a route an expression rule picked
+type expressionRoute struct {
+	routing.Route
+	outboundTag string
+}
+
+// GetOutboundTag implements routing.Route.
+func (r *expressionRoute) GetOutboundTag() string {
+	return r.outboundTag
+}
+
+/*GetExpressionRuleStats return connections routed by each expression rule of the running config as JSON*/
+func (v *V2RayPoint) GetExpressionRuleStats() string {
+	stats := make(map[string]int64)
+	if _, config := v.runningCore(); config != nil && config.expressions != nil {
+		for _, r := range config.expressions.rules {
+			stats[r.ruleTag] = atomic.LoadInt64(&r.hits)
+		}
+	}
+	b, err := json.Marshal(stats)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return string(b)
+}
+
+/*
+extractExpressionRules take rules of type "expression" out of routing and return the
+rules for xray with a placeholder in place of each, expression rules are like
+{"type": "expression", "expression": "domain matches 'geosite:google' && port == 443
+&& network == 'udp' && !(inbound == 'lan')", "outboundTag": "proxy", "ruleTag": "google-udp"}.
+Fields are domain, ip, port, network, inbound, source, sourcePort, protocol, user, process and uid;
+"matches" and "in" take values as field rules do, a list is written ['a', 'b'];
+"==" on domain is a full match. && || ! and, or, not and parentheses combine them.
+On Linux, process and uid match the local owner of connections from local inbounds,
+process is the executable name, e.g. "process in ['firefox', 'curl'] || uid == 1000".
+*/
+func extractExpressionRules(config *v2conf.Config) (*expressionRouter, []json.RawMessage, error) {
+	if config.RouterConfig == nil {
+		return nil, nil, nil
+	}
+	r := &expressionRouter{placeholders: make(map[string]*expressionRule)}
+	kept := make([]json.RawMessage, 0, len(config.RouterConfig.RuleList))
+	coreRules := make([]json.RawMessage, 0, len(config.RouterConfig.RuleList))
+	tags := make(map[string]bool)
+	for i, raw := range config.RouterConfig.RuleList {
+		var rule map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &rule); err != nil {
+			return nil, nil, err
+		}
+		var typ string
+		json.Unmarshal(rule["type"], &typ)
+		if !strings.EqualFold(typ, "expression") {
+			kept = append(kept, raw)
+			coreRules = append(coreRules, raw)
+			continue
+		}
+
+		var source, outboundTag, ruleTag string
+		json.Unmarshal(rule["expression"], &source)
+		json.Unmarshal(rule["outboundTag"], &outboundTag)
+		json.Unmarshal(rule["ruleTag"], &ruleTag)
+		if len(outboundTag) == 0 {
+			return nil, nil, fmt.Errorf("expression rule %d: outboundTag required", i)
+		}
+		if len(ruleTag) == 0 {
+			ruleTag = fmt.Sprintf("expression-%d", i)
+		}
+		if tags[ruleTag] {
+			return nil, nil, fmt.Errorf("duplicate ruleTag %s", ruleTag)
+		}
+		tags[ruleTag] = true
+		expr, err := compileExpression(source)
+		if err != nil {
+			return nil, nil, fmt.Errorf("expression rule %s: %v", ruleTag, err)
+		}
+
+		// xray keeps the order of rules, a field rule matching the attribute stands in for the expression
+		placeholder := fmt.Sprintf("libv2ray-expression-%d", i)
+		b, _ := json.Marshal(map[string]interface{}{
+			"type":        "field",
+			"attrs":       map[string]string{placeholder: "^1$"},
+			"outboundTag": placeholder,
+			"ruleTag":     ruleTag,
+		})
+		coreRules = append(coreRules, b)
+		er := &expressionRule{expr: expr, outboundTag: outboundTag, ruleTag: ruleTag, placeholder: placeholder}
+		r.rules = append(r.rules, er)
+		r.placeholders[placeholder] = er
+	}
+	if len(r.rules) == 0 {
+		return nil, nil, nil
+	}
+
+	if ds := config.RouterConfig.DomainStrategy; ds != nil {
+		r.ipOnDemand = strings.EqualFold(*ds, "IPOnDemand")
+		r.ipIfNonMatch = strings.EqualFold(*ds, "IPIfNonMatch")
+	}
+	config.RouterConfig.RuleList = kept
+	return r, coreRules, nil
+}
+
+func (r *expressionRouter) init(router routing.Router, client dns.Client) {
+	r.Router = router
+	r.dns = client
+}
+
+// PickRoute implements routing.Router.
+func (r *expressionRouter) PickRoute(ctx routing.Context) (routing.Route, error) {
+	sc, _ := ctx.(*routing_session.Context)
+	// only connections from inbounds are routed by expressions
+	if sc == nil || sc.Inbound == nil || sc.Content == nil {
+		return r.Router.PickRoute(ctx)
+	}
+	resolve := r.dns != nil && !ctx.GetSkipDNSResolve()
+	r.mark(sc.Content, ctx, resolve && r.ipOnDemand)
+	route, err := r.Router.PickRoute(ctx)
+	// xray resolves the domain once no rule matched, and so do expressions
+	if errors.Is(err, common.ErrNoClue) && resolve && r.ipIfNonMatch && len(ctx.GetTargetDomain()) > 0 {
+		if r.mark(sc.Content, ctx, true) {
+			route, err = r.Router.PickRoute(ctx)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	rule := r.placeholders[route.GetOutboundTag()]
+	if rule == nil {
+		return route, nil
+	}
+	atomic.AddInt64(&rule.hits, 1)
+	tracedRequest(sc).expressionRouted(rule)
+	return &expressionRoute{Route: route, outboundTag: rule.outboundTag}, nil
+}
+
+// mark set the attributes of expression rules matching ctx, and return if any did
+func (r *expressionRouter) mark(content *session.Content, ctx routing.Context, resolve bool) bool {
+	if resolve {
+		ctx = routing_dns.ContextWithDNSClient(ctx, r.dns)
+	}
+	matched := false
+	for _, rule := range r.rules {
+		if rule.expr.eval(ctx) {
+			content.SetAttribute(rule.placeholder, "1")
+			matched = true
+		}
+	}
+	return matched
+}
+
+type exprToken struct {
+	kind  byte // i identifier, s string, n number, o operator or punctuation
+	value string
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	depth  int
+}
+
+func compileExpression(source string) (exprNode, error) {
+	if len(source) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	if len(source) > maxExpressionLen {
+		return nil, fmt.Errorf("expression longer than %d", maxExpressionLen)
+	}
+	tokens, err := tokenizeExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].value)
+	}
+	return node, nil
+}
+
+func tokenizeExpression(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, exprToken{'s', s[i+1 : i+1+end]})
+			i += end + 2
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '-') {
+				j++
+			}
+			tokens = append(tokens, exprToken{'n', s[i:j]})
+			i = j
+		case isIdentByte(c):
+			j := i
+			for j < len(s) && isIdentByte(s[j]) {
+				j++
+			}
+			word := strings.ToLower(s[i:j])
+			switch word {
+			case "and":
+				tokens = append(tokens, exprToken{'o', "&&"})
+			case "or":
+				tokens = append(tokens, exprToken{'o', "||"})
+			case "not":
+				tokens = append(tokens, exprToken{'o', "!"})
+			case "matches", "in":
+				tokens = append(tokens, exprToken{'o', word})
+			default:
+				tokens = append(tokens, exprToken{'i', word})
+			}
+			i = j
+		case strings.HasPrefix(s[i:], "&&") || strings.HasPrefix(s[i:], "||") ||
+			strings.HasPrefix(s[i:], "==") || strings.HasPrefix(s[i:], "!="):
+			tokens = append(tokens, exprToken{'o', s[i : i+2]})
+			i += 2
+		case strings.IndexByte("!()[],", c) >= 0:
+			tokens = append(tokens, exprToken{'o', string(c)})
+			i++
+		default:
+			r, _ := utf8.DecodeRuneInString(s[i:])
+			return nil, fmt.Errorf("unexpected %q at %d", r, i)
+		}
+	}
+	return tokens, nil
+}
+
+// isIdentByte tell if c may be in an identifier, fields and keywords are ASCII
+func isIdentByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+func (p *exprParser) peek(value string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == 'o' && p.tokens[p.pos].value == value
+}
+
+func (p *exprParser) next() (exprToken, error) {
+	if p.pos >= len(p.tokens) {
+		return exprToken{}, fmt.Errorf("unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxExpressionDepth {
+		return nil, fmt.Errorf("expression nested deeper than %d", maxExpressionDepth)
+	}
+	node, err := p.parseAnd()
+	for err == nil && p.peek("||") {
+		p.pos++
+		var right exprNode
+		if right, err = p.parseAnd(); err == nil {
+			node = &exprOr{node, right}
+		}
+	}
+	return node, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	node, err := p.parseUnary()
+	for err == nil && p.peek("&&") {
+		p.pos++
+		var right exprNode
+		if right, err = p.parseUnary(); err == nil {
+			node = &exprAnd{node, right}
+		}
+	}
+	return node, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	switch {
+	case p.peek("!"):
+		p.pos++
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > maxExpressionDepth {
+			return nil, fmt.Errorf("expression nested deeper than %d", maxExpressionDepth)
+		}
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNot{x}, nil
+	case p.peek("("):
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return node, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	key, found := expressionFields[t.value]
+	if t.kind != 'i' || !found {
+		return nil, fmt.Errorf("unknown field %q", t.value)
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if op.kind != 'o' || (op.value != "==" && op.value != "!=" && op.value != "matches" && op.value != "in") {
+		return nil, fmt.Errorf("expect ==, !=, matches or in after %s", t.value)
+	}
+	values, err := p.parseValues()
+	if err != nil {
+		return nil, err
+	}
+	var cond router.Condition
+	if key == "process" || key == "uid" {
+		cond, err = newProcessCondition(key, op.value, values)
+	} else {
+		if key == "domain" && (op.value == "==" || op.value == "!=") {
+			for i := range values {
+				values[i] = "full:" + values[i]
+			}
+		}
+		cond, err = fieldCondition(key, values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", t.value, op.value, err)
+	}
+	var node exprNode = &exprMatch{cond}
+	if op.value == "!=" {
+		node = &exprNot{node}
+	}
+	return node, nil
+}
+
+func (p *exprParser) parseValues() ([]string, error) {
+	if !p.peek("[") {
+		t, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if t.kind != 's' && t.kind != 'n' {
+			return nil, fmt.Errorf("expect a value, got %q", t.value)
+		}
+		return []string{t.value}, nil
+	}
+	p.pos++
+	var values []string
+	for !p.peek("]") {
+		t, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if t.kind != 's' && t.kind != 'n' {
+			return nil, fmt.Errorf("expect a value, got %q", t.value)
+		}
+		values = append(values, t.value)
+		if p.peek(",") {
+			p.pos++
+		} else if !p.peek("]") {
+			return nil, fmt.Errorf("missing ]")
+		}
+	}
+	p.pos++
+	if len(values) == 0 {
+		return nil, fmt.Errorf("empty list")
+	}
+	return values, nil
+}
+
+// fieldCondition build the condition of a field rule matching key against values
+func fieldCondition(key string, values []string) (router.Condition, error) {
+	var value interface{} = values
+	switch key {
+	case "port", "sourcePort", "network":
+		value = strings.Join(values, ",")
+	}
+	raw, err := json.Marshal(map[string]interface{}{key: value, "outboundTag": "expression"})
+	if err != nil {
+		return nil, err
+	}
+	rule, err := v2conf.ParseRule(raw)
+	if err != nil {
+		return nil, err
+	}
+	return rule.BuildCondition()
+}
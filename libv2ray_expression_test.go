@@ -0,0 +1,154 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	v2net "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	routing_session "github.com/xtls/xray-core/features/routing/session"
+)
+
+func routedContext(inbound string, domain string, network v2net.Network, port v2net.Port) context.Context {
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:    inbound,
+		Source: v2net.TCPDestination(v2net.ParseAddress("10.0.0.1"), 40000),
+	})
+	return session.ContextWithOutbound(ctx, &session.Outbound{
+		Target: v2net.Destination{Network: network, Address: v2net.DomainAddress(domain), Port: port},
+	})
+}
+
+func TestCompileExpression(t *testing.T) {
+	tests := []struct {
+		expr    string
+		ctx     context.Context
+		matched bool
+	}{
+		{"domain matches 'google.com' && port == 443 && network == 'udp' && !(inbound == 'lan')",
+			routedContext("socks", "www.google.com", v2net.Network_UDP, 443), true},
+		{"domain matches 'google.com' and port == 443 and network == 'udp' and not inbound == 'lan'",
+			routedContext("lan", "www.google.com", v2net.Network_UDP, 443), false},
+		{"domain == 'google.com'", routedContext("socks", "www.google.com", v2net.Network_TCP, 443), false},
+		{"domain != 'google.com'", routedContext("socks", "www.google.com", v2net.Network_TCP, 443), true},
+		{"port in [80, '8000-9000'] || domain in ['regexp:^a\\.', 'domain:b.com']",
+			routedContext("socks", "x.b.com", v2net.Network_TCP, 443), true},
+		{"port in [80, '8000-9000']", routedContext("socks", "x.b.com", v2net.Network_TCP, 8080), true},
+		{"source matches '10.0.0.0/8' AND sourcePort == 40000", routedContext("socks", "a.com", v2net.Network_TCP, 1), true},
+	}
+	for _, tt := range tests {
+		expr, err := compileExpression(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		if got := expr.eval(routing_session.AsRoutingContext(tt.ctx)); got != tt.matched {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.matched)
+		}
+	}
+
+	invalid := []string{"", "domain", "domain ==", "host == 'a'", "port > 1", "(port == 1",
+		"port == 1 port == 2", "domain == 'a", "port in []"}
+	for _, expr := range invalid {
+		if _, err := compileExpression(expr); err == nil {
+			t.Errorf("expect error of %q", expr)
+		}
+	}
+	// identifiers are ASCII, other letters are told as they are written
+	if _, err := compileExpression("dömain == 'a'"); err == nil || !strings.Contains(err.Error(), "'ö' at 1") {
+		t.Errorf("unexpected error of non-ASCII identifier: %v", err)
+	}
+}
+
+func TestExpressionRules(t *testing.T) {
+	config, err := loadCoreConfig(`{
+		"outbounds": [{"tag": "direct", "protocol": "freedom"}, {"tag": "proxy", "protocol": "freedom"},
+			{"tag": "block", "protocol": "blackhole"}],
+		"routing": {"rules": [
+			{"type": "field", "domain": ["domain:ads.com"], "outboundTag": "block"},
+			{"type": "expression", "expression": "domain matches 'domain:ads.com' || port == 443 && network == 'udp'",
+				"outboundTag": "proxy", "ruleTag": "quic"},
+			{"type": "field", "network": "udp", "outboundTag": "direct"}]}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(config.json.RouterConfig.RuleList); n != 2 {
+		t.Fatalf("expression rule not taken out, %d rules left", n)
+	}
+	inst, err := config.newInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+	r := config.expressions
+	pick := func(ctx context.Context) string {
+		t.Helper()
+		route, err := r.PickRoute(routing_session.AsRoutingContext(session.ContextWithContent(ctx, &session.Content{})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return route.GetOutboundTag()
+	}
+
+	// the field rule before it wins
+	if tag := pick(routedContext("socks", "x.ads.com", v2net.Network_UDP, 443)); tag != "block" {
+		t.Errorf("field rule overridden, routed to %s", tag)
+	}
+	// before the field rules after it
+	if tag := pick(routedContext("socks", "a.com", v2net.Network_UDP, 443)); tag != "proxy" {
+		t.Errorf("routed to %q, want proxy", tag)
+	}
+	if tag := pick(routedContext("socks", "a.com", v2net.Network_UDP, 53)); tag != "direct" {
+		t.Errorf("routed to %q, want direct", tag)
+	}
+
+	v := &V2RayPoint{config: config}
+	var stats map[string]int64
+	if err := json.Unmarshal([]byte(v.GetExpressionRuleStats()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats["quic"] != 1 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+
+	if _, err := loadCoreConfig(`{"routing": {"rules": [{"type": "expression", "expression": "port == 1"}]}}`); err == nil {
+		t.Error("expect error of missing outboundTag")
+	}
+}
+
+func TestExpressionRulesUntaggedDefault(t *testing.T) {
+	server := smartServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		b := make([]byte, 4)
+		io.ReadFull(conn, b)
+		conn.Write([]byte("pong"))
+	})
+	socksPort := closedPort(t)
+	// an untagged default outbound, expressions route in the dispatcher
+	config, err := loadCoreConfig(fmt.Sprintf(`{
+		"inbounds": [{"tag": "socks", "listen": "127.0.0.1", "port": %d, "protocol": "socks"}],
+		"outbounds": [
+			{"protocol": "blackhole"},
+			{"tag": "good", "protocol": "freedom", "settings": {"redirect": "127.0.0.1:%d"}}
+		],
+		"routing": {"rules": [{"type": "expression", "expression": "inbound == 'socks' && port == 1001", "outboundTag": "good"}]}
+	}`, socksPort, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := config.newInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+	if answer, err := smartExchange(t, fmt.Sprintf("127.0.0.1:%d", socksPort), "localhost:1001"); answer != "pong" {
+		t.Fatalf("expression not routed: %q %v", answer, err)
+	}
+}
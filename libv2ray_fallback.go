@@ -0,0 +1,385 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	v2conf "github.com/xtls/xray-core/infra/conf"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+// what a connection may send before its outbound answers and still be replayed to the next one
+const fallbackReplayLimit = 64 << 10
+
+// fallbackGroup is an outbound of protocol "fallback", trying its outbounds in order
+// for each connection until one of them does not fail before answering.
+// {"tag": "auto", "protocol": "fallback", "settings": {"outbounds": ["proxy-hk", "proxy-jp", "direct"]}}
+// Outbounds using mux hand connections over at once, their failures come too late to try the next one.
+type fallbackGroup struct {
+	tag     string
+	members []string
+	ohm     outbound.Manager
+
+	sync.Mutex
+	stats map[string]*fallbackMemberStatus
+}
+
+type fallbackMemberStatus struct {
+	Tag         string `json:"tag"`
+	Attempts    int64  `json:"attempts"`
+	Failures    int64  `json:"failures"`
+	Consecutive int64  `json:"consecutiveFailures"`
+	LastError   string `json:"lastError,omitempty"`
+	LastFailure int64  `json:"lastFailure,omitempty"`
+}
+
+type fallbackGroupStatus struct {
+	Tag       string                  `json:"tag"`
+	Outbounds []*fallbackMemberStatus `json:"outbounds"`
+}
+
+/*
+GetFallbackStatus return attempts and failures of each outbound of fallback groups
+in the running config as JSON, empty string if core is not running.
+*/
+func (v *V2RayPoint) GetFallbackStatus() string {
+	_, config := v.runningCore()
+	if config == nil {
+		return ""
+	}
+
+	groups := make([]*fallbackGroupStatus, 0)
+	for _, h := range config.outbounds {
+		if g, ok := h.(*fallbackGroup); ok {
+			groups = append(groups, g.status())
+		}
+	}
+	b, err := json.Marshal(map[string]interface{}{"groups": groups})
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return string(b)
+}
+
+func (g *fallbackGroup) init(ohm outbound.Manager) {
+	g.ohm = ohm
+}
+
+// Tag implements outbound.Handler.
+func (g *fallbackGroup) Tag() string {
+	return g.tag
+}
+
+// Start implements common.Runnable.
+func (g *fallbackGroup) Start() error {
+	return nil
+}
+
+// Close implements common.Closable.
+func (g *fallbackGroup) Close() error {
+	return nil
+}
+
+// Dispatch implements outbound.Handler.
+func (g *fallbackGroup) Dispatch(ctx context.Context, link *transport.Link) {
+	c := &fallbackConn{link: link}
+	defer c.stop()
+	for i, tag := range g.members {
+		h := g.ohm.GetHandler(tag)
+		if h == nil {
+			log.Printf("fallback %s: no outbound %s", g.tag, tag)
+			continue
+		}
+		a := c.newAttempt(i == len(g.members)-1)
+		h.Dispatch(session.TrackedConnectionError(ctx, a), &transport.Link{
+			Reader: &fallbackReader{Reader: a.reader, attempt: a},
+			Writer: &fallbackWriter{attempt: a},
+		})
+		err := a.failure()
+		g.record(tag, err)
+		if !a.retry() {
+			if err != nil {
+				session.SubmitOutboundErrorToOriginator(ctx, err)
+			}
+			return
+		}
+		log.Printf("fallback %s: %s failed, %v", g.tag, tag, err)
+	}
+
+	// outbounds left to try are missing
+	session.SubmitOutboundErrorToOriginator(ctx, fmt.Errorf("fallback %s: no outbound left", g.tag))
+	common.Interrupt(link.Writer)
+	common.Interrupt(link.Reader)
+}
+
+// record count an attempt on outbound tag, failed if err is not nil
+func (g *fallbackGroup) record(tag string, err error) {
+	g.Lock()
+	defer g.Unlock()
+	if g.stats == nil {
+		g.stats = make(map[string]*fallbackMemberStatus)
+	}
+	s, found := g.stats[tag]
+	if !found {
+		s = &fallbackMemberStatus{Tag: tag}
+		g.stats[tag] = s
+	}
+	s.Attempts++
+	if err == nil {
+		s.Consecutive = 0
+		return
+	}
+	s.Failures++
+	s.Consecutive++
+	s.LastError = err.Error()
+	s.LastFailure = time.Now().Unix()
+}
+
+func (g *fallbackGroup) status() *fallbackGroupStatus {
+	g.Lock()
+	defer g.Unlock()
+	s := &fallbackGroupStatus{Tag: g.tag}
+	for _, tag := range g.members {
+		m := fallbackMemberStatus{Tag: tag}
+		if found := g.stats[tag]; found != nil {
+			m = *found
+		}
+		s.Outbounds = append(s.Outbounds, &m)
+	}
+	return s
+}
+
+// fallbackConn keep what the client sent until an outbound answers,
+// so that the next outbound can be given the same
+type fallbackConn struct {
+	sync.Mutex
+	link      *transport.Link
+	pumping   bool
+	cache     buf.MultiBuffer
+	overflow  bool
+	eof       bool
+	current   *pipe.Writer
+	committed bool
+}
+
+func copyMultiBuffer(mb buf.MultiBuffer) buf.MultiBuffer {
+	c := make(buf.MultiBuffer, 0, len(mb))
+	for _, b := range mb {
+		nb := buf.New()
+		nb.Write(b.Bytes())
+		nb.UDP = b.UDP
+		c = append(c, nb)
+	}
+	return c
+}
+
+// newAttempt give an outbound a new uplink with what was sent so far
+func (c *fallbackConn) newAttempt(last bool) *fallbackAttempt {
+	r, w := pipe.New(pipe.WithoutSizeLimit())
+	a := &fallbackAttempt{conn: c, reader: r, last: last}
+
+	c.Lock()
+	if c.current != nil {
+		common.Interrupt(c.current)
+	}
+	if len(c.cache) > 0 {
+		w.WriteMultiBuffer(copyMultiBuffer(c.cache))
+	}
+	if c.eof {
+		w.Close()
+	}
+	c.current = w
+	pumping := c.pumping
+	c.pumping = true
+	c.Unlock()
+
+	if !pumping {
+		go c.pump()
+	}
+	return a
+}
+
+// pump move what the client sends to the current attempt
+func (c *fallbackConn) pump() {
+	for {
+		mb, err := c.link.Reader.ReadMultiBuffer()
+		c.Lock()
+		if !mb.IsEmpty() && !c.committed && !c.overflow {
+			if c.cache.Len()+mb.Len() > fallbackReplayLimit {
+				c.overflow = true
+				buf.ReleaseMulti(c.cache)
+				c.cache = nil
+			} else {
+				c.cache = append(c.cache, copyMultiBuffer(mb)...)
+			}
+		}
+		if c.current != nil && !mb.IsEmpty() {
+			c.current.WriteMultiBuffer(mb)
+		} else {
+			buf.ReleaseMulti(mb)
+		}
+		if err != nil {
+			c.eof = true
+			if c.current != nil {
+				c.current.Close()
+			}
+			c.Unlock()
+			return
+		}
+		c.Unlock()
+	}
+}
+
+// commit stop keeping what was sent, the connection stays with this attempt
+func (c *fallbackConn) commit() {
+	c.Lock()
+	if !c.committed {
+		c.committed = true
+		buf.ReleaseMulti(c.cache)
+		c.cache = nil
+	}
+	c.Unlock()
+}
+
+// stop keeping what is sent once the group is done with the connection
+func (c *fallbackConn) stop() {
+	c.Lock()
+	c.committed = true
+	buf.ReleaseMulti(c.cache)
+	c.cache = nil
+	c.Unlock()
+}
+
+// fallbackAttempt is a connection handed to one outbound of the group
+type fallbackAttempt struct {
+	conn   *fallbackConn
+	reader *pipe.Reader
+	last   bool
+
+	sync.Mutex
+	responded bool
+	err       error
+}
+
+// SubmitError implements session.TrackedRequestErrorFeedback.
+func (a *fallbackAttempt) SubmitError(err error) {
+	a.Lock()
+	if a.err == nil {
+		a.err = err
+	}
+	a.Unlock()
+}
+
+func (a *fallbackAttempt) failure() error {
+	a.Lock()
+	defer a.Unlock()
+	return a.err
+}
+
+// retry tell if the connection goes on to the next outbound:
+// this one failed before answering and what the client sent can be replayed
+func (a *fallbackAttempt) retry() bool {
+	a.Lock()
+	failed := a.err != nil && !a.responded
+	a.Unlock()
+	if !failed || a.last {
+		return false
+	}
+	c := a.conn
+	c.Lock()
+	defer c.Unlock()
+	return !c.overflow && !c.committed
+}
+
+// fallbackReader is the uplink of an attempt, it stops the client only once the attempt is kept
+type fallbackReader struct {
+	*pipe.Reader
+	attempt *fallbackAttempt
+}
+
+func (r *fallbackReader) Interrupt() {
+	r.Reader.Interrupt()
+	if !r.attempt.retry() {
+		common.Interrupt(r.attempt.conn.link.Reader)
+	}
+}
+
+// fallbackWriter is the downlink of an attempt, the first answer keeps the attempt
+type fallbackWriter struct {
+	attempt *fallbackAttempt
+}
+
+func (w *fallbackWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	a := w.attempt
+	if !mb.IsEmpty() {
+		a.Lock()
+		responded := a.responded
+		a.responded = true
+		a.Unlock()
+		if !responded {
+			a.conn.commit()
+		}
+	}
+	return a.conn.link.Writer.WriteMultiBuffer(mb)
+}
+
+func (w *fallbackWriter) Close() error {
+	if w.attempt.retry() {
+		return nil
+	}
+	w.attempt.conn.commit()
+	return common.Close(w.attempt.conn.link.Writer)
+}
+
+func (w *fallbackWriter) Interrupt() {
+	if w.attempt.retry() {
+		return
+	}
+	w.attempt.conn.commit()
+	common.Interrupt(w.attempt.conn.link.Writer)
+}
+
+// extractFallbackGroups create groups for outbounds of protocol fallback in config
+func extractFallbackGroups(config *v2conf.Config) ([]*fallbackGroup, error) {
+	var groups []*fallbackGroup
+	for i, ob := range config.OutboundConfigs {
+		if !strings.EqualFold(ob.Protocol, "fallback") {
+			continue
+		}
+		if i == 0 {
+			return nil, fmt.Errorf("fallback %q: can not be the first outbound", ob.Tag)
+		}
+		if len(ob.Tag) == 0 {
+			return nil, fmt.Errorf("fallback outbound without tag")
+		}
+		var settings struct {
+			Outbounds []string `json:"outbounds"`
+		}
+		if ob.Settings != nil {
+			if err := json.Unmarshal(*ob.Settings, &settings); err != nil {
+				return nil, fmt.Errorf("fallback %s: %v", ob.Tag, err)
+			}
+		}
+		if len(settings.Outbounds) == 0 {
+			return nil, fmt.Errorf("fallback %s: no outbounds", ob.Tag)
+		}
+		for _, tag := range settings.Outbounds {
+			if tag == ob.Tag {
+				return nil, fmt.Errorf("fallback %s: falls back to itself", ob.Tag)
+			}
+		}
+		groups = append(groups, &fallbackGroup{tag: ob.Tag, members: settings.Outbounds})
+	}
+	return groups, nil
+}
@@ -0,0 +1,105 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// closedPort return a local port nothing listens on
+func closedPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port
+}
+
+func TestFallbackGroup(t *testing.T) {
+	good := smartServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		b := make([]byte, 4)
+		io.ReadFull(conn, b)
+		conn.Write(append([]byte("pong "), b...))
+	})
+	dead := closedPort(t)
+	socksPort := closedPort(t)
+
+	config, err := loadCoreConfig(fmt.Sprintf(`{
+		"inbounds": [{"tag": "socks", "listen": "127.0.0.1", "port": %d, "protocol": "socks"}],
+		"outbounds": [
+			{"tag": "direct", "protocol": "freedom"},
+			{"tag": "dead", "protocol": "freedom", "settings": {"redirect": "127.0.0.1:%d"}},
+			{"tag": "good", "protocol": "freedom", "settings": {"redirect": "127.0.0.1:%d"}},
+			{"tag": "auto", "protocol": "fallback", "settings": {"outbounds": ["dead", "missing", "good"]}},
+			{"tag": "none", "protocol": "fallback", "settings": {"outbounds": ["dead"]}}
+		],
+		"routing": {"rules": [
+			{"type": "field", "port": "1001", "outboundTag": "auto"},
+			{"type": "field", "port": "1002", "outboundTag": "none"}
+		]}
+	}`, socksPort, dead, good))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := config.newInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+	v := &V2RayPoint{config: config}
+	socks := fmt.Sprintf("127.0.0.1:%d", socksPort)
+
+	// what the client sent to the dead outbound is replayed to the good one
+	for i := 0; i < 2; i++ {
+		if answer, err := smartExchange(t, socks, "localhost:1001"); answer != "pong ping" {
+			t.Fatalf("fallback connection failed: %q %v", answer, err)
+		}
+	}
+	if answer, _ := smartExchange(t, socks, "localhost:1002"); len(answer) > 0 {
+		t.Errorf("answer %q through a group of dead outbounds", answer)
+	}
+
+	var status struct {
+		Groups []*fallbackGroupStatus `json:"groups"`
+	}
+	if err := json.Unmarshal([]byte(v.GetFallbackStatus()), &status); err != nil || len(status.Groups) != 2 {
+		t.Fatalf("%s %v", v.GetFallbackStatus(), err)
+	}
+	auto := status.Groups[0].Outbounds
+	if auto[0].Tag != "dead" || auto[0].Attempts != 2 || auto[0].Failures != 2 || auto[0].Consecutive != 2 || len(auto[0].LastError) == 0 {
+		t.Errorf("dead %+v", auto[0])
+	}
+	if auto[1].Attempts != 0 {
+		t.Errorf("missing %+v", auto[1])
+	}
+	if auto[2].Tag != "good" || auto[2].Attempts != 2 || auto[2].Failures != 0 {
+		t.Errorf("good %+v", auto[2])
+	}
+	if none := status.Groups[1].Outbounds[0]; none.Attempts != 1 || none.Failures != 1 {
+		t.Errorf("none %+v", none)
+	}
+}
+
+func TestExtractFallbackGroupsInvalid(t *testing.T) {
+	for _, outbounds := range []string{
+		`{"tag": "auto", "protocol": "fallback", "settings": {"outbounds": ["direct"]}}, {"tag": "direct", "protocol": "freedom"}`,
+		`{"tag": "direct", "protocol": "freedom"}, {"tag": "auto", "protocol": "fallback"}`,
+		`{"tag": "direct", "protocol": "freedom"}, {"tag": "auto", "protocol": "fallback", "settings": {"outbounds": ["auto"]}}`,
+		`{"tag": "direct", "protocol": "freedom"}, {"protocol": "fallback", "settings": {"outbounds": ["direct"]}}`,
+		`{"tag": "direct", "protocol": "freedom"}, {"tag": "a", "protocol": "fallback", "settings": {"outbounds": ["b"]}},
+			{"tag": "b", "protocol": "fallback", "settings": {"outbounds": ["a"]}}`,
+	} {
+		if _, err := loadCoreConfig(`{"outbounds": [` + outbounds + `]}`); err == nil {
+			t.Errorf("expect error for %s", outbounds)
+		}
+	}
+}
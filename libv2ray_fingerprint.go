@@ -0,0 +1,590 @@
+package libv2ray
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	v2net "github.com/xtls/xray-core/common/net"
+	v2core "github.com/xtls/xray-core/core"
+	xtls "github.com/xtls/xray-core/transport/internet/tls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const fingerprintTimeout = 5 * time.Second
+
+// names of the extensions seen in browser ClientHellos
+var tlsExtensionNames = map[uint16]string{
+	0: "server_name", 5: "status_request", 10: "supported_groups", 11: "ec_point_formats",
+	13: "signature_algorithms", 16: "alpn", 17: "status_request_v2", 18: "signed_certificate_timestamp",
+	21: "padding", 23: "extended_master_secret", 27: "compress_certificate", 28: "record_size_limit",
+	34: "delegated_credentials", 35: "session_ticket", 41: "pre_shared_key", 43: "supported_versions",
+	45: "psk_key_exchange_modes", 49: "post_handshake_auth", 50: "signature_algorithms_cert",
+	51: "key_share", 13172: "next_protocol_negotiation", 17513: "application_settings",
+	65037: "encrypted_client_hello", 65281: "renegotiation_info",
+}
+
+// clientHello is what a fingerprint is taken from, GREASE values left out
+type clientHello struct {
+	Version             uint16   `json:"-"`
+	ServerName          string   `json:"serverName,omitempty"`
+	JA3                 string   `json:"ja3"`
+	JA3Hash             string   `json:"ja3Hash"`
+	JA4                 string   `json:"ja4"`
+	TLSVersions         []uint16 `json:"tlsVersions"`
+	CipherSuites        []uint16 `json:"cipherSuites"`
+	Extensions          []uint16 `json:"extensions"`
+	ExtensionNames      []string `json:"extensionNames"`
+	ALPN                []string `json:"alpn"`
+	Groups              []uint16 `json:"groups"`
+	PointFormats        []uint16 `json:"pointFormats"`
+	SignatureAlgorithms []uint16 `json:"signatureAlgorithms"`
+}
+
+type fingerprintCheck struct {
+	Tag         string       `json:"tag"`
+	Security    string       `json:"security,omitempty"`
+	Transport   string       `json:"transport,omitempty"`
+	Fingerprint string       `json:"fingerprint,omitempty"`
+	Captured    *clientHello `json:"captured,omitempty"`
+	Expected    *clientHello `json:"expected,omitempty"`
+	Match       bool         `json:"match"`
+	Differences []string     `json:"differences,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+/*
+CheckTLSFingerprint run the outbound tagged tag, the first TLS or REALITY one if empty,
+against a local server capturing its ClientHello, and report as JSON the JA3 and JA4
+fingerprints, TLS versions, cipher suites, extensions, ALPN, groups and signature algorithms
+it sends, next to those of the configured fingerprint profile, with the differences.
+Transports other than tcp, ws and httpupgrade are captured without an expected profile.
+*/
+func CheckTLSFingerprint(content string, tag string) string {
+	check := &fingerprintCheck{Tag: tag}
+	if err := checkTLSFingerprint(content, check); err != nil {
+		check.Error = err.Error()
+	}
+	b, err := json.Marshal(check)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return string(b)
+}
+
+func checkTLSFingerprint(content string, check *fingerprintCheck) error {
+	config, err := loadCoreConfig(content)
+	if err != nil {
+		return err
+	}
+	var serverName string
+	var alpn []string
+	index := -1
+	for i, ob := range config.json.OutboundConfigs {
+		ss := ob.StreamSetting
+		if (len(check.Tag) > 0 && ob.Tag != check.Tag) || ss == nil {
+			continue
+		}
+		check.Security = strings.ToLower(ss.Security)
+		switch {
+		case check.Security == "tls" && ss.TLSSettings != nil:
+			check.Fingerprint, serverName = ss.TLSSettings.Fingerprint, ss.TLSSettings.ServerName
+			if ss.TLSSettings.ALPN != nil {
+				alpn = *ss.TLSSettings.ALPN
+			}
+		case check.Security == "tls":
+		case check.Security == "reality" && ss.REALITYSettings != nil:
+			check.Fingerprint, serverName = ss.REALITYSettings.Fingerprint, ss.REALITYSettings.ServerName
+		default:
+			continue
+		}
+		check.Tag, index = ob.Tag, i
+		check.Transport = "tcp"
+		if ss.Network != nil {
+			if check.Transport, err = ss.Network.Build(); err != nil {
+				return err
+			}
+		}
+		break
+	}
+	if index < 0 {
+		return errors.New("no outbound with TLS or REALITY")
+	}
+	switch check.Transport {
+	case "mkcp", "quic", "domainsocket":
+		return fmt.Errorf("transport %s not supported", check.Transport)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	m, err := decodeConfigMap(content)
+	if err != nil {
+		return err
+	}
+	captureConfig, err := fingerprintCaptureConfig(m, index, l.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		return err
+	}
+
+	captured := make(chan *clientHello, 1)
+	captureErr := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			captureErr <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(fingerprintTimeout))
+		hello, err := readClientHello(conn)
+		if err != nil {
+			captureErr <- err
+			return
+		}
+		captured <- hello
+	}()
+
+	inst, err := v2core.New(captureConfig)
+	if err != nil {
+		return err
+	}
+	defer inst.Close()
+	if err := inst.Start(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fingerprintTimeout)
+	defer cancel()
+	go func() {
+		conn, err := v2core.Dial(ctx, inst, v2net.TCPDestination(v2net.DomainAddress("www.example.com"), 443))
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// the outbound only connects once there is something to send
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+		io.Copy(io.Discard, conn)
+	}()
+
+	select {
+	case check.Captured = <-captured:
+	case err := <-captureErr:
+		return err
+	case <-ctx.Done():
+		return errors.New("outbound did not connect to the capture server")
+	}
+
+	if check.Transport == "grpc" || check.Transport == "http" {
+		return nil
+	}
+	if check.Fingerprint == "randomized" || check.Fingerprint == "hellorandomized" {
+		check.Differences = []string{"randomized fingerprint has no fixed profile"}
+		return nil
+	}
+	if len(serverName) == 0 {
+		serverName = check.Captured.ServerName
+	}
+	websocket := check.Transport == "websocket" || check.Transport == "httpupgrade"
+	if len(alpn) == 0 {
+		alpn = []string{"h2", "http/1.1"}
+		if websocket {
+			alpn = []string{"http/1.1"}
+		}
+	}
+	if check.Security == "reality" {
+		alpn, websocket = nil, false
+	}
+	if check.Expected, err = expectedClientHello(check.Fingerprint, serverName, alpn, websocket); err != nil {
+		return err
+	}
+	check.Differences = compareClientHellos(check.Captured, check.Expected)
+	check.Match = len(check.Differences) == 0
+	return nil
+}
+
+// fingerprintCaptureConfig keep the outbound at index only, sending it to the capture port.
+// The server name it would send is kept, taken from the server address if not set.
+func fingerprintCaptureConfig(m map[string]interface{}, index int, port int) (*v2core.Config, error) {
+	outbounds := configOutbounds(m)
+	if index >= len(outbounds) {
+		return nil, fmt.Errorf("no outbound %d", index)
+	}
+	ob := outbounds[index]
+	tag, _ := ob["tag"].(string)
+	settings, _ := ob["settings"].(map[string]interface{})
+	original := ""
+	for _, key := range []string{"vnext", "servers"} {
+		servers, _ := settings[key].([]interface{})
+		for _, s := range servers {
+			if server, ok := s.(map[string]interface{}); ok {
+				if address, _ := server["address"].(string); len(original) == 0 {
+					original = address
+				}
+				server["address"] = "127.0.0.1"
+				server["port"] = port
+			}
+		}
+	}
+	if len(original) == 0 {
+		return nil, fmt.Errorf("outbound %s has no server", tag)
+	}
+
+	stream, _ := ob["streamSettings"].(map[string]interface{})
+	if tlsSettings, ok := stream["tlsSettings"].(map[string]interface{}); ok {
+		if sn, _ := tlsSettings["serverName"].(string); len(sn) == 0 && net.ParseIP(original) == nil {
+			tlsSettings["serverName"] = original
+		}
+	} else if strings.EqualFold(fmt.Sprint(stream["security"]), "tls") && net.ParseIP(original) == nil {
+		stream["tlsSettings"] = map[string]interface{}{"serverName": original}
+	}
+	if sockopt, ok := stream["sockopt"].(map[string]interface{}); ok {
+		delete(sockopt, "dialerProxy")
+	}
+	delete(ob, "proxySettings")
+
+	b, err := json.Marshal(map[string]interface{}{
+		"log":       map[string]interface{}{"loglevel": "none"},
+		"outbounds": []interface{}{ob},
+	})
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadCoreConfig(string(b))
+	if err != nil {
+		return nil, err
+	}
+	return config.core, nil
+}
+
+// expectedClientHello is the ClientHello of the fingerprint profile, built the way xray does
+func expectedClientHello(fingerprint string, serverName string, alpn []string, websocket bool) (*clientHello, error) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(fingerprintTimeout))
+
+	if id := xtls.GetFingerprint(fingerprint); id != nil {
+		uconn := utls.UClient(client, &utls.Config{ServerName: serverName, NextProtos: alpn, InsecureSkipVerify: true}, *id)
+		if err := uconn.BuildHandshakeState(); err != nil {
+			return nil, err
+		}
+		if websocket {
+			found := false
+			for _, extension := range uconn.Extensions {
+				if e, ok := extension.(*utls.ALPNExtension); ok {
+					e.AlpnProtocols, found = []string{"http/1.1"}, true
+					break
+				}
+			}
+			if !found {
+				uconn.Extensions = append(uconn.Extensions, &utls.ALPNExtension{AlpnProtocols: []string{"http/1.1"}})
+			}
+			if err := uconn.BuildHandshakeState(); err != nil {
+				return nil, err
+			}
+		}
+		go uconn.Handshake()
+	} else if len(fingerprint) > 0 {
+		return nil, fmt.Errorf("unknown fingerprint %s", fingerprint)
+	} else {
+		go tls.Client(client, &tls.Config{ServerName: serverName, NextProtos: alpn, InsecureSkipVerify: true}).Handshake()
+	}
+	return readClientHello(server)
+}
+
+// readClientHello read TLS records up to the end of the first handshake message, a ClientHello
+func readClientHello(r io.Reader) (*clientHello, error) {
+	var msg []byte
+	header := make([]byte, 5)
+	for len(msg) < 4 || len(msg) < 4+handshakeLen(msg) {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		if header[0] != 0x16 {
+			return nil, fmt.Errorf("not a TLS handshake record: %x", header)
+		}
+		record := make([]byte, int(header[3])<<8|int(header[4]))
+		if _, err := io.ReadFull(r, record); err != nil {
+			return nil, err
+		}
+		msg = append(msg, record...)
+		if len(msg) > 1<<16 {
+			return nil, errors.New("ClientHello too large")
+		}
+	}
+	if msg[0] != 1 {
+		return nil, fmt.Errorf("not a ClientHello: handshake type %d", msg[0])
+	}
+	return parseClientHello(msg[4 : 4+handshakeLen(msg)])
+}
+
+func handshakeLen(msg []byte) int {
+	return int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+}
+
+func parseClientHello(body []byte) (*clientHello, error) {
+	h := &clientHello{ALPN: []string{}}
+	s := cryptobyte.String(body)
+	var random, sessionID, ciphers, compression, extensions cryptobyte.String
+	if !s.ReadUint16(&h.Version) || !s.ReadBytes((*[]byte)(&random), 32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) || !s.ReadUint16LengthPrefixed(&ciphers) ||
+		!s.ReadUint8LengthPrefixed(&compression) {
+		return nil, errors.New("malformed ClientHello")
+	}
+	for !ciphers.Empty() {
+		var c uint16
+		if !ciphers.ReadUint16(&c) {
+			return nil, errors.New("malformed cipher suites")
+		}
+		if !isGREASE(c) {
+			h.CipherSuites = append(h.CipherSuites, c)
+		}
+	}
+	if !s.Empty() && !s.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errors.New("malformed extensions")
+	}
+	for !extensions.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&typ) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errors.New("malformed extension")
+		}
+		if isGREASE(typ) {
+			continue
+		}
+		h.Extensions = append(h.Extensions, typ)
+		name, found := tlsExtensionNames[typ]
+		if !found {
+			name = fmt.Sprint(typ)
+		}
+		h.ExtensionNames = append(h.ExtensionNames, name)
+		if err := parseExtension(h, typ, data); err != nil {
+			return nil, fmt.Errorf("extension %s: %v", name, err)
+		}
+	}
+	if len(h.TLSVersions) == 0 {
+		h.TLSVersions = []uint16{h.Version}
+	}
+	h.JA3, h.JA4 = ja3(h), ja4(h)
+	sum := md5.Sum([]byte(h.JA3))
+	h.JA3Hash = hex.EncodeToString(sum[:])
+	return h, nil
+}
+
+func parseExtension(h *clientHello, typ uint16, data cryptobyte.String) error {
+	var list cryptobyte.String
+	switch typ {
+	case 0:
+		if !data.ReadUint16LengthPrefixed(&list) {
+			return errors.New("malformed")
+		}
+		for !list.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !list.ReadUint8(&nameType) || !list.ReadUint16LengthPrefixed(&name) {
+				return errors.New("malformed")
+			}
+			if nameType == 0 {
+				h.ServerName = string(name)
+			}
+		}
+	case 16:
+		if !data.ReadUint16LengthPrefixed(&list) {
+			return errors.New("malformed")
+		}
+		for !list.Empty() {
+			var proto cryptobyte.String
+			if !list.ReadUint8LengthPrefixed(&proto) {
+				return errors.New("malformed")
+			}
+			h.ALPN = append(h.ALPN, string(proto))
+		}
+	case 10, 13:
+		if !data.ReadUint16LengthPrefixed(&list) {
+			return errors.New("malformed")
+		}
+		values, err := readUint16s(list)
+		if err != nil {
+			return err
+		}
+		if typ == 10 {
+			h.Groups = values
+		} else {
+			h.SignatureAlgorithms = values
+		}
+	case 11:
+		if !data.ReadUint8LengthPrefixed(&list) {
+			return errors.New("malformed")
+		}
+		for _, f := range list {
+			h.PointFormats = append(h.PointFormats, uint16(f))
+		}
+	case 43:
+		if !data.ReadUint8LengthPrefixed(&list) {
+			return errors.New("malformed")
+		}
+		values, err := readUint16s(list)
+		if err != nil {
+			return err
+		}
+		h.TLSVersions = values
+	}
+	return nil
+}
+
+// readUint16s read a list of uint16, GREASE values left out
+func readUint16s(s cryptobyte.String) ([]uint16, error) {
+	var values []uint16
+	for !s.Empty() {
+		var v uint16
+		if !s.ReadUint16(&v) {
+			return nil, errors.New("malformed")
+		}
+		if !isGREASE(v) {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// isGREASE tell the reserved values of RFC 8701, 0x0a0a, 0x1a1a ... 0xfafa
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ja3 is "version,ciphers,extensions,groups,point formats" in decimal
+func ja3(h *clientHello) string {
+	return strings.Join([]string{
+		fmt.Sprint(h.Version), joinUint16(h.CipherSuites, "%d"), joinUint16(h.Extensions, "%d"),
+		joinUint16(h.Groups, "%d"), joinUint16(h.PointFormats, "%d"),
+	}, ",")
+}
+
+// ja4 is the JA4 TLS client fingerprint, e.g. t13d1516h2_8daaf6152771_02713d6af862
+func ja4(h *clientHello) string {
+	version := "00"
+	max := uint16(0)
+	for _, v := range h.TLSVersions {
+		if v > max {
+			max = v
+		}
+	}
+	switch max {
+	case tls.VersionTLS13:
+		version = "13"
+	case tls.VersionTLS12:
+		version = "12"
+	case tls.VersionTLS11:
+		version = "11"
+	case tls.VersionTLS10:
+		version = "10"
+	}
+	sni := "i"
+	if len(h.ServerName) > 0 {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.ALPN) > 0 && len(h.ALPN[0]) > 0 {
+		first := h.ALPN[0]
+		alpn = first[:1] + first[len(first)-1:]
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", version, sni, min(len(h.CipherSuites), 99), min(len(h.Extensions), 99), alpn)
+
+	ciphers := append([]uint16(nil), h.CipherSuites...)
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	var extensions []uint16
+	for _, e := range h.Extensions {
+		if e != 0 && e != 16 {
+			extensions = append(extensions, e)
+		}
+	}
+	sort.Slice(extensions, func(i, j int) bool { return extensions[i] < extensions[j] })
+	c := joinUint16(extensions, "%04x")
+	if len(h.SignatureAlgorithms) > 0 {
+		c += "_" + joinUint16(h.SignatureAlgorithms, "%04x")
+	}
+	return a + "_" + truncatedHash(joinUint16(ciphers, "%04x"), len(ciphers) == 0) +
+		"_" + truncatedHash(c, len(extensions) == 0)
+}
+
+func truncatedHash(s string, empty bool) string {
+	if empty {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func joinUint16(values []uint16, format string) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = fmt.Sprintf(format, v)
+	}
+	sep := ","
+	if format == "%d" {
+		sep = "-"
+	}
+	return strings.Join(s, sep)
+}
+
+// compareClientHellos list what differs from the expected profile. Extension order
+// and padding are left out, browsers shuffle extensions and pad to a length.
+func compareClientHellos(captured, expected *clientHello) []string {
+	var diffs []string
+	compare := func(what string, got, want []uint16) {
+		if joinUint16(got, "%d") != joinUint16(want, "%d") {
+			diffs = append(diffs, fmt.Sprintf("%s %v, expected %v", what, got, want))
+		}
+	}
+	compare("TLS versions", captured.TLSVersions, expected.TLSVersions)
+	compare("cipher suites", captured.CipherSuites, expected.CipherSuites)
+	compare("groups", captured.Groups, expected.Groups)
+	compare("signature algorithms", captured.SignatureAlgorithms, expected.SignatureAlgorithms)
+	if strings.Join(captured.ALPN, ",") != strings.Join(expected.ALPN, ",") {
+		diffs = append(diffs, fmt.Sprintf("alpn %v, expected %v", captured.ALPN, expected.ALPN))
+	}
+
+	has := func(h *clientHello) map[uint16]bool {
+		m := make(map[uint16]bool)
+		for _, e := range h.Extensions {
+			if e != 21 {
+				m[e] = true
+			}
+		}
+		return m
+	}
+	got, want := has(captured), has(expected)
+	for _, e := range expected.Extensions {
+		if want[e] && !got[e] {
+			diffs = append(diffs, "missing extension "+extensionName(e))
+		}
+	}
+	for _, e := range captured.Extensions {
+		if got[e] && !want[e] {
+			diffs = append(diffs, "unexpected extension "+extensionName(e))
+		}
+	}
+	return diffs
+}
+
+func extensionName(typ uint16) string {
+	if name, found := tlsExtensionNames[typ]; found {
+		return fmt.Sprintf("%s (%d)", name, typ)
+	}
+	return fmt.Sprint(typ)
+}
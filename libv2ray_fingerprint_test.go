@@ -0,0 +1,93 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func fingerprintConfig(address string, stream string) string {
+	return `{"outbounds": [
+		{"tag": "direct", "protocol": "freedom"},
+		{"tag": "proxy", "protocol": "vless", "settings": {"vnext": [{"address": "` + address + `", "port": 443,
+			"users": [{"id": "27848739-7e62-4138-9fd3-098a63964b6b", "encryption": "none"}]}]},
+			"streamSettings": ` + stream + `}
+	]}`
+}
+
+func TestCheckTLSFingerprint(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		tag        string
+		serverName string
+		alpn       string
+		ja4        string
+	}{
+		{"chrome", fingerprintConfig("1.2.3.4", `{"security": "tls", "tlsSettings": {"serverName": "www.example.com", "fingerprint": "chrome"}}`),
+			"proxy", "www.example.com", "h2,http/1.1", "t13d"},
+		{"firefox over ws", fingerprintConfig("1.2.3.4", `{"network": "ws", "security": "tls", "tlsSettings": {"serverName": "ws.example.com", "fingerprint": "firefox"}}`),
+			"", "ws.example.com", "http/1.1", "t13d"},
+		{"go", fingerprintConfig("server.example.org", `{"security": "tls", "tlsSettings": {"alpn": ["h2"]}}`),
+			"proxy", "server.example.org", "h2", "t13d"},
+		{"after fallback", strings.Replace(fingerprintConfig("1.2.3.4", `{"security": "tls", "tlsSettings": {"serverName": "www.example.com"}}`),
+			`{"tag": "proxy"`, `{"tag": "auto", "protocol": "fallback", "settings": {"outbounds": ["proxy", "direct"]}}, {"tag": "proxy"`, 1),
+			"", "www.example.com", "h2,http/1.1", "t13d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var check fingerprintCheck
+			if err := json.Unmarshal([]byte(CheckTLSFingerprint(tt.config, tt.tag)), &check); err != nil {
+				t.Fatal(err)
+			}
+			if len(check.Error) > 0 || check.Captured == nil || check.Expected == nil {
+				t.Fatalf("%+v", check)
+			}
+			if check.Tag != "proxy" || !check.Match || len(check.Differences) > 0 {
+				t.Errorf("tag %s match %v: %v", check.Tag, check.Match, check.Differences)
+			}
+			c := check.Captured
+			if c.ServerName != tt.serverName || strings.Join(c.ALPN, ",") != tt.alpn || !strings.HasPrefix(c.JA4, tt.ja4) {
+				t.Errorf("captured %s %v %s", c.ServerName, c.ALPN, c.JA4)
+			}
+			if len(c.JA3Hash) != 32 || strings.Count(c.JA3, ",") != 4 || len(strings.Split(c.JA4, "_")) != 3 {
+				t.Errorf("ja3 %s %s ja4 %s", c.JA3, c.JA3Hash, c.JA4)
+			}
+			for _, v := range append(c.CipherSuites, c.Extensions...) {
+				if isGREASE(v) {
+					t.Errorf("GREASE value %x kept", v)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckTLSFingerprintInvalid(t *testing.T) {
+	for _, config := range []string{
+		`{"outbounds": [{"protocol": "freedom"}]}`,
+		fingerprintConfig("1.2.3.4", `{"network": "kcp", "security": "tls"}`),
+		"{",
+	} {
+		var check fingerprintCheck
+		if err := json.Unmarshal([]byte(CheckTLSFingerprint(config, "")), &check); err != nil || len(check.Error) == 0 {
+			t.Errorf("expect error for %s: %+v", config, check)
+		}
+	}
+}
+
+func TestCompareClientHellos(t *testing.T) {
+	expected := &clientHello{TLSVersions: []uint16{0x0304, 0x0303}, CipherSuites: []uint16{0x1301},
+		Extensions: []uint16{0, 16, 43, 17513}, ALPN: []string{"h2", "http/1.1"}}
+	captured := &clientHello{TLSVersions: []uint16{0x0303}, CipherSuites: []uint16{0x1301},
+		Extensions: []uint16{16, 0, 43, 21}, ALPN: []string{"http/1.1"}}
+	diffs := compareClientHellos(captured, expected)
+	want := []string{"TLS versions", "alpn", "missing extension application_settings (17513)"}
+	if len(diffs) != len(want) {
+		t.Fatal(diffs)
+	}
+	for i := range want {
+		if !strings.HasPrefix(diffs[i], want[i]) {
+			t.Errorf("%s, expected %s", diffs[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	v2conf "github.com/xtls/xray-core/infra/conf"
+)
+
+type inboundSummary struct {
+	Tag      string `json:"tag,omitempty"`
+	Protocol string `json:"protocol"`
+	Listen   string `json:"listen"`
+	Port     string `json:"port,omitempty"`
+}
+
+type outboundSummary struct {
+	Tag       string   `json:"tag,omitempty"`
+	Protocol  string   `json:"protocol"`
+	Servers   []string `json:"servers,omitempty"`
+	Transport string   `json:"transport,omitempty"`
+	Security  string   `json:"security,omitempty"`
+	Outbounds []string `json:"outbounds,omitempty"`
+}
+
+type balancerSummary struct {
+	Tag       string   `json:"tag"`
+	Selectors []string `json:"selectors"`
+	Strategy  string   `json:"strategy"`
+	Fallback  string   `json:"fallback,omitempty"`
+}
+
+type configSummary struct {
+	Inbounds      []*inboundSummary  `json:"inbounds"`
+	Outbounds     []*outboundSummary `json:"outbounds"`
+	Balancers     []*balancerSummary `json:"balancers"`
+	Rules         map[string]int     `json:"rules"`
+	DNSServers    []string           `json:"dnsServers"`
+	GeoCategories []string           `json:"geoCategories"`
+	PrimaryServer string             `json:"primaryServer,omitempty"`
+	Error         string             `json:"error,omitempty"`
+}
+
+// rule fields counted by InspectConfig, aliases count as the field itself
+var ruleFields = map[string]string{
+	"domain": "domain", "domains": "domain", "ip": "ip", "port": "port",
+	"sourcePort": "sourcePort", "source": "source", "network": "network",
+	"inboundTag": "inboundTag", "protocol": "protocol", "user": "user", "attrs": "attrs",
+}
+
+/*
+InspectConfig describe a config for UI overviews as JSON: inbounds, outbounds with their
+servers, transport and security or the outbounds they go over, balancers, rule counts by matched field, DNS servers,
+geosite/geoip categories referenced, and the primary server to use as DomainName.
+The config is loaded as pointloop does, an invalid one is reported in "error".
+*/
+func InspectConfig(content string) string {
+	summary := &configSummary{}
+	config, err := loadCoreConfig(content)
+	if err != nil {
+		summary.Error = err.Error()
+	} else {
+		inspectCoreConfig(config, summary)
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func inspectCoreConfig(config *coreConfig, s *configSummary) {
+	c := config.json
+	geo := make(map[string]bool)
+
+	s.Inbounds = make([]*inboundSummary, 0, len(c.InboundConfigs))
+	for _, ib := range c.InboundConfigs {
+		in := &inboundSummary{Tag: ib.Tag, Protocol: ib.Protocol, Listen: "0.0.0.0"}
+		if ib.ListenOn != nil {
+			in.Listen = ib.ListenOn.String()
+		}
+		if ib.PortList != nil {
+			ports := make([]string, 0, len(ib.PortList.Range))
+			for _, r := range ib.PortList.Range {
+				if r.From == r.To {
+					ports = append(ports, fmt.Sprint(r.From))
+				} else {
+					ports = append(ports, fmt.Sprintf("%d-%d", r.From, r.To))
+				}
+			}
+			in.Port = strings.Join(ports, ",")
+		}
+		s.Inbounds = append(s.Inbounds, in)
+	}
+
+	s.Outbounds = make([]*outboundSummary, 0, len(c.OutboundConfigs))
+	for _, ob := range c.OutboundConfigs {
+		out := &outboundSummary{Tag: ob.Tag, Protocol: ob.Protocol}
+		if ob.Settings != nil {
+			out.Servers = outboundEndpoints(*ob.Settings)
+		}
+		if len(out.Servers) > 0 {
+			out.Transport, out.Security = "tcp", "none"
+			if ss := ob.StreamSetting; ss != nil {
+				if ss.Network != nil {
+					out.Transport = strings.ToLower(string(*ss.Network))
+				}
+				if len(ss.Security) > 0 {
+					out.Security = strings.ToLower(ss.Security)
+				}
+			}
+			if len(s.PrimaryServer) == 0 {
+				s.PrimaryServer = out.Servers[0]
+			}
+		}
+		s.Outbounds = append(s.Outbounds, out)
+	}
+
+	s.Balancers = make([]*balancerSummary, 0)
+	s.Rules = map[string]int{"total": 0}
+	if c.RouterConfig != nil {
+		for _, rule := range c.RouterConfig.Balancers {
+			strategy := rule.Strategy.Type
+			if len(strategy) == 0 {
+				strategy = "random"
+			}
+			s.Balancers = append(s.Balancers, &balancerSummary{
+				Tag: rule.Tag, Selectors: rule.Selectors, Strategy: strategy, Fallback: rule.FallbackTag,
+			})
+		}
+		for _, raw := range c.RouterConfig.RuleList {
+			inspectRule(raw, s.Rules, geo)
+		}
+	}
+	if config.expressions != nil {
+		for _, r := range config.expressions.rules {
+			if r.expr != nil {
+				s.Rules["total"]++
+				s.Rules["expression"]++
+			}
+		}
+	}
+	for _, h := range config.outbounds {
+		if b, ok := h.(*libBalancer); ok {
+			s.Balancers = append(s.Balancers, &balancerSummary{
+				Tag: b.tag, Selectors: b.selectors, Strategy: b.strategyTyp, Fallback: b.fallbackTag,
+			})
+		}
+		if members := outboundMembers(h); len(members) > 0 {
+			for _, out := range s.Outbounds {
+				if out.Tag == h.Tag() {
+					out.Outbounds = members
+				}
+			}
+		}
+	}
+
+	s.DNSServers = make([]string, 0)
+	if c.DNSConfig != nil {
+		for _, ns := range c.DNSConfig.Servers {
+			s.DNSServers = append(s.DNSServers, nameServerString(ns))
+			addGeoCategories(geo, ns.Domains)
+			addGeoCategories(geo, ns.ExpectIPs)
+		}
+	}
+
+	s.GeoCategories = make([]string, 0, len(geo))
+	for category := range geo {
+		s.GeoCategories = append(s.GeoCategories, category)
+	}
+	sort.Strings(s.GeoCategories)
+}
+
+func inspectRule(raw json.RawMessage, counts map[string]int, geo map[string]bool) {
+	var rule map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &rule); err != nil {
+		return
+	}
+	counts["total"]++
+	for key, value := range rule {
+		field, found := ruleFields[key]
+		if !found {
+			continue
+		}
+		counts[field]++
+		if field == "domain" || field == "ip" || field == "source" {
+			var list []string
+			json.Unmarshal(value, &list)
+			addGeoCategories(geo, list)
+		}
+	}
+}
+
+// addGeoCategories collect geosite:, geoip: and ext: entries
+func addGeoCategories(geo map[string]bool, list []string) {
+	for _, item := range list {
+		kind, category, found := strings.Cut(item, ":")
+		if found && (kind == "geosite" || kind == "geoip" || kind == "ext") {
+			// geoip:!cn matches the rest, the category is still cn
+			geo[kind+":"+strings.ToLower(strings.TrimPrefix(category, "!"))] = true
+		}
+	}
+}
+
+func nameServerString(ns *v2conf.NameServerConfig) string {
+	if ns.Address == nil {
+		return ""
+	}
+	address := ns.Address.String()
+	if ns.Port > 0 {
+		return net.JoinHostPort(address, fmt.Sprint(ns.Port))
+	}
+	return address
+}
+
+// outboundEndpoints return host:port of servers in outbound settings of any proxy protocol
+func outboundEndpoints(settings json.RawMessage) []string {
+	type server struct {
+		Address  string `json:"address"`
+		Port     int    `json:"port"`
+		Endpoint string `json:"endpoint"`
+	}
+	var s struct {
+		Vnext   []server `json:"vnext"`
+		Servers []server `json:"servers"`
+		Peers   []server `json:"peers"`
+	}
+	if err := json.Unmarshal(settings, &s); err != nil {
+		return nil
+	}
+	endpoints := make([]string, 0)
+	for _, list := range [][]server{s.Vnext, s.Servers, s.Peers} {
+		for _, srv := range list {
+			switch {
+			case len(srv.Endpoint) > 0:
+				endpoints = append(endpoints, srv.Endpoint)
+			case len(srv.Address) > 0 && srv.Port > 0:
+				endpoints = append(endpoints, net.JoinHostPort(srv.Address, fmt.Sprint(srv.Port)))
+			}
+		}
+	}
+	return endpoints
+}
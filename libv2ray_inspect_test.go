@@ -0,0 +1,87 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInspectConfig(t *testing.T) {
+	assets, _ := filepath.Abs("assets")
+	t.Setenv(v2Asset, assets)
+	content := `{
+		"dns": {"servers": ["1.1.1.1", {"address": "8.8.8.8", "port": 5353, "domains": ["geosite:google"]}]},
+		"inbounds": [
+			{"tag": "socks", "listen": "127.0.0.1", "port": 10808, "protocol": "socks"},
+			{"tag": "http", "port": "10809-10810", "protocol": "http"}],
+		"outbounds": [
+			{"tag": "direct", "protocol": "freedom"},
+			{"tag": "proxy", "protocol": "vless", "settings": {"vnext": [{"address": "a.example.com", "port": 443,
+				"users": [{"id": "b831381d-6324-4d53-ad4f-8cda48b30811", "encryption": "none"}]}]},
+				"streamSettings": {"network": "ws", "security": "tls"}},
+			{"tag": "ss", "protocol": "shadowsocks", "settings": {"servers": [{"address": "10.0.0.1", "port": 8388,
+				"method": "aes-128-gcm", "password": "p"}]}},
+			{"tag": "auto", "protocol": "fallback", "settings": {"outbounds": ["proxy", "ss"]}},
+			{"tag": "game", "protocol": "dualpath", "settings": {"outbounds": ["proxy", "ss"]}}],
+		"routing": {
+			"rules": [
+				{"type": "field", "domain": ["geosite:cn", "example.com"], "outboundTag": "direct"},
+				{"type": "field", "ip": ["geoip:private", "geoip:!cn"], "port": "443", "outboundTag": "direct"},
+				{"type": "field", "network": "udp", "balancerTag": "sticky"},
+				{"type": "field", "inboundTag": ["http"], "balancerTag": "random"}],
+			"balancers": [
+				{"tag": "sticky", "selector": ["proxy"], "strategy": {"type": "sticky"}},
+				{"tag": "random", "selector": ["proxy", "ss"]}]}}`
+
+	var s configSummary
+	if err := json.Unmarshal([]byte(InspectConfig(content)), &s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Error) > 0 {
+		t.Fatal(s.Error)
+	}
+	if len(s.Inbounds) != 2 || s.Inbounds[0].Listen != "127.0.0.1" || s.Inbounds[1].Port != "10809-10810" {
+		t.Errorf("unexpected inbounds: %+v %+v", s.Inbounds[0], s.Inbounds[1])
+	}
+	proxy := s.Outbounds[1]
+	if !reflect.DeepEqual(proxy.Servers, []string{"a.example.com:443"}) || proxy.Transport != "ws" || proxy.Security != "tls" {
+		t.Errorf("unexpected outbound: %+v", proxy)
+	}
+	if len(s.Outbounds[0].Servers) != 0 || s.Outbounds[2].Security != "none" {
+		t.Errorf("unexpected outbounds: %+v %+v", s.Outbounds[0], s.Outbounds[2])
+	}
+	if auto := s.Outbounds[3]; auto.Protocol != "fallback" || !reflect.DeepEqual(auto.Outbounds, []string{"proxy", "ss"}) {
+		t.Errorf("unexpected fallback: %+v", auto)
+	}
+	if game := s.Outbounds[4]; game.Protocol != "dualpath" || !reflect.DeepEqual(game.Outbounds, []string{"proxy", "ss"}) {
+		t.Errorf("unexpected dualpath: %+v", game)
+	}
+	if s.PrimaryServer != "a.example.com:443" {
+		t.Errorf("primary server %q", s.PrimaryServer)
+	}
+	if len(s.Balancers) != 2 {
+		t.Errorf("unexpected balancers: %+v", s.Balancers)
+	}
+	wantRules := map[string]int{"total": 4, "domain": 1, "ip": 1, "port": 1, "network": 1, "inboundTag": 1}
+	if !reflect.DeepEqual(s.Rules, wantRules) {
+		t.Errorf("rules %v, want %v", s.Rules, wantRules)
+	}
+	if !reflect.DeepEqual(s.DNSServers, []string{"1.1.1.1", "8.8.8.8:5353"}) {
+		t.Errorf("dns servers %v", s.DNSServers)
+	}
+	wantGeo := []string{"geoip:cn", "geoip:private", "geosite:cn", "geosite:google"}
+	if !reflect.DeepEqual(s.GeoCategories, wantGeo) {
+		t.Errorf("geo categories %v, want %v", s.GeoCategories, wantGeo)
+	}
+}
+
+func TestInspectConfigInvalid(t *testing.T) {
+	var s configSummary
+	if err := json.Unmarshal([]byte(InspectConfig(`{"outbounds": [{"protocol": "nope"}]}`)), &s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Error) == 0 {
+		t.Error("expect error")
+	}
+}
@@ -0,0 +1,166 @@
+package libv2ray
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	v2conf "github.com/xtls/xray-core/infra/conf"
+	v2serial "github.com/xtls/xray-core/infra/conf/serial"
+)
+
+// blockingConfig keep inbounds of content and send everything they accept to a blackhole,
+// so nothing leaks while the VPN interface stays up
+func blockingConfig(content string) (*coreConfig, error) {
+	jsonConfig, err := v2serial.DecodeJSONConfig(strings.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	blocking := &v2conf.Config{
+		LogConfig:       jsonConfig.LogConfig,
+		OutboundConfigs: []v2conf.OutboundDetourConfig{{Tag: "block", Protocol: "blackhole"}},
+	}
+	for _, ib := range jsonConfig.InboundConfigs {
+		// sniffing may need fakedns, which is not kept
+		ib.SniffingConfig = nil
+		blocking.InboundConfigs = append(blocking.InboundConfigs, ib)
+	}
+
+	c := &coreConfig{json: blocking}
+	if c.core, err = blocking.Build(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// block run the blocking core in place of a failed one, v2rayOP must be held
+// and the failed core closed. Without a core at all the VPN service is shut down.
+func (v *V2RayPoint) block(cause error) error {
+	log.Printf("kill switch, blocking traffic: %v", cause)
+	v.Vpoint = nil
+	config, err := blockingConfig(v.configContent())
+	if err == nil {
+		err = v.startCore(config)
+	}
+	if err != nil {
+		log.Printf("kill switch failed: %v", err)
+		if v.Vpoint != nil {
+			v.Vpoint.Close()
+		}
+		close(v.closeChan)
+		v.IsRunning = false
+		v.IsBlocked = false
+		v.unblock = nil
+		v.Vpoint = nil
+		v.statsManager = nil
+		v.config = nil
+		v.SupportSet.OnEmitStatus(0, "Closed")
+		v.SupportSet.Shutdown()
+		return err
+	}
+
+	if !v.IsBlocked {
+		v.IsBlocked = true
+		v.unblock = make(chan struct{}, 1)
+		go v.recoverLoop(v.closeChan, v.unblock)
+		v.SupportSet.OnEmitStatus(0, "Blocked")
+	}
+	return nil
+}
+
+// blockUnresolved block traffic if the server of closeCh's run can not be resolved
+func (v *V2RayPoint) blockUnresolved(closeCh chan struct{}) {
+	v.v2rayOP.Lock()
+	defer v.v2rayOP.Unlock()
+	if !v.IsRunning || v.IsBlocked || v.closeChan != closeCh {
+		return
+	}
+	v.Vpoint.Close()
+	v.block(errors.New("vServer cannot resolved"))
+}
+
+// retryUnblock make the recover loop try again now, v2rayOP must be held
+func (v *V2RayPoint) retryUnblock() {
+	select {
+	case v.unblock <- struct{}{}:
+	default:
+	}
+}
+
+// recoverLoop retry the real config with backoff, until it runs or the point is stopped
+func (v *V2RayPoint) recoverLoop(closeCh chan struct{}, retry chan struct{}) {
+	backoff := 5 * time.Second
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-retry:
+		case <-time.After(backoff):
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+		}
+		if v.tryRecover(closeCh, retry) {
+			return
+		}
+	}
+}
+
+// tryRecover return true if nothing is left to recover
+func (v *V2RayPoint) tryRecover(closeCh chan struct{}, retry chan struct{}) bool {
+	v.v2rayOP.Lock()
+	if v.unblock != retry {
+		v.v2rayOP.Unlock()
+		return true
+	}
+	v.dialer.setServer(v.DomainName)
+	v.dialer.Reset(closeCh)
+	resolveCh := v.dialer.ResolveChan()
+	v.v2rayOP.Unlock()
+
+	select {
+	case <-resolveCh:
+	case <-closeCh:
+		return true
+	}
+	if !v.dialer.IsVServerReady() {
+		log.Println("still blocked, vServer cannot resolved")
+		return false
+	}
+
+	v.v2rayOP.Lock()
+	defer v.v2rayOP.Unlock()
+	if v.unblock != retry {
+		return true
+	}
+	config, err := loadCoreConfig(v.configContent())
+	if err != nil {
+		log.Printf("still blocked: %v", err)
+		return false
+	}
+
+	blockInst, blockConfig := v.Vpoint, v.config
+	blockInst.Close()
+	if err := v.startCore(config); err != nil {
+		log.Printf("still blocked: %v", err)
+		if v.Vpoint != blockInst {
+			v.Vpoint.Close()
+		}
+		if err := v.startCore(blockConfig); err != nil {
+			if v.Vpoint != blockInst {
+				v.Vpoint.Close()
+			}
+			v.block(err)
+			return v.unblock != retry
+		}
+		return false
+	}
+
+	log.Println("kill switch released")
+	v.IsBlocked = false
+	v.unblock = nil
+	v.SupportSet.OnEmitStatus(0, "Running")
+	return true
+}
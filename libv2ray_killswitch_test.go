@@ -0,0 +1,178 @@
+package libv2ray
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a config that loads, but whose core fails to start
+const testFailingConfig = `{"outbounds": [{"tag": "a", "protocol": "freedom"}, {"tag": "a", "protocol": "freedom"}]}`
+
+func TestBlockingConfig(t *testing.T) {
+	config := `{
+		"inbounds": [{"tag": "socks", "port": 10808, "protocol": "socks",
+			"sniffing": {"enabled": true, "destOverride": ["fakedns"]}}],
+		"outbounds": [{"tag": "proxy", "protocol": "vmess",
+			"settings": {"vnext": [{"address": "example.com", "port": 443, "users": [{"id": "b831381d-6324-4d53-ad4f-8cda48b30811"}]}]}}],
+		"fakedns": [{"ipPool": "198.18.0.0/15", "poolSize": 65535}],
+		"routing": {"rules": [{"type": "field", "port": "53", "outboundTag": "proxy"}]}
+	}`
+
+	c, err := blockingConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.json.InboundConfigs) != 1 || c.json.InboundConfigs[0].Tag != "socks" {
+		t.Errorf("inbounds not kept: %+v", c.json.InboundConfigs)
+	}
+	if c.json.InboundConfigs[0].SniffingConfig != nil {
+		t.Error("sniffing not removed")
+	}
+	if len(c.json.OutboundConfigs) != 1 || c.json.OutboundConfigs[0].Protocol != "blackhole" {
+		t.Errorf("expect a single blackhole, got %+v", c.json.OutboundConfigs)
+	}
+	if c.json.RouterConfig != nil || c.json.FakeDNS != nil {
+		t.Error("routing and fakedns should be dropped")
+	}
+
+	if _, err := blockingConfig("{bad"); err == nil {
+		t.Error("expect error")
+	}
+}
+
+// waitStatus wait until status is emitted, return what was emitted up to it
+func waitStatus(t *testing.T, support *recordingSupportSet, status string) []string {
+	t.Helper()
+	var statuses []string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, s := range support.take() {
+			statuses = append(statuses, s)
+			if s == status {
+				return statuses
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no status %s, got %v", status, statuses)
+	return nil
+}
+
+// checkBlocked fail unless v runs the blocking core
+func checkBlocked(t *testing.T, v *V2RayPoint) {
+	t.Helper()
+	v.v2rayOP.Lock()
+	defer v.v2rayOP.Unlock()
+	if !v.IsRunning || !v.IsBlocked || v.config == nil {
+		t.Fatalf("not blocked: running %v, blocked %v", v.IsRunning, v.IsBlocked)
+	}
+	if obs := v.config.json.OutboundConfigs; len(obs) != 1 || obs[0].Protocol != "blackhole" {
+		t.Errorf("blocking core goes out through %+v", obs)
+	}
+}
+
+// waitRecoverLoopGone fail if a recover loop is still running after a while
+func waitRecoverLoopGone(t *testing.T) {
+	t.Helper()
+	b := make([]byte, 1<<20)
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Contains(string(b[:runtime.Stack(b, true)]), ").recoverLoop(") {
+		if time.Now().After(deadline) {
+			t.Fatal("recover loop left running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKillSwitchCoreFailure(t *testing.T) {
+	support := &recordingSupportSet{}
+	v := newTestPoint(support)
+	v.KillSwitch = true
+	v.ConfigureFileContent = testFailingConfig
+	defer v.StopLoop()
+
+	if err := v.RunLoop(false); err != nil {
+		t.Fatal(err)
+	}
+	if statuses := waitStatus(t, support, "Blocked"); len(statuses) != 1 {
+		t.Errorf("statuses %v", statuses)
+	}
+	checkBlocked(t, v)
+
+	// a working config is tried at once, not after the backoff
+	if err := v.ReloadConfig(testLocalConfig, ""); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, support, "Running")
+	if _, config := v.runningCore(); v.IsBlocked || config == nil || config.json.OutboundConfigs[0].Protocol != "freedom" {
+		t.Errorf("not recovered: blocked %v", v.IsBlocked)
+	}
+}
+
+func TestKillSwitchUnresolved(t *testing.T) {
+	support := &recordingSupportSet{}
+	v := newTestPoint(support)
+	v.KillSwitch = true
+	defer v.StopLoop()
+
+	if err := v.RunLoop(false); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, support, "Running")
+
+	// what an earlier run found out is not about this one
+	v.blockUnresolved(make(chan struct{}))
+	if v.IsBlocked {
+		t.Fatal("blocked by a stale run")
+	}
+	v.blockUnresolved(v.closeChan)
+	waitStatus(t, support, "Blocked")
+	checkBlocked(t, v)
+
+	// the server resolves again, but the config is still broken
+	v.v2rayOP.Lock()
+	v.ConfigureFileContent = testFailingConfig
+	v.v2rayOP.Unlock()
+	v.NetworkChanged()
+	time.Sleep(200 * time.Millisecond)
+	checkBlocked(t, v)
+
+	v.v2rayOP.Lock()
+	v.ConfigureFileContent = testLocalConfig
+	v.v2rayOP.Unlock()
+	v.NetworkChanged()
+	waitStatus(t, support, "Running")
+	if v.IsBlocked {
+		t.Error("still blocked")
+	}
+	waitRecoverLoopGone(t)
+}
+
+func TestKillSwitchStopWhileRecovering(t *testing.T) {
+	support := &recordingSupportSet{}
+	v := newTestPoint(support)
+	v.KillSwitch = true
+	v.ConfigureFileContent = testFailingConfig
+
+	if err := v.RunLoop(false); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, support, "Blocked")
+	v.NetworkChanged()
+	if err := v.StopLoop(); err != nil {
+		t.Fatal(err)
+	}
+	if v.IsRunning || v.IsBlocked {
+		t.Errorf("running %v, blocked %v after stop", v.IsRunning, v.IsBlocked)
+	}
+
+	waitRecoverLoopGone(t)
+	time.Sleep(100 * time.Millisecond)
+	for _, s := range support.take() {
+		if s != "Closed" {
+			t.Errorf("status %s after stop", s)
+		}
+	}
+}
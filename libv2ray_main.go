@@ -10,7 +10,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 
@@ -20,7 +19,6 @@ import (
 	v2filesystem "github.com/xtls/xray-core/common/platform/filesystem"
 	v2core "github.com/xtls/xray-core/core"
 	v2stats "github.com/xtls/xray-core/features/stats"
-	v2serial "github.com/xtls/xray-core/infra/conf/serial"
 	_ "github.com/xtls/xray-core/main/distro/all"
 	v2internet "github.com/xtls/xray-core/transport/internet"
 
@@ -41,16 +39,36 @@ type V2RayPoint struct {
 	SupportSet   V2RayVPNServiceSupportsSet
 	statsManager v2stats.Manager
 
-	dialer    *ProtectedDialer
-	v2rayOP   sync.Mutex
-	closeChan chan struct{}
+	dialer      *ProtectedDialer
+	v2rayOP     sync.Mutex
+	closeChan   chan struct{}
+	netWatcher  *netlinkWatcher
+	fileWatcher *configWatcher
+	policy      policyState
+	unblock     chan struct{}
+	subs        subscriptionScheduler
+	admission   admissionControl
+	protocols   protocolClassifier
+	smart       smartRouter
+	// balancer overrides of a restored state, waiting for a core that has the balancers
+	pendingOverrides map[string]string
+	// outbound traffic of a restored state, added to the counters of the next core
+	pendingTraffic map[string]*outboundTraffic
 
 	Vpoint    *v2core.Instance
 	IsRunning bool
+	IsBlocked bool
+	config    *coreConfig
+	// configFiles is set while configs come from SetConfigFiles, their merged content
+	// is kept in fileContent and ConfigureFileContent is left to the host
+	configFiles bool
+	fileContent string
 
 	DomainName           string
 	ConfigureFileContent string
 	AsyncResolve         bool
+	// KillSwitch keep the VPN service up and block traffic, instead of shutting down, when the core fails
+	KillSwitch bool
 }
 
 /*V2RayVPNServiceSupportsSet To support Android VPN mode*/
@@ -67,15 +85,25 @@ type V2RayVPNServiceSupportsSet interface {
 func (v *V2RayPoint) RunLoop(prefIPv6 bool) (err error) {
 	v.v2rayOP.Lock()
 	defer v.v2rayOP.Unlock()
+	return v.runLoop(prefIPv6)
+}
+
+// runLoop start the core if not running, v2rayOP must be held
+func (v *V2RayPoint) runLoop(prefIPv6 bool) (err error) {
 	//Construct Context
 
 	if !v.IsRunning {
 		v.closeChan = make(chan struct{})
 		v.dialer.PrepareResolveChan()
-		go func() {
+		resolveCh := v.dialer.ResolveChan()
+		go func(closeCh chan struct{}) {
 			select {
 			// wait until resolved
-			case <-v.dialer.ResolveChan():
+			case <-resolveCh:
+				if !v.dialer.IsVServerReady() && v.KillSwitch {
+					v.blockUnresolved(closeCh)
+					return
+				}
 				// shutdown VPNService if server name can not reolved
 				if !v.dialer.IsVServerReady() {
 					log.Println("vServer cannot resolved, shutdown")
@@ -84,18 +112,18 @@ func (v *V2RayPoint) RunLoop(prefIPv6 bool) (err error) {
 				}
 
 			// stop waiting if manually closed
-			case <-v.closeChan:
+			case <-closeCh:
 			}
-		}()
+		}(v.closeChan)
 
 		if v.AsyncResolve {
 			go func() {
 				v.dialer.PrepareDomain(v.DomainName, v.closeChan, prefIPv6)
-				close(v.dialer.ResolveChan())
+				close(resolveCh)
 			}()
 		} else {
 			v.dialer.PrepareDomain(v.DomainName, v.closeChan, prefIPv6)
-			close(v.dialer.ResolveChan())
+			close(resolveCh)
 		}
 
 		err = v.pointloop()
@@ -108,6 +136,11 @@ func (v *V2RayPoint) RunLoop(prefIPv6 bool) (err error) {
 func (v *V2RayPoint) StopLoop() (err error) {
 	v.v2rayOP.Lock()
 	defer v.v2rayOP.Unlock()
+	return v.stopLoop()
+}
+
+// stopLoop stop the core if running, v2rayOP must be held
+func (v *V2RayPoint) stopLoop() (err error) {
 	if v.IsRunning {
 		close(v.closeChan)
 		v.shutdownInit()
@@ -116,8 +149,136 @@ func (v *V2RayPoint) StopLoop() (err error) {
 	return
 }
 
+/*
+ReloadConfig Replace the running core with a new config, keeping the VPN service up.
+The new config is validated first, an invalid one leaves the old core running.
+An empty domainName keeps the current server.
+*/
+func (v *V2RayPoint) ReloadConfig(content string, domainName string) error {
+	config, err := loadCoreConfig(content)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	v.v2rayOP.Lock()
+	defer v.v2rayOP.Unlock()
+	return v.reloadConfig(config, content, domainName)
+}
+
+// reloadConfig replace the running core with config loaded from content, v2rayOP must be held
+func (v *V2RayPoint) reloadConfig(config *coreConfig, content string, domainName string) error {
+	if !v.IsRunning || v.IsBlocked {
+		v.setConfigContent(content)
+		if len(domainName) > 0 {
+			v.DomainName = domainName
+		}
+		if v.IsBlocked {
+			v.retryUnblock()
+		}
+		return nil
+	}
+
+	log.Println("reloading core config")
+	oldInst, oldConfig := v.Vpoint, v.config
+	oldInst.Close()
+	if err := v.startCore(config); err != nil {
+		// the old config did run, it should run again
+		log.Printf("reload failed, restore old config: %v", err)
+		if v.Vpoint != oldInst {
+			v.Vpoint.Close()
+			v.Vpoint = oldInst
+		}
+		if err := v.startCore(oldConfig); err != nil {
+			if v.Vpoint != oldInst {
+				v.Vpoint.Close()
+			}
+			if v.KillSwitch {
+				v.block(err)
+				return err
+			}
+			close(v.closeChan)
+			v.IsRunning = false
+			v.Vpoint = nil
+			v.statsManager = nil
+			v.config = nil
+			v.SupportSet.OnEmitStatus(0, "Closed")
+			// no core behind the VPN service, shut it down as RunLoop does when
+			// the server is not resolved; hosts stop the point from there, v2rayOP is held
+			go v.SupportSet.Shutdown()
+		}
+		return err
+	}
+
+	v.setConfigContent(content)
+	if len(domainName) > 0 && domainName != v.DomainName {
+		v.DomainName = domainName
+		v.dialer.setServer(domainName)
+		v.dialer.Reset(v.closeChan)
+	}
+	v.SupportSet.OnEmitStatus(0, "Reloaded")
+	return nil
+}
+
+/*
+NetworkChanged Reset protected dialer after the underlying network changed,
+server domain is resolved again and connections on the old network are closed
+*/
+func (v *V2RayPoint) NetworkChanged() {
+	v.v2rayOP.Lock()
+	defer v.v2rayOP.Unlock()
+	v.networkChanged()
+}
+
+// networkChanged is NetworkChanged with v2rayOP held
+func (v *V2RayPoint) networkChanged() {
+	if v.IsBlocked {
+		v.retryUnblock()
+		return
+	}
+	if v.IsRunning {
+		log.Println("network changed, reset dialer")
+		v.dialer.Reset(v.closeChan)
+		if v.KillSwitch {
+			go func(closeCh chan struct{}, resolveCh chan struct{}) {
+				select {
+				case <-resolveCh:
+					if !v.dialer.IsVServerReady() {
+						v.blockUnresolved(closeCh)
+					}
+				case <-closeCh:
+				}
+			}(v.closeChan, v.dialer.ResolveChan())
+		}
+	}
+}
+
+// configContent return the config in use, v2rayOP must be held
+func (v *V2RayPoint) configContent() string {
+	if v.configFiles {
+		return v.fileContent
+	}
+	return v.ConfigureFileContent
+}
+
+// setConfigContent keep content as the config in use, v2rayOP must be held
+func (v *V2RayPoint) setConfigContent(content string) {
+	if v.configFiles {
+		v.fileContent = content
+		return
+	}
+	v.ConfigureFileContent = content
+}
+
+// runningCore return the core instance and its config, both nil if not running
+func (v *V2RayPoint) runningCore() (*v2core.Instance, *coreConfig) {
+	v.v2rayOP.Lock()
+	defer v.v2rayOP.Unlock()
+	return v.Vpoint, v.config
+}
+
 // Delegate Funcation
-func (v V2RayPoint) QueryStats(tag string, direct string) int64 {
+func (v *V2RayPoint) QueryStats(tag string, direct string) int64 {
 	if v.statsManager == nil {
 		return 0
 	}
@@ -130,26 +291,56 @@ func (v V2RayPoint) QueryStats(tag string, direct string) int64 {
 
 func (v *V2RayPoint) shutdownInit() {
 	v.IsRunning = false
+	v.IsBlocked = false
+	v.unblock = nil
 	v.Vpoint.Close()
 	v.Vpoint = nil
 	v.statsManager = nil
+	v.config = nil
 }
 
 func (v *V2RayPoint) pointloop() error {
 	log.Println("loading core config")
-	config, err := v2serial.LoadJSONConfig(strings.NewReader(v.ConfigureFileContent))
+	config, err := loadCoreConfig(v.configContent())
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
+	if err := v.startCore(config); err != nil {
+		if !v.KillSwitch {
+			return err
+		}
+		if v.Vpoint != nil {
+			v.Vpoint.Close()
+		}
+		if err := v.block(err); err != nil {
+			return err
+		}
+		v.SupportSet.Prepare()
+		v.SupportSet.Setup("")
+		return nil
+	}
+
+	v.SupportSet.Prepare()
+	v.SupportSet.Setup("")
+	v.SupportSet.OnEmitStatus(0, "Running")
+	return nil
+}
+
+func (v *V2RayPoint) startCore(config *coreConfig) error {
 	log.Println("new core")
-	v.Vpoint, err = v2core.New(config)
+	v.protocols.setConfig(config.json)
+	v.smart.setConfig(config.json)
+	config.removeStaleSockets()
+	inst, err := config.newInstance(&v.protocols, &v.smart, &v.admission)
 	if err != nil {
-		v.Vpoint = nil
 		log.Println(err)
 		return err
 	}
+	v.smart.init(inst)
+	v.Vpoint = inst
+	v.config = config
 	v.statsManager = v.Vpoint.GetFeature(v2stats.ManagerType()).(v2stats.Manager)
 
 	log.Println("start core")
@@ -159,10 +350,8 @@ func (v *V2RayPoint) pointloop() error {
 		log.Println(err)
 		return err
 	}
-
-	v.SupportSet.Prepare()
-	v.SupportSet.Setup("")
-	v.SupportSet.OnEmitStatus(0, "Running")
+	v.applyBalancerOverrides()
+	v.applyOutboundTraffic()
 	return nil
 }
 
@@ -203,18 +392,18 @@ func InitV2Env(envPath string, key string) {
 }
 
 func MeasureOutboundDelay(ConfigureFileContent string, url string) (int64, error) {
-	config, err := v2serial.LoadJSONConfig(strings.NewReader(ConfigureFileContent))
+	config, err := loadCoreConfig(ConfigureFileContent)
 	if err != nil {
 		return -1, err
 	}
 
 	// dont listen to anything for test purpose
-	config.Inbound = nil
+	config.core.Inbound = nil
 	// config.App: (fakedns), log, dispatcher, InboundConfig, OutboundConfig, (stats), router, dns, (policy)
 	// keep only basic features
-	config.App = config.App[:5]
+	config.core.App = config.core.App[:5]
 
-	inst, err := v2core.New(config)
+	inst, err := config.newInstance()
 	if err != nil {
 		return -1, err
 	}
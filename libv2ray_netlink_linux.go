@@ -0,0 +1,178 @@
+package libv2ray
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// events within this period are reported as one network change
+const netlinkDebounce = 2 * time.Second
+
+type netlinkWatcher struct {
+	fd       int
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+/*
+StartNetworkWatcher Watch netlink route, link and address events,
+and call NetworkChanged after they settle down.
+For hosts that have nobody to report network changes, Android apps should
+call NetworkChanged from ConnectivityManager callbacks instead.
+*/
+func (v *V2RayPoint) StartNetworkWatcher() error {
+	v.v2rayOP.Lock()
+	defer v.v2rayOP.Unlock()
+	if v.netWatcher != nil {
+		return nil
+	}
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK |
+			unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR |
+			unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE,
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	// wake up from time to time to check if stopped
+	tv := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	w := &netlinkWatcher{fd: fd, done: make(chan struct{})}
+	v.netWatcher = w
+	go func() {
+		w.run(func() { v.watchedNetworkChanged(w) })
+		v.watcherStopped(w)
+	}()
+	log.Println("network watcher started")
+	return nil
+}
+
+/*StopNetworkWatcher Stop watching netlink events
+ */
+func (v *V2RayPoint) StopNetworkWatcher() {
+	v.v2rayOP.Lock()
+	defer v.v2rayOP.Unlock()
+	if v.netWatcher != nil {
+		v.netWatcher.stop()
+		v.netWatcher = nil
+	}
+}
+
+// watchedNetworkChanged report a change seen by w, unless w was stopped meanwhile,
+// which is checked under v2rayOP as StopNetworkWatcher stops it holding the lock
+func (v *V2RayPoint) watchedNetworkChanged(w *netlinkWatcher) {
+	v.v2rayOP.Lock()
+	defer v.v2rayOP.Unlock()
+	if v.netWatcher != w {
+		return
+	}
+	v.networkChanged()
+}
+
+// watcherStopped forget w once it is not watching any more, so that a new one can start
+func (v *V2RayPoint) watcherStopped(w *netlinkWatcher) {
+	v.v2rayOP.Lock()
+	defer v.v2rayOP.Unlock()
+	if v.netWatcher == w {
+		v.netWatcher = nil
+	}
+}
+
+func (w *netlinkWatcher) stop() {
+	w.stopOnce.Do(func() { close(w.done) })
+}
+
+func (w *netlinkWatcher) run(changed func()) {
+	defer unix.Close(w.fd)
+	// stop debouncing when returning on errors
+	defer w.stop()
+
+	// a timer firing while the watcher is stopped must not report the change
+	fire := func() {
+		select {
+		case <-w.done:
+		default:
+			changed()
+		}
+	}
+	events := make(chan struct{}, 1)
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case <-w.done:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			case <-events:
+				if timer == nil {
+					timer = time.AfterFunc(netlinkDebounce, fire)
+				} else {
+					timer.Reset(netlinkDebounce)
+				}
+			}
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		select {
+		case <-w.done:
+			log.Println("network watcher stopped")
+			return
+		default:
+		}
+
+		n, _, err := unix.Recvfrom(w.fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				continue
+			}
+			// ENOBUFS means events were dropped, still a change anyway
+			if !errors.Is(err, unix.ENOBUFS) {
+				log.Printf("network watcher err: %v", err)
+				return
+			}
+		} else if !isNetworkChange(buf[:n]) {
+			continue
+		}
+
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func isNetworkChange(b []byte) bool {
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return false
+	}
+	for _, m := range msgs {
+		switch m.Header.Type {
+		case unix.RTM_NEWLINK, unix.RTM_DELLINK,
+			unix.RTM_NEWADDR, unix.RTM_DELADDR,
+			unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package libv2ray
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNetworkWatcherRestart(t *testing.T) {
+	v := &V2RayPoint{}
+	if err := v.StartNetworkWatcher(); err != nil {
+		t.Skipf("netlink not available: %v", err)
+	}
+	defer v.StopNetworkWatcher()
+	v.v2rayOP.Lock()
+	w := v.netWatcher
+	v.v2rayOP.Unlock()
+
+	// put something that is not a socket under the watcher, it fails to receive and stops
+	null, err := unix.Open("/dev/null", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(null)
+	if err := unix.Dup2(null, w.fd); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		v.v2rayOP.Lock()
+		stopped := v.netWatcher == nil
+		v.v2rayOP.Unlock()
+		if stopped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watcher still set after it stopped")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case <-w.done:
+	default:
+		t.Error("debouncing not stopped")
+	}
+
+	if err := v.StartNetworkWatcher(); err != nil {
+		t.Fatal(err)
+	}
+	v.v2rayOP.Lock()
+	restarted := v.netWatcher
+	v.v2rayOP.Unlock()
+	if restarted == nil || restarted == w {
+		t.Error("watcher not started again")
+	}
+}
+
+func TestNetworkWatcherStopped(t *testing.T) {
+	v := &V2RayPoint{IsBlocked: true, unblock: make(chan struct{}, 1)}
+	w := &netlinkWatcher{done: make(chan struct{})}
+	v.netWatcher = w
+
+	// a change that settled down after StopNetworkWatcher returned is dropped
+	v.StopNetworkWatcher()
+	v.watchedNetworkChanged(w)
+	if len(v.unblock) != 0 {
+		t.Error("change reported by a stopped watcher")
+	}
+
+	w = &netlinkWatcher{done: make(chan struct{})}
+	v.netWatcher = w
+	v.watchedNetworkChanged(w)
+	if len(v.unblock) != 1 {
+		t.Error("change not reported")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package libv2ray
+
+import "errors"
+
+type netlinkWatcher struct{}
+
+/*StartNetworkWatcher Netlink is only available on Linux
+ */
+func (v *V2RayPoint) StartNetworkWatcher() error {
+	return errors.New("network watcher not supported on this platform")
+}
+
+/*StopNetworkWatcher Stop watching netlink events
+ */
+func (v *V2RayPoint) StopNetworkWatcher() {
+}
@@ -0,0 +1,125 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+
+	v2observatory "github.com/xtls/xray-core/app/observatory"
+	"github.com/xtls/xray-core/features/extension"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/features/routing"
+)
+
+type outboundHealth struct {
+	Tag          string `json:"tag"`
+	Alive        bool   `json:"alive"`
+	Delay        int64  `json:"delay"`
+	LastError    string `json:"lastError,omitempty"`
+	LastSeenTime int64  `json:"lastSeenTime,omitempty"`
+	LastTryTime  int64  `json:"lastTryTime,omitempty"`
+}
+
+type balancerStatus struct {
+	Tag        string   `json:"tag"`
+	Strategy   string   `json:"strategy"`
+	Candidates []string `json:"candidates"`
+	Override   string   `json:"override,omitempty"`
+	Principle  []string `json:"principle,omitempty"`
+	Selected   string   `json:"selected,omitempty"`
+}
+
+type observatoryStatus struct {
+	Outbounds []*outboundHealth `json:"outbounds"`
+	Balancers []*balancerStatus `json:"balancers"`
+}
+
+/*
+GetObservatoryStatus return observatory results and balancer selections as JSON,
+empty string if core is not running.
+*/
+func (v *V2RayPoint) GetObservatoryStatus() string {
+	inst, config := v.runningCore()
+	if inst == nil || config == nil {
+		return ""
+	}
+
+	status := &observatoryStatus{
+		Outbounds: make([]*outboundHealth, 0),
+		Balancers: make([]*balancerStatus, 0),
+	}
+
+	if obs, ok := inst.GetFeature(extension.ObservatoryType()).(extension.Observatory); ok {
+		msg, err := obs.GetObservation(context.Background())
+		if err != nil {
+			log.Printf("GetObservation err: %v", err)
+		} else if result, ok := msg.(*v2observatory.ObservationResult); ok {
+			for _, s := range result.Status {
+				status.Outbounds = append(status.Outbounds, &outboundHealth{
+					Tag:          s.OutboundTag,
+					Alive:        s.Alive,
+					Delay:        s.Delay,
+					LastError:    s.LastErrorReason,
+					LastSeenTime: s.LastSeenTime,
+					LastTryTime:  s.LastTryTime,
+				})
+			}
+		}
+	}
+
+	if config.json.RouterConfig != nil {
+		router, _ := inst.GetFeature(routing.RouterType()).(routing.Router)
+		hs, _ := inst.GetFeature(outbound.ManagerType()).(outbound.HandlerSelector)
+		for _, b := range config.json.RouterConfig.Balancers {
+			bs := &balancerStatus{
+				Tag:        b.Tag,
+				Strategy:   b.Strategy.Type,
+				Candidates: make([]string, 0),
+			}
+			if hs != nil {
+				bs.Candidates = hs.Select(b.Selectors)
+			}
+			if bo, ok := router.(routing.BalancerOverrider); ok {
+				bs.Override, _ = bo.GetOverrideTarget(b.Tag)
+			}
+			// only leastPing and leastLoad rank their principle targets, random and roundRobin
+			// give all candidates and pick a different one for each connection
+			ranked := strings.EqualFold(bs.Strategy, "leastPing") || strings.EqualFold(bs.Strategy, "leastLoad")
+			if pt, ok := router.(routing.BalancerPrincipleTarget); ok && ranked {
+				targets, _ := pt.GetPrincipleTarget(b.Tag)
+				for _, t := range targets {
+					if len(t) > 0 {
+						bs.Principle = append(bs.Principle, t)
+					}
+				}
+			}
+			if len(bs.Override) > 0 {
+				bs.Selected = bs.Override
+			} else if len(bs.Principle) > 0 {
+				bs.Selected = bs.Principle[0]
+			}
+			status.Balancers = append(status.Balancers, bs)
+		}
+	}
+
+	for _, h := range config.outbounds {
+		b, ok := h.(*libBalancer)
+		if !ok {
+			continue
+		}
+		// strategies of this library pick per connection, nothing selected in advance
+		status.Balancers = append(status.Balancers, &balancerStatus{
+			Tag:        b.tag,
+			Strategy:   b.strategyTyp,
+			Candidates: b.Candidates(),
+		})
+	}
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return string(b)
+}
@@ -0,0 +1,116 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	v2observatory "github.com/xtls/xray-core/app/observatory"
+	"github.com/xtls/xray-core/features/extension"
+	"github.com/xtls/xray-core/features/routing"
+	"google.golang.org/protobuf/proto"
+)
+
+func startObservatoryCore(t *testing.T, observatory string) *V2RayPoint {
+	t.Helper()
+	config, err := loadCoreConfig(fmt.Sprintf(`{
+		"outbounds": [
+			{"tag": "proxy-a", "protocol": "freedom"},
+			{"tag": "proxy-b", "protocol": "freedom"}
+		],
+		%s
+		"routing": {"balancers": [
+			{"tag": "random", "selector": ["proxy"], "strategy": {"type": "random"}},
+			{"tag": "sticky", "selector": ["proxy"], "strategy": {"type": "sticky"}}
+		]}
+	}`, observatory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := config.newInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { inst.Close() })
+	return &V2RayPoint{Vpoint: inst, config: config}
+}
+
+func decodeObservatoryStatus(t *testing.T, v *V2RayPoint) *observatoryStatus {
+	t.Helper()
+	var status observatoryStatus
+	if err := json.Unmarshal([]byte(v.GetObservatoryStatus()), &status); err != nil {
+		t.Fatalf("%s %v", v.GetObservatoryStatus(), err)
+	}
+	return &status
+}
+
+func TestGetObservatoryStatus(t *testing.T) {
+	if status := (&V2RayPoint{}).GetObservatoryStatus(); status != "" {
+		t.Errorf("status %q while not running", status)
+	}
+
+	v := startObservatoryCore(t, "")
+	if s := v.GetObservatoryStatus(); s[:15] != `{"outbounds":[]` {
+		t.Errorf("outbounds not an empty list: %s", s)
+	}
+	status := decodeObservatoryStatus(t, v)
+	if len(status.Balancers) != 2 {
+		t.Fatalf("%+v", status.Balancers)
+	}
+	random, sticky := status.Balancers[0], status.Balancers[1]
+	if random.Tag != "random" || len(random.Candidates) != 2 || len(random.Selected) > 0 {
+		t.Errorf("random %+v", random)
+	}
+	if sticky.Tag != "sticky" || sticky.Strategy != "sticky" || len(sticky.Candidates) != 2 {
+		t.Errorf("sticky %+v", sticky)
+	}
+
+	// an override is what the balancer selects
+	router := v.Vpoint.GetFeature(routing.RouterType()).(routing.BalancerOverrider)
+	if err := router.SetOverrideTarget("random", "proxy-b"); err != nil {
+		t.Fatal(err)
+	}
+	if random := decodeObservatoryStatus(t, v).Balancers[0]; random.Override != "proxy-b" || random.Selected != "proxy-b" {
+		t.Errorf("overridden %+v", random)
+	}
+}
+
+// fakeObservatory give a fixed observation
+type fakeObservatory struct {
+	result *v2observatory.ObservationResult
+}
+
+func (o *fakeObservatory) Type() interface{} { return extension.ObservatoryType() }
+func (o *fakeObservatory) Start() error      { return nil }
+func (o *fakeObservatory) Close() error      { return nil }
+func (o *fakeObservatory) GetObservation(ctx context.Context) (proto.Message, error) {
+	return o.result, nil
+}
+
+func TestGetObservatoryStatusObserved(t *testing.T) {
+	v := startObservatoryCore(t, "")
+	v.Vpoint.AddFeature(&fakeObservatory{result: &v2observatory.ObservationResult{
+		Status: []*v2observatory.OutboundStatus{
+			{OutboundTag: "proxy-a", Alive: true, Delay: 120, LastSeenTime: 1700000000, LastTryTime: 1700000000},
+			{OutboundTag: "proxy-b", Alive: false, Delay: 99999999, LastErrorReason: "timeout", LastTryTime: 1700000000},
+		},
+	}})
+
+	status := decodeObservatoryStatus(t, v)
+	if len(status.Outbounds) != 2 {
+		t.Fatalf("%s", v.GetObservatoryStatus())
+	}
+	if a := status.Outbounds[0]; a.Tag != "proxy-a" || !a.Alive || a.Delay != 120 || a.LastSeenTime == 0 || len(a.LastError) > 0 {
+		t.Errorf("proxy-a %+v", a)
+	}
+	if b := status.Outbounds[1]; b.Tag != "proxy-b" || b.Alive || b.LastError != "timeout" || b.LastSeenTime != 0 {
+		t.Errorf("proxy-b %+v", b)
+	}
+	if len(status.Balancers) != 2 {
+		t.Errorf("%+v", status.Balancers)
+	}
+}
@@ -0,0 +1,259 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+type networkFacts struct {
+	Type     string `json:"type"`
+	SSIDHash string `json:"ssidHash,omitempty"`
+	Metered  bool   `json:"metered"`
+	IPv6     bool   `json:"ipv6"`
+}
+
+type networkMatch struct {
+	Type     []string `json:"type"`
+	SSIDHash []string `json:"ssidHash"`
+	Metered  *bool    `json:"metered"`
+	IPv6     *bool    `json:"ipv6"`
+}
+
+// networkPolicy is applied when its match fits the reported network.
+// action "stop" stops the core, "run" runs Config (or the config at the time policies are set)
+// on DomainName, with mux switched on or off if Mux is set.
+type networkPolicy struct {
+	Name       string       `json:"name"`
+	Match      networkMatch `json:"match"`
+	Action     string       `json:"action"`
+	Config     string       `json:"config"`
+	DomainName string       `json:"domainName"`
+	Mux        *bool        `json:"mux"`
+}
+
+type policyState struct {
+	sync.Mutex
+	policies   []*networkPolicy
+	base       string
+	baseDomain string
+	facts      *networkFacts
+	fired      string
+}
+
+func (m *networkMatch) matches(f *networkFacts) bool {
+	if len(m.Type) > 0 && !containsFold(m.Type, f.Type) {
+		return false
+	}
+	if len(m.SSIDHash) > 0 && !containsFold(m.SSIDHash, f.SSIDHash) {
+		return false
+	}
+	if m.Metered != nil && *m.Metered != f.Metered {
+		return false
+	}
+	if m.IPv6 != nil && *m.IPv6 != f.IPv6 {
+		return false
+	}
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+SetNetworkPolicies set policies applied on ReportNetwork, as a JSON array, first match wins.
+The current config and domain are used by policies that do not bring their own.
+*/
+func (v *V2RayPoint) SetNetworkPolicies(policiesJSON string) error {
+	var policies []*networkPolicy
+	if len(strings.TrimSpace(policiesJSON)) > 0 {
+		if err := json.Unmarshal([]byte(policiesJSON), &policies); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for _, p := range policies {
+		// the name tells which policy fired last, an empty or repeated one would hide it
+		if len(p.Name) == 0 {
+			return errors.New("policy without name")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("policy %q: duplicate name", p.Name)
+		}
+		names[p.Name] = true
+		switch p.Action {
+		case "stop", "run":
+		default:
+			return fmt.Errorf("policy %q: unknown action %q", p.Name, p.Action)
+		}
+	}
+
+	v.v2rayOP.Lock()
+	base, baseDomain := v.configContent(), v.DomainName
+	v.v2rayOP.Unlock()
+
+	v.policy.Lock()
+	v.policy.policies = policies
+	v.policy.base = base
+	v.policy.baseDomain = baseDomain
+	v.policy.fired = ""
+	facts := v.policy.facts
+	v.policy.Unlock()
+
+	if facts != nil {
+		return v.applyNetworkPolicy(facts)
+	}
+	return nil
+}
+
+/*
+ReportNetwork Report facts of the current network and apply the first matching policy.
+networkType is free form as in policies, e.g. wifi, cellular, ethernet, none.
+*/
+func (v *V2RayPoint) ReportNetwork(networkType string, ssidHash string, metered bool, ipv6 bool) error {
+	facts := &networkFacts{
+		Type:     strings.ToLower(networkType),
+		SSIDHash: ssidHash,
+		Metered:  metered,
+		IPv6:     ipv6,
+	}
+	v.policy.Lock()
+	v.policy.facts = facts
+	v.policy.Unlock()
+	return v.applyNetworkPolicy(facts)
+}
+
+// applyNetworkPolicy pick the policy under the policy lock, the core is started or stopped
+// outside of it, callbacks of the host may report the network again
+func (v *V2RayPoint) applyNetworkPolicy(facts *networkFacts) error {
+	v.policy.Lock()
+	var p *networkPolicy
+	for _, candidate := range v.policy.policies {
+		if candidate.Match.matches(facts) {
+			p = candidate
+			break
+		}
+	}
+	// a network no policy matches lets the last policy fire again later
+	if p == nil {
+		v.policy.fired = ""
+		v.policy.Unlock()
+		return nil
+	}
+	// nothing changes if the same policy fires again
+	if p.Name == v.policy.fired {
+		v.policy.Unlock()
+		return nil
+	}
+	v.policy.fired = p.Name
+	base, baseDomain := v.policy.base, v.policy.baseDomain
+	v.policy.Unlock()
+
+	f, _ := json.Marshal(facts)
+	log.Printf("policy %s fired on %s", p.Name, f)
+	if err := v.runNetworkPolicy(p, base, baseDomain); err != nil {
+		// a policy that failed fires again on the next report
+		v.policy.Lock()
+		if v.policy.fired == p.Name {
+			v.policy.fired = ""
+		}
+		v.policy.Unlock()
+		return err
+	}
+	v.SupportSet.OnEmitStatus(0, fmt.Sprintf("Policy %s: %s on %s", p.Name, p.Action, f))
+	return nil
+}
+
+// runNetworkPolicy stop the core or run it with the config of the policy
+func (v *V2RayPoint) runNetworkPolicy(p *networkPolicy, base string, baseDomain string) error {
+	if p.Action == "stop" {
+		v.v2rayOP.Lock()
+		defer v.v2rayOP.Unlock()
+		return v.stopLoop()
+	}
+
+	content, domain := p.Config, p.DomainName
+	if len(content) == 0 {
+		content = base
+	}
+	if len(domain) == 0 {
+		domain = baseDomain
+	}
+	if p.Mux != nil {
+		var err error
+		if content, err = setConfigMux(content, *p.Mux); err != nil {
+			return err
+		}
+	}
+
+	config, err := loadCoreConfig(content)
+	if err != nil {
+		return err
+	}
+
+	// running is checked and changed in one go, StopLoop and RunLoop may come in between otherwise
+	v.v2rayOP.Lock()
+	defer v.v2rayOP.Unlock()
+	if v.IsRunning {
+		return v.reloadConfig(config, content, domain)
+	}
+	v.setConfigContent(content)
+	v.DomainName = domain
+	return v.runLoop(v.dialer.prefersIPv6())
+}
+
+// setConfigMux switch mux of proxy outbounds, vless with flow can not mux and is left alone
+func setConfigMux(content string, enabled bool) (string, error) {
+	m, err := decodeConfigMap(content)
+	if err != nil {
+		return "", err
+	}
+
+	for _, ob := range configOutbounds(m) {
+		switch ob["protocol"] {
+		case "vmess", "trojan", "shadowsocks":
+		case "vless":
+			if vlessHasFlow(ob) {
+				continue
+			}
+		default:
+			continue
+		}
+		mux, _ := ob["mux"].(map[string]interface{})
+		if mux == nil {
+			mux = map[string]interface{}{"concurrency": 8}
+		}
+		mux["enabled"] = enabled
+		ob["mux"] = mux
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func vlessHasFlow(ob map[string]interface{}) bool {
+	settings, _ := ob["settings"].(map[string]interface{})
+	vnext, _ := settings["vnext"].([]interface{})
+	for _, server := range vnext {
+		s, _ := server.(map[string]interface{})
+		users, _ := s["users"].([]interface{})
+		for _, user := range users {
+			if u, ok := user.(map[string]interface{}); ok && u["flow"] != nil && u["flow"] != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package libv2ray
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSupportSet keep the statuses emitted by the core
+type recordingSupportSet struct {
+	fakeSupportSet
+	mu       sync.Mutex
+	statuses []string
+	// called with each status, as hosts do from their callbacks
+	onStatus func(status string)
+}
+
+func (s *recordingSupportSet) Setup(string) int { return 0 }
+func (s *recordingSupportSet) Prepare() int     { return 0 }
+func (s *recordingSupportSet) Shutdown() int    { return 0 }
+func (s *recordingSupportSet) OnEmitStatus(_ int, status string) int {
+	s.mu.Lock()
+	s.statuses = append(s.statuses, status)
+	s.mu.Unlock()
+	if s.onStatus != nil {
+		s.onStatus(status)
+	}
+	return 0
+}
+
+// take return the statuses emitted since the last call
+func (s *recordingSupportSet) take() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := s.statuses
+	s.statuses = nil
+	return statuses
+}
+
+const testLocalConfig = `{"outbounds": [{"protocol": "freedom"}]}`
+
+func newTestPoint(support *recordingSupportSet) *V2RayPoint {
+	return &V2RayPoint{
+		SupportSet:           support,
+		dialer:               NewPreotectedDialer(support),
+		DomainName:           "127.0.0.1:443",
+		ConfigureFileContent: testLocalConfig,
+	}
+}
+
+func TestNetworkMatch(t *testing.T) {
+	yes, no := true, false
+	wifi := &networkFacts{Type: "wifi", SSIDHash: "home", Metered: false, IPv6: true}
+	cellular := &networkFacts{Type: "cellular", Metered: true}
+
+	tests := []struct {
+		name  string
+		match networkMatch
+		facts *networkFacts
+		want  bool
+	}{
+		{"empty matches all", networkMatch{}, cellular, true},
+		{"type", networkMatch{Type: []string{"ethernet", "WIFI"}}, wifi, true},
+		{"other type", networkMatch{Type: []string{"wifi"}}, cellular, false},
+		{"ssid", networkMatch{SSIDHash: []string{"office", "home"}}, wifi, true},
+		{"other ssid", networkMatch{SSIDHash: []string{"office"}}, wifi, false},
+		{"no ssid", networkMatch{SSIDHash: []string{"home"}}, cellular, false},
+		{"metered", networkMatch{Metered: &yes}, cellular, true},
+		{"not metered", networkMatch{Metered: &no}, cellular, false},
+		{"ipv6", networkMatch{IPv6: &yes}, wifi, true},
+		{"no ipv6", networkMatch{IPv6: &yes}, cellular, false},
+		{"all fields", networkMatch{Type: []string{"wifi"}, SSIDHash: []string{"home"}, Metered: &no, IPv6: &yes}, wifi, true},
+		{"one field off", networkMatch{Type: []string{"wifi"}, SSIDHash: []string{"home"}, Metered: &yes}, wifi, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.match.matches(tt.facts); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetConfigMux(t *testing.T) {
+	tests := []struct {
+		name     string
+		outbound string
+		enabled  bool
+		want     string
+	}{
+		{"vmess switched on", `{"protocol": "vmess"}`, true,
+			`{"mux":{"concurrency":8,"enabled":true},"protocol":"vmess"}`},
+		{"trojan switched off", `{"protocol": "trojan", "mux": {"enabled": true, "concurrency": 4}}`, false,
+			`{"mux":{"concurrency":4,"enabled":false},"protocol":"trojan"}`},
+		{"shadowsocks keeps settings", `{"protocol": "shadowsocks", "mux": {"concurrency": 2, "xudpConcurrency": 16}}`, true,
+			`{"mux":{"concurrency":2,"enabled":true,"xudpConcurrency":16},"protocol":"shadowsocks"}`},
+		{"vless without flow", `{"protocol": "vless", "settings": {"vnext": [{"users": [{"id": "a"}]}]}}`, true,
+			`{"mux":{"concurrency":8,"enabled":true},"protocol":"vless","settings":{"vnext":[{"users":[{"id":"a"}]}]}}`},
+		{"vless with flow", `{"protocol": "vless", "settings": {"vnext": [{"users": [{"id": "a", "flow": "xtls-rprx-vision"}]}]}}`, true,
+			`{"protocol":"vless","settings":{"vnext":[{"users":[{"flow":"xtls-rprx-vision","id":"a"}]}]}}`},
+		{"freedom", `{"protocol": "freedom"}`, true, `{"protocol":"freedom"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := setConfigMux(`{"outbounds": [`+tt.outbound+`]}`, tt.enabled)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := `{"outbounds":[` + tt.want + `]}`; got != want {
+				t.Errorf("got %s\nwant %s", got, want)
+			}
+		})
+	}
+
+	if _, err := setConfigMux(`{"outbounds": [`, true); err == nil {
+		t.Error("expect error for broken config")
+	}
+}
+
+func TestSetNetworkPoliciesInvalid(t *testing.T) {
+	v := newTestPoint(&recordingSupportSet{})
+	for _, policies := range []string{
+		`[{"action": "stop"}]`,
+		`[{"name": "a", "action": "stop"}, {"name": "a", "action": "run"}]`,
+		`[{"name": "a", "action": "pause"}]`,
+	} {
+		if err := v.SetNetworkPolicies(policies); err == nil {
+			t.Errorf("expect error for %s", policies)
+		}
+	}
+}
+
+func TestNetworkPolicyTransitions(t *testing.T) {
+	support := &recordingSupportSet{}
+	v := newTestPoint(support)
+	if err := v.SetNetworkPolicies(`[
+		{"name": "home", "match": {"ssidHash": ["home"]}, "action": "stop"},
+		{"name": "cellular", "match": {"type": ["cellular"]}, "action": "run"}
+	]`); err != nil {
+		t.Fatal(err)
+	}
+	defer v.StopLoop()
+
+	report := func(networkType string, ssidHash string, wantRunning bool, wantFired string) {
+		t.Helper()
+		if err := v.ReportNetwork(networkType, ssidHash, false, false); err != nil {
+			t.Fatal(err)
+		}
+		if v.IsRunning != wantRunning {
+			t.Errorf("%s %s: running %v", networkType, ssidHash, v.IsRunning)
+		}
+		fired := ""
+		for _, status := range support.take() {
+			if strings.HasPrefix(status, "Policy ") {
+				fired = strings.SplitN(strings.TrimPrefix(status, "Policy "), ":", 2)[0]
+			}
+		}
+		if fired != wantFired {
+			t.Errorf("%s %s: fired %q, want %q", networkType, ssidHash, fired, wantFired)
+		}
+	}
+
+	report("cellular", "", true, "cellular")
+	// the same policy does not fire twice in a row
+	report("cellular", "", true, "")
+	report("wifi", "home", false, "home")
+	report("wifi", "home", false, "")
+
+	// started by hand on a network no policy is about, stopped again once back home
+	report("wifi", "cafe", false, "")
+	if err := v.RunLoop(false); err != nil {
+		t.Fatal(err)
+	}
+	report("wifi", "home", false, "home")
+
+	// new policies apply to the current network right away
+	if err := v.SetNetworkPolicies(`[{"name": "any", "action": "run"}]`); err != nil {
+		t.Fatal(err)
+	}
+	if !v.IsRunning {
+		t.Error("policy set on the current network did not run")
+	}
+}
+
+func TestNetworkPolicyReentrant(t *testing.T) {
+	support := &recordingSupportSet{}
+	v := newTestPoint(support)
+	if err := v.SetNetworkPolicies(`[{"name": "any", "action": "run"}]`); err != nil {
+		t.Fatal(err)
+	}
+	defer v.StopLoop()
+
+	// the host reports the network again while the policy starts the core
+	reported := make(chan error, 2)
+	support.onStatus = func(status string) {
+		if status == "Running" {
+			reported <- v.ReportNetwork("wifi", "", false, false)
+		}
+	}
+	done := make(chan error)
+	go func() { done <- v.ReportNetwork("wifi", "", false, false) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock reporting from a callback")
+	}
+	if err := <-reported; err != nil {
+		t.Error(err)
+	}
+}
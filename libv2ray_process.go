@@ -0,0 +1,88 @@
+package libv2ray
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/xtls/xray-core/features/routing"
+)
+
+// processInfo is the local owner of a connection
+type processInfo struct {
+	UID  int
+	PID  int
+	Name string
+}
+
+// processCondition match the local process owning the connection,
+// by uid or by process name, which is the executable base name
+type processCondition struct {
+	uids     map[int]bool
+	names    map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// newProcessCondition build the condition of "process" and "uid" expression fields
+func newProcessCondition(field, op string, values []string) (*processCondition, error) {
+	c := &processCondition{}
+	switch {
+	case field == "uid" && op == "matches":
+		return nil, fmt.Errorf("uid can not be matched by pattern")
+	case field == "uid":
+		c.uids = make(map[int]bool)
+		for _, value := range values {
+			uid, err := strconv.Atoi(value)
+			if err != nil || uid < 0 {
+				return nil, fmt.Errorf("invalid uid %q", value)
+			}
+			c.uids[uid] = true
+		}
+	case op == "matches":
+		for _, value := range values {
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, err
+			}
+			c.patterns = append(c.patterns, re)
+		}
+	default:
+		c.names = make(map[string]bool)
+		for _, value := range values {
+			c.names[value] = true
+		}
+	}
+	return c, nil
+}
+
+// Apply implements router.Condition, connections of unknown owner never match
+func (c *processCondition) Apply(ctx routing.Context) bool {
+	ips := ctx.GetSourceIPs()
+	if len(ips) == 0 || ctx.GetSourcePort() == 0 {
+		return false
+	}
+	network := strings.ToLower(ctx.GetNetwork().SystemString())
+	if network != "tcp" && network != "udp" {
+		return false
+	}
+	owner, err := socketOwner(network, ips[0], uint16(ctx.GetSourcePort()), c.uids == nil)
+	if err != nil {
+		return false
+	}
+	if c.uids != nil {
+		return c.uids[owner.UID]
+	}
+	if len(owner.Name) == 0 {
+		return false
+	}
+	if c.names[owner.Name] {
+		return true
+	}
+	for _, re := range c.patterns {
+		if re.MatchString(owner.Name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package libv2ray
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// processes found in /proc are trusted that long, rules matching the same
+// connection one after another scan for it once
+const ownerCacheTTL = 2 * time.Second
+
+type cachedProcess struct {
+	pid     int
+	name    string
+	expires time.Time
+}
+
+// ownerCache keep processes by socket inode. Sockets are not kept by local address,
+// which the next connection may take right after, their inode is read every time:
+// socket inodes come from a counter, a cached one is not another socket so soon.
+type ownerCache struct {
+	sync.Mutex
+	processes map[string]*cachedProcess
+	swept     time.Time
+
+	// lookups that went to /proc
+	socketReads  int
+	processScans int
+}
+
+var owners ownerCache
+
+/*
+socketOwner find the local process owning the socket bound to ip:port,
+through /proc/net/{tcp,udp}{,6} and the fds in /proc/<pid>.
+The process is only looked for when withProcess, the uid comes for free.
+Without root only fds of processes of our own uid can be read, sockets of
+other users get their uid and no process, so process rules never match them.
+*/
+func socketOwner(network string, ip net.IP, port uint16, withProcess bool) (*processInfo, error) {
+	now := time.Now()
+	uid, inode, err := lookupSocket(network, ip, port)
+	if err != nil {
+		return nil, err
+	}
+	owners.Lock()
+	owners.socketReads++
+	owners.Unlock()
+	if len(inode) == 0 {
+		return nil, fmt.Errorf("no local socket %s:%s:%d", network, ip, port)
+	}
+
+	info := &processInfo{UID: uid, PID: -1}
+	if withProcess && inode != "0" {
+		info.PID, info.Name = owners.process(uid, inode, now)
+	}
+	return info, nil
+}
+
+// lookupSocket return uid and inode of the socket bound to ip:port, empty inode if none
+func lookupSocket(network string, ip net.IP, port uint16) (int, string, error) {
+	for _, file := range []string{network, network + "6"} {
+		uid, inode, err := findSocket("/proc/net/"+file, ip, port)
+		if err != nil || len(inode) > 0 {
+			return uid, inode, err
+		}
+	}
+	return -1, "", nil
+}
+
+// sweep drop what expired, the lock must be held
+func (c *ownerCache) sweep(now time.Time) {
+	if c.processes == nil {
+		c.processes = make(map[string]*cachedProcess)
+	}
+	if now.Sub(c.swept) < ownerCacheTTL {
+		return
+	}
+	c.swept = now
+	for inode, p := range c.processes {
+		if now.After(p.expires) {
+			delete(c.processes, inode)
+		}
+	}
+}
+
+// process return pid and name of the process having socket inode open,
+// a miss scans processes of uid once for all their sockets
+func (c *ownerCache) process(uid int, inode string, now time.Time) (int, string) {
+	c.Lock()
+	defer c.Unlock()
+	c.sweep(now)
+	if p := c.processes[inode]; p != nil {
+		return p.pid, p.name
+	}
+
+	c.processScans++
+	expires := now.Add(ownerCacheTTL)
+	for found, p := range scanProcesses(uid) {
+		p.expires = expires
+		c.processes[found] = p
+	}
+	p := c.processes[inode]
+	if p == nil {
+		// not found is kept as well, other rules need not scan again
+		p = &cachedProcess{pid: -1, expires: expires}
+		c.processes[inode] = p
+	}
+	return p.pid, p.name
+}
+
+// findSocket return uid and inode of the line whose local address is ip:port
+func findSocket(path string, ip net.IP, port uint16) (int, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return -1, "", nil
+		}
+		return -1, "", err
+	}
+	defer f.Close()
+
+	ip4 := ip.To4()
+	s := bufio.NewScanner(f)
+	s.Scan() // header
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		local, localPort, err := parseProcAddr(fields[1])
+		if err != nil || localPort != port {
+			continue
+		}
+		// IPv4 clients of dual stack listeners show up as IPv4-mapped in tcp6
+		if !local.Equal(ip) && !(ip4 != nil && local.To4() != nil && local.To4().Equal(ip4)) {
+			// sockets bound to any address, mostly UDP, match any ip
+			if !local.IsUnspecified() {
+				continue
+			}
+		}
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			continue
+		}
+		return uid, fields[9], nil
+	}
+	return -1, "", s.Err()
+}
+
+// parseProcAddr parse "0100007F:0277", the IP is in words of host byte order
+func parseProcAddr(s string) (net.IP, uint16, error) {
+	addr, portHex, found := strings.Cut(s, ":")
+	if !found {
+		return nil, 0, fmt.Errorf("invalid address %s", s)
+	}
+	b, err := hex.DecodeString(addr)
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return nil, 0, fmt.Errorf("invalid address %s", s)
+	}
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.NativeEndian.Uint32(b[i:]))
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, uint16(port), nil
+}
+
+// scanProcesses map socket inodes to the processes having them open,
+// among processes of uid, which are the only ones a socket of uid can be in
+func scanProcesses(uid int) map[string]*cachedProcess {
+	found := make(map[string]*cachedProcess)
+	dirs, err := os.ReadDir("/proc")
+	if err != nil {
+		return found
+	}
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		procDir := filepath.Join("/proc", dir.Name())
+		if info, err := os.Stat(procDir); err != nil {
+			continue
+		} else if st, ok := info.Sys().(*syscall.Stat_t); ok && uid >= 0 && int(st.Uid) != uid {
+			continue
+		}
+		fds, err := os.ReadDir(filepath.Join(procDir, "fd"))
+		if err != nil {
+			continue
+		}
+		var p *cachedProcess
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(procDir, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			if p == nil {
+				p = &cachedProcess{pid: pid, name: processName(procDir)}
+			}
+			found[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = p
+		}
+	}
+	return found
+}
+
+// processName is the executable name, or comm, which is cut at 15 bytes, if exe can not be read
+func processName(procDir string) string {
+	if exe, err := os.Readlink(filepath.Join(procDir, "exe")); err == nil {
+		return filepath.Base(strings.TrimSuffix(exe, " (deleted)"))
+	}
+	comm, _ := os.ReadFile(filepath.Join(procDir, "comm"))
+	return strings.TrimSpace(string(comm))
+}
@@ -0,0 +1,155 @@
+package libv2ray
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v2net "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	routing_session "github.com/xtls/xray-core/features/routing/session"
+)
+
+func TestParseProcAddr(t *testing.T) {
+	ip, port, err := parseProcAddr("0100007F:0277")
+	if err != nil || port != 631 {
+		t.Fatal(ip, port, err)
+	}
+	if !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Error(ip)
+	}
+	ip, _, err = parseProcAddr("00000000000000000000000001000000:0050")
+	if err != nil || !ip.Equal(net.IPv6loopback) {
+		t.Error(ip, err)
+	}
+	if _, _, err := parseProcAddr("zz:0050"); err == nil {
+		t.Error("expect error")
+	}
+}
+
+func TestSocketOwner(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.TCPAddr)
+
+	exe, _ := os.Executable()
+	owner, err := socketOwner("tcp", local.IP, uint16(local.Port), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner.UID != os.Getuid() || owner.PID != os.Getpid() || owner.Name != filepath.Base(exe) {
+		t.Errorf("owner %+v, expect uid %d pid %d %s", owner, os.Getuid(), os.Getpid(), filepath.Base(exe))
+	}
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udpAddr := udp.LocalAddr().(*net.UDPAddr)
+	if owner, err := socketOwner("udp", udpAddr.IP, uint16(udpAddr.Port), false); err != nil || owner.UID != os.Getuid() {
+		t.Errorf("udp owner %+v %v", owner, err)
+	}
+
+	if _, err := socketOwner("tcp", local.IP, 1, false); err == nil {
+		t.Error("expect no owner for an unused port")
+	}
+
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:    "socks",
+		Source: v2net.TCPDestination(v2net.IPAddress(local.IP), v2net.Port(local.Port)),
+	})
+	ctx = session.ContextWithOutbound(ctx, &session.Outbound{
+		Target: v2net.TCPDestination(v2net.DomainAddress("example.com"), 443),
+	})
+	routed := routing_session.AsRoutingContext(ctx)
+	tests := []struct {
+		expr    string
+		matched bool
+	}{
+		{fmt.Sprintf("uid == %d && process == '%s'", os.Getuid(), filepath.Base(exe)), true},
+		{fmt.Sprintf("process matches '^%s' && port == 443", filepath.Base(exe)[:3]), true},
+		{fmt.Sprintf("uid in [%d] && process != 'no-such-process'", os.Getuid()+1), false},
+		{"process in ['no-such-process', 'curl']", false},
+	}
+	for _, tt := range tests {
+		node, err := compileExpression(tt.expr)
+		if err != nil {
+			t.Fatal(tt.expr, err)
+		}
+		if matched := node.eval(routed); matched != tt.matched {
+			t.Errorf("%s: matched %v", tt.expr, matched)
+		}
+	}
+	for _, expr := range []string{"uid == 'root'", "uid matches '1.*'", "process matches '('"} {
+		if _, err := compileExpression(expr); err == nil {
+			t.Errorf("%s: expect error", expr)
+		}
+	}
+}
+
+func TestSocketOwnerCache(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var locals []*net.TCPAddr
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		locals = append(locals, conn.LocalAddr().(*net.TCPAddr))
+	}
+	lookups := func() (int, int) {
+		owners.Lock()
+		defer owners.Unlock()
+		return owners.socketReads, owners.processScans
+	}
+
+	reads, scans := lookups()
+	for i := 0; i < 3; i++ {
+		owner, err := socketOwner("tcp", locals[0].IP, uint16(locals[0].Port), true)
+		if err != nil || owner.PID != os.Getpid() {
+			t.Fatalf("owner %+v %v", owner, err)
+		}
+	}
+	if _, s := lookups(); s != scans+1 {
+		t.Errorf("%d process scans for one connection", s-scans)
+	}
+
+	// the scan found the other connection of this process as well
+	if owner, err := socketOwner("tcp", locals[1].IP, uint16(locals[1].Port), true); err != nil || owner.PID != os.Getpid() {
+		t.Fatalf("owner %+v %v", owner, err)
+	}
+	if r, s := lookups(); r != reads+4 || s != scans+1 {
+		t.Errorf("%d socket reads and %d process scans for two connections", r-reads, s-scans)
+	}
+
+	// the address is free once the socket is closed, another one may take it
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := udp.LocalAddr().(*net.UDPAddr)
+	if _, err := socketOwner("udp", addr.IP, uint16(addr.Port), true); err != nil {
+		t.Fatal(err)
+	}
+	udp.Close()
+	if _, err := socketOwner("udp", addr.IP, uint16(addr.Port), true); err == nil {
+		t.Error("closed socket still owned")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package libv2ray
+
+import (
+	"errors"
+	"net"
+)
+
+// socketOwner is only implemented on Linux, process and uid rules never match elsewhere
+func socketOwner(network string, ip net.IP, port uint16, withProcess bool) (*processInfo, error) {
+	return nil, errors.New("process lookup not supported")
+}
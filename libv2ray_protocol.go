@@ -0,0 +1,155 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xtls/xray-core/common/session"
+	v2conf "github.com/xtls/xray-core/infra/conf"
+	"github.com/xtls/xray-core/transport"
+)
+
+const unknownProtocol = "unknown"
+
+type protocolCounters struct {
+	Connections int64 `json:"connections"`
+	Active      int64 `json:"active"`
+	Uplink      int64 `json:"uplink"`
+	Downlink    int64 `json:"downlink"`
+	Blocked     int64 `json:"blocked"`
+	Redirected  int64 `json:"redirected"`
+}
+
+// protocolClassifier count connections from inbounds by sniffed protocol,
+// and block or redirect the protocols it is told to
+type protocolClassifier struct {
+	sync.Mutex
+	counters  map[string]*protocolCounters
+	actions   map[string]string
+	directTag string
+}
+
+type classifiedKey struct{}
+
+/*
+SetProtocolActions set what to do with connections of a sniffed protocol, as JSON
+e.g. {"bittorrent": "block", "quic": "direct"}. An action is "block", "direct"
+(the first freedom outbound) or any outbound tag. Protocols are named as xray sniffs them:
+http1, tls, quic, bittorrent; sniffing must be enabled on the inbound.
+*/
+func (v *V2RayPoint) SetProtocolActions(actionsJSON string) error {
+	actions := make(map[string]string)
+	if len(actionsJSON) > 0 {
+		if err := json.Unmarshal([]byte(actionsJSON), &actions); err != nil {
+			return err
+		}
+	}
+	normalized := make(map[string]string, len(actions))
+	for protocol, action := range actions {
+		if len(action) == 0 {
+			return fmt.Errorf("protocol %s: empty action", protocol)
+		}
+		normalized[strings.ToLower(protocol)] = action
+	}
+
+	v.protocols.Lock()
+	v.protocols.actions = normalized
+	v.protocols.Unlock()
+	log.Printf("protocol actions: %v", normalized)
+	return nil
+}
+
+/*GetProtocolStats return connections and traffic by sniffed protocol as JSON, optionally reset*/
+func (v *V2RayPoint) GetProtocolStats(reset bool) string {
+	p := &v.protocols
+	p.Lock()
+	counters := p.counters
+	if reset {
+		p.counters = nil
+	}
+	p.Unlock()
+
+	stats := make(map[string]*protocolCounters, len(counters))
+	for protocol, c := range counters {
+		stats[protocol] = &protocolCounters{
+			Connections: atomic.LoadInt64(&c.Connections),
+			Active:      atomic.LoadInt64(&c.Active),
+			Uplink:      atomic.LoadInt64(&c.Uplink),
+			Downlink:    atomic.LoadInt64(&c.Downlink),
+			Blocked:     atomic.LoadInt64(&c.Blocked),
+			Redirected:  atomic.LoadInt64(&c.Redirected),
+		}
+	}
+	b, err := json.Marshal(stats)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return string(b)
+}
+
+// setConfig pick the outbound "direct" stands for in config
+func (p *protocolClassifier) setConfig(config *v2conf.Config) {
+	p.Lock()
+	defer p.Unlock()
+	p.directTag = ""
+	for _, ob := range config.OutboundConfigs {
+		if strings.EqualFold(ob.Protocol, "freedom") && len(ob.Tag) > 0 {
+			p.directTag = ob.Tag
+			return
+		}
+	}
+}
+
+func (p *protocolClassifier) filter(ctx context.Context, tag string, link *transport.Link) (context.Context, *transport.Link, error) {
+	if ctx.Value(classifiedKey{}) != nil || session.InboundFromContext(ctx) == nil {
+		return ctx, link, nil
+	}
+	protocol := unknownProtocol
+	if content := session.ContentFromContext(ctx); content != nil && len(content.Protocol) > 0 {
+		protocol = strings.ToLower(content.Protocol)
+	}
+
+	p.Lock()
+	if p.counters == nil {
+		p.counters = make(map[string]*protocolCounters)
+	}
+	c, found := p.counters[protocol]
+	if !found {
+		c = &protocolCounters{}
+		p.counters[protocol] = c
+	}
+	action := p.actions[protocol]
+	target := action
+	if action == "direct" {
+		target = p.directTag
+	}
+	p.Unlock()
+
+	switch {
+	case action == "block":
+		atomic.AddInt64(&c.Blocked, 1)
+		return ctx, link, fmt.Errorf("protocol %s blocked", protocol)
+	case action == "direct" && len(target) == 0:
+		log.Printf("protocol %s: no direct outbound", protocol)
+	case len(target) > 0 && target != tag:
+		atomic.AddInt64(&c.Redirected, 1)
+		ctx = redirectOutbound(ctx, target)
+	}
+
+	atomic.AddInt64(&c.Connections, 1)
+	atomic.AddInt64(&c.Active, 1)
+	w := &releaseWriter{
+		Writer:  &countingWriter{Writer: link.Writer, bytes: &c.Downlink},
+		release: func() { atomic.AddInt64(&c.Active, -1) },
+	}
+	return context.WithValue(ctx, classifiedKey{}, protocol), &transport.Link{
+		Reader: &countingReader{Reader: link.Reader, bytes: &c.Uplink},
+		Writer: w,
+	}, nil
+}
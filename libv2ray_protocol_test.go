@@ -0,0 +1,125 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/session"
+	v2conf "github.com/xtls/xray-core/infra/conf"
+)
+
+func sniffedContext(protocol string) context.Context {
+	ctx := inboundContext("socks", "10.0.0.1", "a.com")
+	return session.ContextWithContent(ctx, &session.Content{Protocol: protocol})
+}
+
+func TestProtocolClassifier(t *testing.T) {
+	v := &V2RayPoint{}
+	v.protocols.setConfig(&v2conf.Config{OutboundConfigs: []v2conf.OutboundDetourConfig{
+		{Tag: "proxy", Protocol: "vmess"},
+		{Tag: "direct", Protocol: "freedom"},
+	}})
+	if err := v.SetProtocolActions(`{"BitTorrent": "block", "quic": "direct"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := v.protocols.filter(sniffedContext("bittorrent"), "proxy", testLink()); err == nil {
+		t.Error("bittorrent not blocked")
+	}
+	ctx, _, err := v.protocols.filter(sniffedContext("quic"), "proxy", testLink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag, _ := ctx.Value(redirectKey{}).(string); tag != "direct" {
+		t.Errorf("quic redirected to %q", tag)
+	}
+	_, link, err := v.protocols.filter(sniffedContext("tls"), "proxy", testLink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	common.Close(link.Writer)
+	// not sniffed at all
+	if _, _, err := v.protocols.filter(sniffedContext(""), "proxy", testLink()); err != nil {
+		t.Fatal(err)
+	}
+
+	var stats map[string]*protocolCounters
+	if err := json.Unmarshal([]byte(v.GetProtocolStats(true)), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if c := stats["bittorrent"]; c == nil || c.Blocked != 1 || c.Connections != 0 {
+		t.Errorf("unexpected bittorrent stats: %+v", c)
+	}
+	if c := stats["quic"]; c == nil || c.Redirected != 1 || c.Active != 1 {
+		t.Errorf("unexpected quic stats: %+v", c)
+	}
+	if c := stats["tls"]; c == nil || c.Connections != 1 || c.Active != 0 {
+		t.Errorf("unexpected tls stats: %+v", c)
+	}
+	if stats[unknownProtocol] == nil {
+		t.Error("unsniffed connection not counted")
+	}
+	if got := v.GetProtocolStats(false); got != "{}" {
+		t.Errorf("stats not reset: %s", got)
+	}
+}
+
+func TestProtocolClassifierGroups(t *testing.T) {
+	unknownStats := func(v *V2RayPoint) *protocolCounters {
+		t.Helper()
+		var stats map[string]*protocolCounters
+		if err := json.Unmarshal([]byte(v.GetProtocolStats(true)), &stats); err != nil || stats[unknownProtocol] == nil {
+			t.Fatalf("%v %v", stats, err)
+		}
+		return stats[unknownProtocol]
+	}
+
+	// a flow over both paths of a dualpath is one connection
+	classified := &V2RayPoint{}
+	conn, v := startDualPath(t, &classified.protocols)
+	checkDualPath(t, conn, v, []string{"a", "b", "c", "d"})
+	if c := unknownStats(classified); c.Connections != 1 || c.Uplink != 4 || c.Downlink != 4 {
+		t.Errorf("dualpath %+v", c)
+	}
+
+	// and so is a connection a fallback group retried on another outbound
+	good := smartServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		b := make([]byte, 4)
+		io.ReadFull(conn, b)
+		conn.Write([]byte("pong"))
+	})
+	socksPort := closedPort(t)
+	config, err := loadCoreConfig(fmt.Sprintf(`{
+		"inbounds": [{"tag": "socks", "listen": "127.0.0.1", "port": %d, "protocol": "socks"}],
+		"outbounds": [
+			{"tag": "dead", "protocol": "freedom", "settings": {"redirect": "127.0.0.1:%d"}},
+			{"tag": "good", "protocol": "freedom", "settings": {"redirect": "127.0.0.1:%d"}},
+			{"tag": "auto", "protocol": "fallback", "settings": {"outbounds": ["dead", "good"]}}
+		],
+		"routing": {"rules": [{"type": "field", "network": "tcp", "outboundTag": "auto"}]}
+	}`, socksPort, closedPort(t), good))
+	if err != nil {
+		t.Fatal(err)
+	}
+	classified = &V2RayPoint{}
+	inst, err := config.newInstance(&classified.protocols)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+	if answer, err := smartExchange(t, fmt.Sprintf("127.0.0.1:%d", socksPort), "localhost:1001"); answer != "pong" {
+		t.Fatalf("fallback connection failed: %q %v", answer, err)
+	}
+	if c := unknownStats(classified); c.Connections != 1 || c.Uplink != 4 || c.Downlink != 4 {
+		t.Errorf("fallback %+v", c)
+	}
+}
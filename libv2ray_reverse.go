@@ -0,0 +1,281 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/features/outbound"
+	v2conf "github.com/xtls/xray-core/infra/conf"
+	"github.com/xtls/xray-core/transport"
+)
+
+const (
+	reverseBridgeTag  = "bridge"
+	reversePortalTag  = "portal"
+	reverseServiceTag = "service"
+	// portal workers send a heartbeat every 2 seconds
+	reverseIdleTimeout = 10 * time.Second
+)
+
+// reverseMonitor sits between a bridge and the outbound to its portal,
+// counting tunnels and their traffic
+type reverseMonitor struct {
+	// 64-bit atomic counters go first to stay aligned on 32-bit platforms
+	uplink       int64
+	downlink     int64
+	lastDownlink int64
+	tunnels      int32
+
+	tag       string
+	bridgeTag string
+	domain    string
+	target    string
+	ohm       outbound.Manager
+}
+
+type reverseStatus struct {
+	Tag        string `json:"tag"`
+	Domain     string `json:"domain"`
+	Outbound   string `json:"outbound"`
+	Connected  bool   `json:"connected"`
+	Tunnels    int32  `json:"tunnels"`
+	Uplink     int64  `json:"uplink"`
+	Downlink   int64  `json:"downlink"`
+	LastActive int64  `json:"lastActive,omitempty"`
+}
+
+/*
+NewReverseBridgeConfig generate the bridge side of a xray reverse proxy.
+portalOutbound is the outbound (JSON) reaching the portal server,
+service the internal host:port exposed, and domain the one configured on the portal.
+*/
+func NewReverseBridgeConfig(portalOutbound string, service string, domain string) (string, error) {
+	var portal map[string]interface{}
+	if err := json.Unmarshal([]byte(portalOutbound), &portal); err != nil {
+		return "", fmt.Errorf("invalid portal outbound: %v", err)
+	}
+	var detour v2conf.OutboundDetourConfig
+	if err := json.Unmarshal([]byte(portalOutbound), &detour); err != nil {
+		return "", fmt.Errorf("invalid portal outbound: %v", err)
+	}
+	if _, err := detour.Build(); err != nil {
+		return "", fmt.Errorf("invalid portal outbound: %v", err)
+	}
+	if _, _, err := net.SplitHostPort(service); err != nil {
+		return "", fmt.Errorf("invalid service address: %v", err)
+	}
+	if len(domain) == 0 || strings.ContainsAny(domain, ":/ ") {
+		return "", fmt.Errorf("invalid domain %q", domain)
+	}
+	portal["tag"] = reversePortalTag
+
+	config := map[string]interface{}{
+		"log": map[string]interface{}{"loglevel": "warning"},
+		"reverse": map[string]interface{}{
+			"bridges": []interface{}{
+				map[string]interface{}{"tag": reverseBridgeTag, "domain": domain},
+			},
+		},
+		"outbounds": []interface{}{
+			portal,
+			map[string]interface{}{
+				"tag":      reverseServiceTag,
+				"protocol": "freedom",
+				"settings": map[string]interface{}{"redirect": service},
+			},
+		},
+		"routing": map[string]interface{}{
+			"rules": []interface{}{
+				map[string]interface{}{
+					"type":        "field",
+					"inboundTag":  []string{reverseBridgeTag},
+					"domain":      []string{"full:" + domain},
+					"outboundTag": reversePortalTag,
+				},
+				map[string]interface{}{
+					"type":        "field",
+					"inboundTag":  []string{reverseBridgeTag},
+					"outboundTag": reverseServiceTag,
+				},
+			},
+		},
+	}
+	b, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+/*
+StartReverseBridge run a bridge generated by NewReverseBridgeConfig,
+with the portal server as DomainName of the protected dialer.
+*/
+func (v *V2RayPoint) StartReverseBridge(portalOutbound string, service string, domain string) error {
+	config, err := NewReverseBridgeConfig(portalOutbound, service, domain)
+	if err != nil {
+		return err
+	}
+	var portal map[string]interface{}
+	json.Unmarshal([]byte(portalOutbound), &portal)
+
+	v.v2rayOP.Lock()
+	defer v.v2rayOP.Unlock()
+	v.setConfigContent(config)
+	v.DomainName = outboundServer(portal)
+	return v.runLoop(false)
+}
+
+// outboundServer return host:port of the first server of a proxy outbound
+func outboundServer(ob map[string]interface{}) string {
+	settings, _ := ob["settings"].(map[string]interface{})
+	for _, key := range []string{"vnext", "servers"} {
+		list, _ := settings[key].([]interface{})
+		if len(list) == 0 {
+			continue
+		}
+		server, _ := list[0].(map[string]interface{})
+		address, _ := server["address"].(string)
+		if port, ok := server["port"].(float64); ok && len(address) > 0 {
+			return net.JoinHostPort(address, fmt.Sprint(int(port)))
+		}
+	}
+	return ""
+}
+
+/*
+GetReverseStatus return the state of reverse bridges of the running config as JSON,
+empty string if core is not running.
+*/
+func (v *V2RayPoint) GetReverseStatus() string {
+	_, config := v.runningCore()
+	if config == nil {
+		return ""
+	}
+
+	bridges := make([]*reverseStatus, 0)
+	for _, h := range config.outbounds {
+		if m, ok := h.(*reverseMonitor); ok {
+			bridges = append(bridges, m.status())
+		}
+	}
+	b, err := json.Marshal(map[string]interface{}{"bridges": bridges})
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return string(b)
+}
+
+func (m *reverseMonitor) init(ohm outbound.Manager) {
+	m.ohm = ohm
+}
+
+// Tag implements outbound.Handler.
+func (m *reverseMonitor) Tag() string {
+	return m.tag
+}
+
+// Start implements common.Runnable.
+func (m *reverseMonitor) Start() error {
+	return nil
+}
+
+// Close implements common.Closable.
+func (m *reverseMonitor) Close() error {
+	return nil
+}
+
+// Dispatch implements outbound.Handler.
+func (m *reverseMonitor) Dispatch(ctx context.Context, link *transport.Link) {
+	h := m.ohm.GetHandler(m.target)
+	if h == nil {
+		log.Printf("reverse bridge %s: no outbound %s", m.bridgeTag, m.target)
+		common.Interrupt(link.Writer)
+		common.Interrupt(link.Reader)
+		return
+	}
+
+	atomic.AddInt32(&m.tunnels, 1)
+	defer atomic.AddInt32(&m.tunnels, -1)
+	h.Dispatch(ctx, &transport.Link{
+		Reader: &countingReader{Reader: link.Reader, bytes: &m.uplink},
+		Writer: &countingWriter{Writer: link.Writer, bytes: &m.downlink, last: &m.lastDownlink},
+	})
+}
+
+func (m *reverseMonitor) status() *reverseStatus {
+	s := &reverseStatus{
+		Tag:        m.bridgeTag,
+		Domain:     m.domain,
+		Outbound:   m.target,
+		Tunnels:    atomic.LoadInt32(&m.tunnels),
+		Uplink:     atomic.LoadInt64(&m.uplink),
+		Downlink:   atomic.LoadInt64(&m.downlink),
+		LastActive: atomic.LoadInt64(&m.lastDownlink),
+	}
+	// a tunnel is up once the portal talks through it
+	s.Connected = s.Tunnels > 0 && s.LastActive > 0 &&
+		time.Since(time.Unix(s.LastActive, 0)) < reverseIdleTimeout
+	return s
+}
+
+// extractReverseMonitors route bridge tunnels of config through monitors,
+// a tunnel is what a bridge dispatches to its own domain.
+// Bridges routed without naming the domain are not monitored.
+func extractReverseMonitors(config *v2conf.Config) ([]*reverseMonitor, error) {
+	if config.Reverse == nil || config.RouterConfig == nil {
+		return nil, nil
+	}
+
+	var monitors []*reverseMonitor
+	for _, bridge := range config.Reverse.Bridges {
+		for i, raw := range config.RouterConfig.RuleList {
+			var rule map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &rule); err != nil {
+				return nil, err
+			}
+			var inboundTags, domains []string
+			var target string
+			json.Unmarshal(rule["inboundTag"], &inboundTags)
+			json.Unmarshal(rule["domain"], &domains)
+			json.Unmarshal(rule["outboundTag"], &target)
+			if len(target) == 0 || !containsFold(inboundTags, bridge.Tag) || !hasReverseDomain(domains, bridge.Domain) {
+				continue
+			}
+
+			m := &reverseMonitor{
+				tag:       "reverse-" + bridge.Tag,
+				bridgeTag: bridge.Tag,
+				domain:    bridge.Domain,
+				target:    target,
+			}
+			rule["outboundTag"], _ = json.Marshal(m.tag)
+			b, err := json.Marshal(rule)
+			if err != nil {
+				return nil, err
+			}
+			config.RouterConfig.RuleList[i] = b
+			monitors = append(monitors, m)
+			break
+		}
+	}
+	return monitors, nil
+}
+
+func hasReverseDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		d = strings.TrimPrefix(strings.TrimPrefix(d, "full:"), "domain:")
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+const testPortalOutbound = `{"protocol": "vmess", "settings": {"vnext": [{"address": "portal.example.com", "port": 443,
+	"users": [{"id": "b831381d-6324-4d53-ad4f-8cda48b30811"}]}]}}`
+
+func TestNewReverseBridgeConfig(t *testing.T) {
+	content, err := NewReverseBridgeConfig(testPortalOutbound, "127.0.0.1:8080", "rev.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadCoreConfig(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.outbounds) != 1 {
+		t.Fatalf("expect 1 monitor, got %d", len(config.outbounds))
+	}
+	m := config.outbounds[0].(*reverseMonitor)
+	if m.bridgeTag != reverseBridgeTag || m.target != reversePortalTag || m.domain != "rev.example" {
+		t.Errorf("unexpected monitor: %+v", m)
+	}
+	if !strings.Contains(string(config.json.RouterConfig.RuleList[0]), `"reverse-bridge"`) {
+		t.Errorf("tunnel rule not rewritten: %s", config.json.RouterConfig.RuleList[0])
+	}
+	if status := m.status(); status.Connected || status.Tunnels != 0 {
+		t.Errorf("idle monitor reported connected: %+v", status)
+	}
+}
+
+func TestNewReverseBridgeConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		portal  string
+		service string
+		domain  string
+	}{
+		{"bad outbound", `{"protocol": "nope"}`, "127.0.0.1:80", "rev.example"},
+		{"bad service", testPortalOutbound, "127.0.0.1", "rev.example"},
+		{"no domain", testPortalOutbound, "127.0.0.1:80", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewReverseBridgeConfig(tt.portal, tt.service, tt.domain); err == nil {
+				t.Error("expect error")
+			}
+		})
+	}
+}
+
+func TestOutboundServer(t *testing.T) {
+	var ob map[string]interface{}
+	if err := json.Unmarshal([]byte(testPortalOutbound), &ob); err != nil {
+		t.Fatal(err)
+	}
+	if got := outboundServer(ob); got != "portal.example.com:443" {
+		t.Errorf("outboundServer() = %q", got)
+	}
+}
+
+// echoOutbound write back everything read from a link until it is closed
+type echoOutbound struct {
+	fakeOutbound
+}
+
+func (h *echoOutbound) Dispatch(ctx context.Context, link *transport.Link) {
+	buf.Copy(link.Reader, link.Writer)
+	common.Close(link.Writer)
+}
+
+func TestReverseMonitorTraffic(t *testing.T) {
+	ohm := newFakeOutboundManager()
+	ohm.handlers[reversePortalTag] = &echoOutbound{fakeOutbound{tag: reversePortalTag}}
+	m := &reverseMonitor{tag: "reverse-bridge", bridgeTag: reverseBridgeTag, domain: "rev.example", target: reversePortalTag}
+	m.init(ohm)
+
+	upReader, upWriter := pipe.New()
+	downReader, downWriter := pipe.New()
+	done := make(chan struct{})
+	go func() {
+		m.Dispatch(context.Background(), &transport.Link{Reader: upReader, Writer: downWriter})
+		close(done)
+	}()
+
+	if err := upWriter.WriteMultiBuffer(buf.MergeBytes(nil, []byte("ping"))); err != nil {
+		t.Fatal(err)
+	}
+	mb, err := downReader.ReadMultiBuffer()
+	if err != nil || mb.String() != "ping" {
+		t.Fatalf("echo %q %v", mb.String(), err)
+	}
+	buf.ReleaseMulti(mb)
+	status := m.status()
+	if !status.Connected || status.Tunnels != 1 || status.Uplink != 4 || status.Downlink != 4 || status.LastActive == 0 {
+		t.Errorf("open tunnel %+v", status)
+	}
+
+	upWriter.Close()
+	<-done
+	if status := m.status(); status.Connected || status.Tunnels != 0 || status.Uplink != 4 || status.Downlink != 4 {
+		t.Errorf("closed tunnel %+v", status)
+	}
+}
@@ -0,0 +1,415 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type singBoxUTLS struct {
+	Enabled     bool   `json:"enabled"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+type singBoxReality struct {
+	Enabled   bool   `json:"enabled"`
+	PublicKey string `json:"public_key"`
+	ShortID   string `json:"short_id,omitempty"`
+}
+
+type singBoxTLS struct {
+	Enabled    bool            `json:"enabled"`
+	ServerName string          `json:"server_name,omitempty"`
+	Insecure   bool            `json:"insecure,omitempty"`
+	ALPN       []string        `json:"alpn,omitempty"`
+	UTLS       *singBoxUTLS    `json:"utls,omitempty"`
+	Reality    *singBoxReality `json:"reality,omitempty"`
+}
+
+type singBoxTransport struct {
+	Type        string            `json:"type"`
+	Path        string            `json:"path,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Host        []string          `json:"host,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+}
+
+type singBoxOutbound struct {
+	Type       string            `json:"type"`
+	Tag        string            `json:"tag"`
+	Server     string            `json:"server,omitempty"`
+	ServerPort int               `json:"server_port,omitempty"`
+	UUID       string            `json:"uuid,omitempty"`
+	Security   string            `json:"security,omitempty"`
+	AlterID    int               `json:"alter_id,omitempty"`
+	Flow       string            `json:"flow,omitempty"`
+	Method     string            `json:"method,omitempty"`
+	Version    string            `json:"version,omitempty"`
+	Username   string            `json:"username,omitempty"`
+	Password   string            `json:"password,omitempty"`
+	TLS        *singBoxTLS       `json:"tls,omitempty"`
+	Transport  *singBoxTransport `json:"transport,omitempty"`
+}
+
+type singBoxRule struct {
+	Domain        []string `json:"domain,omitempty"`
+	DomainSuffix  []string `json:"domain_suffix,omitempty"`
+	DomainKeyword []string `json:"domain_keyword,omitempty"`
+	DomainRegex   []string `json:"domain_regex,omitempty"`
+	Geosite       []string `json:"geosite,omitempty"`
+	IPCIDR        []string `json:"ip_cidr,omitempty"`
+	GeoIP         []string `json:"geoip,omitempty"`
+	Port          []int    `json:"port,omitempty"`
+	PortRange     []string `json:"port_range,omitempty"`
+	Network       string   `json:"network,omitempty"`
+	Outbound      string   `json:"outbound"`
+}
+
+type singBoxRoute struct {
+	Rules []*singBoxRule `json:"rules"`
+	Final string         `json:"final,omitempty"`
+}
+
+type singBoxConfig struct {
+	Outbounds []*singBoxOutbound `json:"outbounds"`
+	Route     *singBoxRoute      `json:"route,omitempty"`
+}
+
+// xray protocols and sing-box outbound types
+var singBoxTypes = map[string]string{
+	"vmess": "vmess", "vless": "vless", "trojan": "trojan", "shadowsocks": "shadowsocks",
+	"socks": "socks", "http": "http", "freedom": "direct", "blackhole": "block",
+}
+
+// outbound and rule keys the importer knows what to do with
+var (
+	singBoxOutboundKeys = map[string]bool{"type": true, "tag": true, "server": true, "server_port": true,
+		"uuid": true, "security": true, "alter_id": true, "flow": true, "method": true, "version": true,
+		"username": true, "password": true, "tls": true, "transport": true}
+	singBoxRuleKeys = map[string]bool{"domain": true, "domain_suffix": true, "domain_keyword": true,
+		"domain_regex": true, "geosite": true, "ip_cidr": true, "geoip": true, "port": true,
+		"port_range": true, "network": true, "outbound": true}
+)
+
+/*
+ExportSingBoxConfig convert outbounds and simple routing rules of a xray config to
+a sing-box config with outbounds and route rules. Returns JSON {"config": json, "unsupported": [...]}
+listing outbounds, fields and rules that have no sing-box equivalent and were left out.
+*/
+func ExportSingBoxConfig(content string) (string, error) {
+	p, err := profileFromXray(content)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.MarshalIndent(p.singBoxConfig(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return p.result(string(b))
+}
+
+/*
+ImportSingBoxConfig convert outbounds and route rules of a sing-box config to a xray config.
+Returns JSON {"config": xray json, "unsupported": [...]}, outbound types and rule fields
+xray has no equivalent of are listed in unsupported.
+*/
+func ImportSingBoxConfig(content string) (string, error) {
+	m, err := decodeConfigMap(content)
+	if err != nil {
+		return "", err
+	}
+	p, err := profileFromSingBox(m)
+	if err != nil {
+		return "", err
+	}
+	xray, err := p.xrayConfig()
+	if err != nil {
+		return "", err
+	}
+	return p.result(xray)
+}
+
+func (p *exportProfile) singBoxConfig() *singBoxConfig {
+	config := &singBoxConfig{Route: &singBoxRoute{Rules: []*singBoxRule{}}}
+	for _, proxy := range p.Proxies {
+		config.Outbounds = append(config.Outbounds, proxy.singBoxOutbound())
+	}
+	for _, rule := range p.Rules {
+		if sr, err := singBoxRuleOf(rule); err != nil {
+			p.unsupported("rule %d: %v", rule.Index, err)
+		} else {
+			config.Route.Rules = append(config.Route.Rules, sr)
+		}
+	}
+	config.Route.Final = p.Final
+	return config
+}
+
+func (proxy *exportProxy) singBoxOutbound() *singBoxOutbound {
+	ob := &singBoxOutbound{Type: singBoxTypes[proxy.Protocol], Tag: proxy.Tag}
+	if proxy.Protocol == "freedom" || proxy.Protocol == "blackhole" {
+		return ob
+	}
+	ob.Server, ob.ServerPort, ob.UUID, ob.Flow = proxy.Server, proxy.Port, proxy.UUID, proxy.Flow
+	ob.Username, ob.Password = proxy.Username, proxy.Password
+	switch proxy.Protocol {
+	case "vmess":
+		ob.Security, ob.AlterID = proxy.Cipher, proxy.AlterID
+	case "shadowsocks":
+		ob.Method = proxy.Cipher
+	case "socks":
+		ob.Version = "5"
+	}
+
+	if proxy.TLS {
+		ob.TLS = &singBoxTLS{Enabled: true, ServerName: proxy.ServerName, Insecure: proxy.Insecure, ALPN: proxy.ALPN}
+		if len(proxy.Fingerprint) > 0 {
+			ob.TLS.UTLS = &singBoxUTLS{Enabled: true, Fingerprint: proxy.Fingerprint}
+		}
+		if proxy.Reality {
+			ob.TLS.Reality = &singBoxReality{Enabled: true, PublicKey: proxy.PublicKey, ShortID: proxy.ShortID}
+		}
+	}
+	switch proxy.Transport {
+	case "ws":
+		ob.Transport = &singBoxTransport{Type: "ws", Path: proxy.Path}
+		if len(proxy.Host) > 0 {
+			ob.Transport.Headers = map[string]string{"Host": proxy.Host}
+		}
+	case "grpc":
+		ob.Transport = &singBoxTransport{Type: "grpc", ServiceName: proxy.ServiceName}
+	case "http":
+		ob.Transport = &singBoxTransport{Type: "http", Path: proxy.Path}
+		if len(proxy.Host) > 0 {
+			ob.Transport.Host = []string{proxy.Host}
+		}
+	}
+	return ob
+}
+
+// singBoxRuleOf write a rule as a sing-box rule. sing-box matches domain and ip items
+// of a rule if any of them matches, xray rules need both.
+func singBoxRuleOf(rule *exportRule) (*singBoxRule, error) {
+	if len(rule.Domains) > 0 && len(rule.IPs) > 0 {
+		return nil, fmt.Errorf("matches domain and ip together")
+	}
+	sr := &singBoxRule{Outbound: rule.Outbound}
+	for _, d := range rule.Domains {
+		kind, value, found := strings.Cut(d, ":")
+		if !found {
+			kind, value = "keyword", d
+		}
+		switch kind {
+		case "full":
+			sr.Domain = append(sr.Domain, value)
+		case "domain":
+			sr.DomainSuffix = append(sr.DomainSuffix, value)
+		case "keyword":
+			sr.DomainKeyword = append(sr.DomainKeyword, value)
+		case "regexp":
+			sr.DomainRegex = append(sr.DomainRegex, value)
+		case "geosite":
+			sr.Geosite = append(sr.Geosite, value)
+		default:
+			return nil, fmt.Errorf("domain %s", d)
+		}
+	}
+	for _, ip := range rule.IPs {
+		switch {
+		case strings.HasPrefix(ip, "geoip:!") || strings.HasPrefix(ip, "ext:"):
+			return nil, fmt.Errorf("ip %s", ip)
+		case strings.HasPrefix(ip, "geoip:"):
+			sr.GeoIP = append(sr.GeoIP, strings.TrimPrefix(ip, "geoip:"))
+		default:
+			sr.IPCIDR = append(sr.IPCIDR, cidr(ip))
+		}
+	}
+	for _, port := range rule.Ports {
+		from, to, err := splitPortRange(port)
+		if err != nil {
+			return nil, fmt.Errorf("port %s", port)
+		}
+		if from == to {
+			sr.Port = append(sr.Port, from)
+		} else {
+			sr.PortRange = append(sr.PortRange, fmt.Sprintf("%d:%d", from, to))
+		}
+	}
+	switch rule.Network {
+	case "", "tcp", "udp":
+		sr.Network = rule.Network
+	default:
+		if len(rule.Domains) == 0 && len(rule.IPs) == 0 && len(rule.Ports) == 0 {
+			return nil, fmt.Errorf("network %s only", rule.Network)
+		}
+		// both networks is any network
+	}
+	return sr, nil
+}
+
+func profileFromSingBox(m map[string]interface{}) (*exportProfile, error) {
+	p := &exportProfile{}
+	list, _ := m["outbounds"].([]interface{})
+	for _, o := range list {
+		raw, ok := o.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if proxy := p.proxyFromSingBox(raw); proxy != nil {
+			if p.proxy(proxy.Tag) != nil {
+				p.unsupported("outbound %s: duplicate tag", proxy.Tag)
+				continue
+			}
+			p.Proxies = append(p.Proxies, proxy)
+		}
+	}
+	if len(p.Proxies) == 0 {
+		return nil, fmt.Errorf("no outbound to import")
+	}
+
+	route, _ := m["route"].(map[string]interface{})
+	rules, _ := route["rules"].([]interface{})
+	for i, r := range rules {
+		raw, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		p.Rules = append(p.Rules, p.rulesFromSingBox(i, raw)...)
+	}
+	// sing-box also sends what no rule matches to the first outbound
+	p.Final = p.Proxies[0].Tag
+	if final, _ := route["final"].(string); len(final) > 0 {
+		if p.proxy(final) == nil {
+			p.unsupported("route final %s not imported", final)
+		} else {
+			p.Final = final
+		}
+	}
+	return p, nil
+}
+
+func (p *exportProfile) proxyFromSingBox(raw map[string]interface{}) *exportProxy {
+	var ob singBoxOutbound
+	b, _ := json.Marshal(raw)
+	if err := json.Unmarshal(b, &ob); err != nil {
+		p.unsupported("outbound %v: %v", raw["tag"], err)
+		return nil
+	}
+	proxy := &exportProxy{Tag: ob.Tag, Transport: "tcp"}
+	for protocol, typ := range singBoxTypes {
+		if ob.Type == typ {
+			proxy.Protocol = protocol
+		}
+	}
+	if len(proxy.Protocol) == 0 {
+		p.unsupported("outbound %s: type %s", ob.Tag, ob.Type)
+		return nil
+	}
+	if len(proxy.Tag) == 0 {
+		proxy.Tag = ob.Type
+	}
+	if proxy.Protocol == "freedom" || proxy.Protocol == "blackhole" {
+		return proxy
+	}
+	for _, key := range sortedKeys(raw) {
+		if !singBoxOutboundKeys[key] {
+			p.unsupported("outbound %s: %s", proxy.Tag, key)
+		}
+	}
+	proxy.Server, proxy.Port, proxy.UUID, proxy.Flow = ob.Server, ob.ServerPort, ob.UUID, ob.Flow
+	proxy.Username, proxy.Password, proxy.AlterID = ob.Username, ob.Password, ob.AlterID
+	proxy.Cipher = ob.Security
+	if proxy.Protocol == "shadowsocks" {
+		proxy.Cipher = ob.Method
+	}
+	if proxy.Protocol == "socks" && len(ob.Version) > 0 && ob.Version != "5" {
+		p.unsupported("outbound %s: socks version %s", proxy.Tag, ob.Version)
+		return nil
+	}
+
+	if t := ob.TLS; t != nil && t.Enabled {
+		proxy.TLS, proxy.ServerName, proxy.Insecure, proxy.ALPN = true, t.ServerName, t.Insecure, t.ALPN
+		if t.UTLS != nil && t.UTLS.Enabled {
+			proxy.Fingerprint = t.UTLS.Fingerprint
+		}
+		if t.Reality != nil && t.Reality.Enabled {
+			proxy.Reality, proxy.PublicKey, proxy.ShortID = true, t.Reality.PublicKey, t.Reality.ShortID
+		}
+	}
+	if t := ob.Transport; t != nil {
+		switch t.Type {
+		case "ws":
+			proxy.Transport, proxy.Path, proxy.Host = "ws", t.Path, t.Headers["Host"]
+		case "grpc":
+			proxy.Transport, proxy.ServiceName = "grpc", t.ServiceName
+		case "http":
+			proxy.Transport, proxy.Path = "http", t.Path
+			if len(t.Host) > 0 {
+				proxy.Host = t.Host[0]
+			}
+		default:
+			p.unsupported("outbound %s: transport %s", proxy.Tag, t.Type)
+			return nil
+		}
+	}
+	return proxy
+}
+
+// rulesFromSingBox read a sing-box rule. Its domain and ip items match if any of them does,
+// a rule having both is read as a domain rule followed by an ip rule.
+func (p *exportProfile) rulesFromSingBox(i int, raw map[string]interface{}) []*exportRule {
+	for _, key := range sortedKeys(raw) {
+		if !singBoxRuleKeys[key] {
+			p.unsupported("rule %d: %s", i, key)
+			return nil
+		}
+	}
+	var sr singBoxRule
+	b, _ := json.Marshal(raw)
+	if err := json.Unmarshal(b, &sr); err != nil {
+		p.unsupported("rule %d: %v", i, err)
+		return nil
+	}
+	if p.proxy(sr.Outbound) == nil {
+		p.unsupported("rule %d: outbound %q not imported", i, sr.Outbound)
+		return nil
+	}
+
+	rule := &exportRule{Outbound: sr.Outbound, Network: sr.Network, Index: i}
+	for _, group := range []struct {
+		prefix string
+		values []string
+	}{{"full:", sr.Domain}, {"domain:", sr.DomainSuffix}, {"keyword:", sr.DomainKeyword},
+		{"regexp:", sr.DomainRegex}, {"geosite:", sr.Geosite}} {
+		for _, value := range group.values {
+			rule.Domains = append(rule.Domains, group.prefix+value)
+		}
+	}
+	rule.IPs = append(rule.IPs, sr.IPCIDR...)
+	for _, code := range sr.GeoIP {
+		rule.IPs = append(rule.IPs, "geoip:"+code)
+	}
+	for _, port := range sr.Port {
+		rule.Ports = append(rule.Ports, strconv.Itoa(port))
+	}
+	for _, r := range sr.PortRange {
+		from, to, found := strings.Cut(r, ":")
+		if !found || len(from) == 0 || len(to) == 0 {
+			// open ranges like ":1000" have no xray equivalent
+			p.unsupported("rule %d: port_range %s", i, r)
+			return nil
+		}
+		rule.Ports = append(rule.Ports, from+"-"+to)
+	}
+	if len(rule.Domains) == 0 && len(rule.IPs) == 0 && len(rule.Ports) == 0 && len(rule.Network) == 0 {
+		p.unsupported("rule %d: nothing to match", i)
+		return nil
+	}
+	if len(rule.Domains) > 0 && len(rule.IPs) > 0 {
+		ipRule := *rule
+		rule.IPs, ipRule.Domains = nil, nil
+		return []*exportRule{rule, &ipRule}
+	}
+	return []*exportRule{rule}
+}
@@ -0,0 +1,116 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestExportSingBoxConfig(t *testing.T) {
+	r, err := decodeExportResult(ExportSingBoxConfig(exportXrayConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Unsupported) > 0 {
+		t.Fatal(r.Unsupported)
+	}
+	var config singBoxConfig
+	if err := json.Unmarshal([]byte(r.Config), &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Outbounds) != 6 || len(config.Route.Rules) != 6 || config.Route.Final != "proxy" {
+		t.Fatalf("%s", r.Config)
+	}
+	proxy := config.Outbounds[0]
+	if proxy.Type != "vless" || proxy.TLS == nil || proxy.TLS.Reality == nil || proxy.TLS.UTLS.Fingerprint != "chrome" {
+		t.Errorf("%+v", proxy)
+	}
+	if ws := config.Outbounds[1]; ws.Transport == nil || ws.Transport.Headers["Host"] != "cdn.example.com" || ws.Security != "aes-128-gcm" {
+		t.Errorf("%+v", ws)
+	}
+	if ob := config.Outbounds[4]; ob.Type != "direct" || len(ob.Server) > 0 {
+		t.Errorf("%+v", ob)
+	}
+	rules := config.Route.Rules
+	if len(rules[1].DomainSuffix) != 1 || len(rules[1].Domain) != 1 || len(rules[1].DomainKeyword) != 1 {
+		t.Errorf("%+v", rules[1])
+	}
+	if len(rules[2].GeoIP) != 1 || len(rules[2].IPCIDR) != 2 || rules[2].IPCIDR[0] != "10.0.0.1/32" {
+		t.Errorf("%+v", rules[2])
+	}
+	if len(rules[4].Port) != 1 || rules[4].Port[0] != 53 || rules[4].PortRange[0] != "1000:2000" {
+		t.Errorf("%+v", rules[4])
+	}
+
+	// export, import and export again gives the same sing-box config
+	imported, err := decodeExportResult(ImportSingBoxConfig(r.Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported.Unsupported) > 0 {
+		t.Fatal(imported.Unsupported)
+	}
+	again, err := decodeExportResult(ExportSingBoxConfig(imported.Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Config != r.Config {
+		t.Errorf("round trip changed the config:\n%s\n%s", r.Config, again.Config)
+	}
+
+	r, err = decodeExportResult(ExportSingBoxConfig(exportUnsupportedConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectUnsupported(t, r.Unsupported, "mux", "transport kcp", "protocol wireguard", "rule 2: ip geoip:!cn",
+		"rule 4: matches domain and ip together")
+}
+
+func TestImportSingBoxConfig(t *testing.T) {
+	r, err := decodeExportResult(ImportSingBoxConfig(`{
+		"outbounds": [
+			{"type": "selector", "tag": "select", "outbounds": ["hk", "direct"]},
+			{"type": "shadowsocks", "tag": "hk", "server": "hk.example.com", "server_port": 8388,
+				"method": "aes-256-gcm", "password": "secret", "multiplex": {"enabled": true}},
+			{"type": "vless", "tag": "quic", "server": "quic.example.com", "server_port": 443,
+				"uuid": "27848739-7e62-4138-9fd3-098a63964b6b", "transport": {"type": "quic"}},
+			{"type": "direct", "tag": "direct"}
+		],
+		"route": {
+			"rules": [
+				{"protocol": "dns", "outbound": "dns-out"},
+				{"domain_suffix": ["cn"], "ip_cidr": ["10.0.0.0/8"], "outbound": "direct"},
+				{"rule_set": ["geosite-ads"], "outbound": "direct"},
+				{"port_range": [":1000"], "outbound": "direct"},
+				{"port": [443], "network": "udp", "outbound": "select"}
+			],
+			"final": "select"
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectUnsupported(t, r.Unsupported, "outbound select: type selector", "outbound hk: multiplex",
+		"outbound quic: transport quic", "rule 0: protocol", "rule 2: rule_set", "rule 3: port_range :1000",
+		"rule 4: outbound \"select\"", "route final select")
+
+	if _, err := loadCoreConfig(r.Config); err != nil {
+		t.Fatal(err)
+	}
+	p, err := profileFromXray(r.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Proxies) != 2 || p.Final != "hk" || len(p.Rules) != 2 {
+		t.Fatalf("%d proxies final %s %d rules", len(p.Proxies), p.Final, len(p.Rules))
+	}
+	// a domain or an ip matches the sing-box rule, each has its own xray rule
+	if rule := p.Rules[0]; len(rule.Domains) != 1 || rule.Domains[0] != "domain:cn" || len(rule.IPs) > 0 || rule.Outbound != "direct" {
+		t.Errorf("%+v", rule)
+	}
+	if rule := p.Rules[1]; len(rule.IPs) != 1 || rule.IPs[0] != "10.0.0.0/8" || len(rule.Domains) > 0 || rule.Outbound != "direct" {
+		t.Errorf("%+v", rule)
+	}
+	if hk := p.proxy("hk"); hk.Cipher != "aes-256-gcm" || hk.Password != "secret" {
+		t.Errorf("%+v", hk)
+	}
+}
@@ -0,0 +1,352 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	v2net "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	v2core "github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/features/routing"
+	routing_session "github.com/xtls/xray-core/features/routing/session"
+	v2conf "github.com/xtls/xray-core/infra/conf"
+	"github.com/xtls/xray-core/transport"
+)
+
+const (
+	defaultSmartTimeout = 5 * time.Second
+	defaultSmartExpire  = 7 * 24 * time.Hour
+)
+
+type smartSettings struct {
+	Enabled     bool   `json:"enabled"`
+	DirectTag   string `json:"directTag,omitempty"`
+	ProxyTag    string `json:"proxyTag,omitempty"`
+	TimeoutMs   int64  `json:"timeoutMs,omitempty"`
+	ExpireHours int64  `json:"expireHours,omitempty"`
+	Path        string `json:"path,omitempty"`
+}
+
+// smartRouter send connections to domains no rule covers direct, and learn the
+// domains direct fails for, which go to the proxy from then on
+type smartRouter struct {
+	sync.Mutex
+	settings   smartSettings
+	learned    map[string]int64 // domain to unix time it expires
+	directTag  string
+	proxyTag   string
+	defaultTag string
+	router     routing.Router
+}
+
+type smartKey struct{}
+
+/*
+SetSmartRouting turn on learning which domains need the proxy, settings as JSON
+{"enabled": true, "directTag": "direct", "proxyTag": "proxy", "timeoutMs": 5000,
+"expireHours": 168, "path": "/data/.../learned.json"}. Connections to domains matched
+by no rule try direct first; a domain is learned when direct is reset, times out or
+gets anything but TLS back for a TLS handshake, and goes to proxyTag until it expires.
+Tags default to the first freedom outbound and the first proxy outbound.
+Learned domains are kept in path, loaded here. An empty settings turns it off.
+*/
+func (v *V2RayPoint) SetSmartRouting(settingsJSON string) error {
+	var settings smartSettings
+	if len(settingsJSON) > 0 {
+		if err := json.Unmarshal([]byte(settingsJSON), &settings); err != nil {
+			return err
+		}
+	}
+	var learned map[string]int64
+	if len(settings.Path) > 0 {
+		if !filepath.IsAbs(settings.Path) {
+			return errors.New("path must be absolute")
+		}
+		b, err := os.ReadFile(settings.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &learned); err != nil {
+				return err
+			}
+		}
+	}
+
+	// v2rayOP is taken before the smart router lock when the core starts
+	_, config := v.runningCore()
+	s := &v.smart
+	s.Lock()
+	s.settings = settings
+	if s.learned == nil {
+		s.learned = make(map[string]int64)
+	}
+	for domain, expire := range learned {
+		s.learned[domain] = expire
+	}
+	s.pruneLocked()
+	if config != nil {
+		s.setConfigLocked(config.json)
+	}
+	s.Unlock()
+	log.Printf("smart routing: enabled %v, %d learned domains", settings.Enabled, len(learned))
+	return nil
+}
+
+/*GetLearnedDomains return domains learned to need the proxy as JSON, with the unix time they expire*/
+func (v *V2RayPoint) GetLearnedDomains() string {
+	s := &v.smart
+	s.Lock()
+	s.pruneLocked()
+	b, err := json.Marshal(s.learned)
+	s.Unlock()
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return string(b)
+}
+
+/*ForgetLearnedDomain let domain try direct again, all domains if it is empty*/
+func (v *V2RayPoint) ForgetLearnedDomain(domain string) {
+	s := &v.smart
+	s.Lock()
+	if len(domain) == 0 {
+		s.learned = make(map[string]int64)
+	} else {
+		delete(s.learned, strings.ToLower(domain))
+	}
+	s.Unlock()
+	s.save()
+}
+
+// setConfig pick the direct and proxy outbounds in config
+func (s *smartRouter) setConfig(config *v2conf.Config) {
+	s.Lock()
+	defer s.Unlock()
+	s.setConfigLocked(config)
+}
+
+func (s *smartRouter) setConfigLocked(config *v2conf.Config) {
+	s.directTag, s.proxyTag = s.settings.DirectTag, s.settings.ProxyTag
+	for _, ob := range config.OutboundConfigs {
+		if len(ob.Tag) == 0 {
+			continue
+		}
+		switch strings.ToLower(ob.Protocol) {
+		case "freedom":
+			if len(s.directTag) == 0 {
+				s.directTag = ob.Tag
+			}
+		case "blackhole", "dns", "loopback":
+		default:
+			if len(s.proxyTag) == 0 {
+				s.proxyTag = ob.Tag
+			}
+		}
+	}
+}
+
+// init take the router and the default outbound of a new core
+func (s *smartRouter) init(inst *v2core.Instance) {
+	s.Lock()
+	defer s.Unlock()
+	s.router, _ = inst.GetFeature(routing.RouterType()).(routing.Router)
+	s.defaultTag = ""
+	if ohm, ok := inst.GetFeature(outbound.ManagerType()).(outbound.Manager); ok {
+		if def := ohm.GetDefaultHandler(); def != nil {
+			s.defaultTag = def.Tag()
+		}
+	}
+}
+
+func (s *smartRouter) filter(ctx context.Context, tag string, link *transport.Link) (context.Context, *transport.Link, error) {
+	if ctx.Value(smartKey{}) != nil || session.InboundFromContext(ctx) == nil {
+		return ctx, link, nil
+	}
+	// routed by this library already
+	if redirected, _ := ctx.Value(redirectKey{}).(string); len(redirected) > 0 {
+		return ctx, link, nil
+	}
+	s.Lock()
+	enabled, router, defaultTag := s.settings.Enabled, s.router, s.defaultTag
+	direct, proxy := s.directTag, s.proxyTag
+	timeout := time.Duration(s.settings.TimeoutMs) * time.Millisecond
+	s.Unlock()
+	if !enabled || router == nil || tag != defaultTag || len(direct) == 0 || len(proxy) == 0 {
+		return ctx, link, nil
+	}
+	ob := session.OutboundFromContext(ctx)
+	if ob == nil || ob.Target.Network != v2net.Network_TCP {
+		return ctx, link, nil
+	}
+	rctx := routing_session.AsRoutingContext(ctx)
+	domain := strings.ToLower(rctx.GetTargetDomain())
+	if len(domain) == 0 {
+		return ctx, link, nil
+	}
+	if _, err := router.PickRoute(rctx); !errors.Is(err, common.ErrNoClue) {
+		return ctx, link, nil
+	}
+
+	ctx = context.WithValue(ctx, smartKey{}, domain)
+	if s.isLearned(domain) {
+		outboundTraceFromContext(ctx).smartRouted(proxy, "learned")
+		if proxy != tag {
+			ctx = redirectOutbound(ctx, proxy)
+		}
+		return ctx, link, nil
+	}
+	outboundTraceFromContext(ctx).smartRouted(direct, "probing")
+	if direct != tag {
+		ctx = redirectOutbound(ctx, direct)
+	}
+
+	if timeout <= 0 {
+		timeout = defaultSmartTimeout
+	}
+	p := &smartProbe{router: s, domain: domain, link: link}
+	if content := session.ContentFromContext(ctx); content != nil {
+		p.tls = strings.EqualFold(content.Protocol, "tls")
+	}
+	p.timer = time.AfterFunc(timeout, p.timeout)
+	w := &releaseWriter{Writer: &smartWriter{Writer: link.Writer, probe: p}}
+	w.release = func() { p.timer.Stop() }
+	return session.TrackedConnectionError(ctx, p), &transport.Link{
+		Reader: &countingReader{Reader: link.Reader, bytes: &p.sent},
+		Writer: w,
+	}, nil
+}
+
+func (s *smartRouter) isLearned(domain string) bool {
+	s.Lock()
+	defer s.Unlock()
+	expire, found := s.learned[domain]
+	return found && expire > time.Now().Unix()
+}
+
+func (s *smartRouter) learn(domain string, reason string) {
+	s.Lock()
+	expire := time.Duration(s.settings.ExpireHours) * time.Hour
+	if expire <= 0 {
+		expire = defaultSmartExpire
+	}
+	if s.learned == nil {
+		s.learned = make(map[string]int64)
+	}
+	s.learned[domain] = time.Now().Add(expire).Unix()
+	s.Unlock()
+	log.Printf("smart routing: %s needs proxy, %s", domain, reason)
+	s.save()
+}
+
+func (s *smartRouter) pruneLocked() {
+	now := time.Now().Unix()
+	for domain, expire := range s.learned {
+		if expire <= now {
+			delete(s.learned, domain)
+		}
+	}
+}
+
+// save write learned domains to path, through a temporary file so that it is never half written
+func (s *smartRouter) save() {
+	s.Lock()
+	path := s.settings.Path
+	s.pruneLocked()
+	b, err := json.Marshal(s.learned)
+	s.Unlock()
+	if len(path) == 0 || err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		log.Printf("smart routing: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("smart routing: %v", err)
+	}
+}
+
+// smartProbe watch a direct connection for the ways it is interfered with
+type smartProbe struct {
+	router    *smartRouter
+	domain    string
+	tls       bool
+	link      *transport.Link
+	timer     *time.Timer
+	sent      int64
+	responded int32
+	failed    int32
+}
+
+// SubmitError implements session.TrackedRequestErrorFeedback, errors before any response
+// are dial failures or resets
+func (p *smartProbe) SubmitError(err error) {
+	if atomic.LoadInt32(&p.responded) == 0 {
+		p.fail(err.Error())
+	}
+}
+
+// timeout the server has not answered what the client sent
+func (p *smartProbe) timeout() {
+	if atomic.LoadInt32(&p.responded) != 0 || atomic.LoadInt64(&p.sent) == 0 {
+		return
+	}
+	p.fail("timeout")
+	common.Interrupt(p.link.Reader)
+	common.Interrupt(p.link.Writer)
+}
+
+func (p *smartProbe) fail(reason string) {
+	if atomic.CompareAndSwapInt32(&p.failed, 0, 1) {
+		p.router.learn(p.domain, reason)
+	}
+}
+
+// smartWriter check the first response to the client
+type smartWriter struct {
+	buf.Writer
+	probe *smartProbe
+}
+
+func (w *smartWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	p := w.probe
+	if !mb.IsEmpty() && atomic.CompareAndSwapInt32(&p.responded, 0, 1) {
+		p.timer.Stop()
+		var first byte
+		for _, b := range mb {
+			if !b.IsEmpty() {
+				first = b.Byte(0)
+				break
+			}
+		}
+		// a TLS server answers a ClientHello with a handshake record or an alert
+		if p.tls && first != 0x16 && first != 0x15 {
+			buf.ReleaseMulti(mb)
+			p.fail("not TLS in response to TLS")
+			return errors.New("smart routing: TLS interference")
+		}
+	}
+	return w.Writer.WriteMultiBuffer(mb)
+}
+
+func (w *smartWriter) Close() error {
+	return common.Close(w.Writer)
+}
+
+func (w *smartWriter) Interrupt() {
+	common.Interrupt(w.Writer)
+}
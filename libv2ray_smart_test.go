@@ -0,0 +1,196 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/buf"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// smartServer accept connections and serve them with handle
+func smartServer(t *testing.T, handle func(conn *net.TCPConn)) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn.(*net.TCPConn))
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func startSmartCore(t *testing.T, v *V2RayPoint, proxyPort int) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socks := l.Addr().String()
+	l.Close()
+	_, port, _ := net.SplitHostPort(socks)
+
+	// the proxy is a freedom going to the good server whatever the target
+	config, err := loadCoreConfig(fmt.Sprintf(`{
+		"inbounds": [{"tag": "socks", "listen": "127.0.0.1", "port": %s, "protocol": "socks"}],
+		"outbounds": [
+			{"tag": "proxy", "protocol": "freedom", "settings": {"redirect": "127.0.0.1:%d"}},
+			{"tag": "direct", "protocol": "freedom"}
+		],
+		"routing": {"rules": [{"type": "field", "port": "%d", "outboundTag": "direct"}]}
+	}`, port, proxyPort, proxyPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.smart.setConfig(config.json)
+	inst, err := config.newInstance(&v.smart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.smart.init(inst)
+	if err := inst.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { inst.Close() })
+	return socks
+}
+
+// smartExchange send ping to target through socks and return the answer
+func smartExchange(t *testing.T, socks string, target string) (string, error) {
+	t.Helper()
+	d, err := xproxy.SOCKS5("tcp", socks, nil, xproxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", target)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return "", err
+	}
+	b, err := io.ReadAll(conn)
+	return string(b), err
+}
+
+func TestSmartRouting(t *testing.T) {
+	good := smartServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		b := make([]byte, 4)
+		io.ReadFull(conn, b)
+		conn.Write([]byte("pong"))
+	})
+	reset := smartServer(t, func(conn *net.TCPConn) {
+		b := make([]byte, 4)
+		io.ReadFull(conn, b)
+		conn.SetLinger(0)
+		conn.Close()
+	})
+	silent := smartServer(t, func(conn *net.TCPConn) {
+		io.Copy(io.Discard, conn)
+	})
+
+	path := filepath.Join(t.TempDir(), "learned.json")
+	v := &V2RayPoint{}
+	if err := v.SetSmartRouting(fmt.Sprintf(`{"enabled": true, "directTag": "direct", "proxyTag": "proxy", "timeoutMs": 300, "path": %q}`, path)); err != nil {
+		t.Fatal(err)
+	}
+	socks := startSmartCore(t, v, good)
+
+	// covered by a rule, left alone
+	if answer, err := smartExchange(t, socks, fmt.Sprintf("localhost:%d", good)); answer != "pong" {
+		t.Errorf("ruled connection failed: %q %v", answer, err)
+	}
+	if learned := v.GetLearnedDomains(); learned != "{}" {
+		t.Errorf("learned %s", learned)
+	}
+
+	// reset direct, learned, then proxied
+	if answer, _ := smartExchange(t, socks, fmt.Sprintf("localhost:%d", reset)); answer == "pong" {
+		t.Error("first connection went to the proxy")
+	}
+	waitLearned(t, v, "localhost")
+	if answer, err := smartExchange(t, socks, fmt.Sprintf("localhost:%d", reset)); answer != "pong" {
+		t.Errorf("learned domain not proxied: %q %v", answer, err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]int64
+	if err := json.Unmarshal(b, &saved); err != nil || saved["localhost"] <= time.Now().Unix() {
+		t.Errorf("saved %s %v", b, err)
+	}
+
+	// silent direct times out
+	v.ForgetLearnedDomain("")
+	start := time.Now()
+	if answer, _ := smartExchange(t, socks, fmt.Sprintf("localhost:%d", silent)); answer == "pong" {
+		t.Error("connection went to the proxy after forget")
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Error("silent connection not interrupted")
+	}
+	waitLearned(t, v, "localhost")
+
+	// learned domains are loaded back
+	w := &V2RayPoint{}
+	if err := w.SetSmartRouting(fmt.Sprintf(`{"enabled": true, "path": %q}`, path)); err != nil {
+		t.Fatal(err)
+	}
+	if !w.smart.isLearned("localhost") {
+		t.Error("learned domains not loaded")
+	}
+	if err := w.SetSmartRouting(`{"enabled": true, "path": "learned.json"}`); err == nil {
+		t.Error("expect error for a relative path")
+	}
+}
+
+func waitLearned(t *testing.T, v *V2RayPoint, domain string) {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		if v.smart.isLearned(domain) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%s not learned: %s", domain, v.GetLearnedDomains())
+}
+
+func TestSmartWriterTLS(t *testing.T) {
+	s := &smartRouter{}
+	p := &smartProbe{router: s, domain: "blocked.example", tls: true, timer: time.NewTimer(time.Hour)}
+	w := &smartWriter{Writer: buf.Discard, probe: p}
+	if err := w.WriteMultiBuffer(buf.MultiBuffer{buf.FromBytes([]byte("HTTP/1.1 403 Forbidden\r\n"))}); err == nil {
+		t.Error("expect error for a plain text response")
+	}
+	if !s.isLearned("blocked.example") {
+		t.Error("TLS interference not learned")
+	}
+
+	p = &smartProbe{router: s, domain: "ok.example", tls: true, timer: time.NewTimer(time.Hour)}
+	w = &smartWriter{Writer: buf.Discard, probe: p}
+	if err := w.WriteMultiBuffer(buf.MultiBuffer{buf.New(), buf.FromBytes([]byte{0x16, 0x03, 0x03})}); err != nil {
+		t.Error(err)
+	}
+	p.SubmitError(io.ErrUnexpectedEOF)
+	if s.isLearned("ok.example") {
+		t.Error("error after a response learned")
+	}
+}
@@ -0,0 +1,308 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtls/xray-core/features/routing"
+	v2stats "github.com/xtls/xray-core/features/stats"
+)
+
+// stateVersion is bumped on incompatible changes of stateSnapshot,
+// snapshots newer than this library are refused
+const stateVersion = 1
+
+type serverState struct {
+	Domain string `json:"domain"`
+	IP     string `json:"ip"`
+}
+
+// outboundTraffic is traffic of an outbound not yet taken by QueryStats
+type outboundTraffic struct {
+	Uplink   int64 `json:"uplink"`
+	Downlink int64 `json:"downlink"`
+}
+
+type policySnapshot struct {
+	Policies   []*networkPolicy `json:"policies,omitempty"`
+	Base       string           `json:"base,omitempty"`
+	BaseDomain string           `json:"baseDomain,omitempty"`
+	Facts      *networkFacts    `json:"facts,omitempty"`
+	Fired      string           `json:"fired,omitempty"`
+}
+
+// stateSnapshot is what a restarted V2RayPoint needs to resume
+type stateSnapshot struct {
+	Version          int                          `json:"version"`
+	Created          int64                        `json:"created"`
+	Config           string                       `json:"config,omitempty"`
+	DomainName       string                       `json:"domainName,omitempty"`
+	ProtocolActions  map[string]string            `json:"protocolActions,omitempty"`
+	ConnectionLimits connectionLimits             `json:"connectionLimits"`
+	Policy           *policySnapshot              `json:"policy,omitempty"`
+	ProtocolStats    map[string]*protocolCounters `json:"protocolStats,omitempty"`
+	Server           *serverState                 `json:"server,omitempty"`
+	// balancer tag to the outbound it is pinned to
+	BalancerOverrides map[string]string           `json:"balancerOverrides,omitempty"`
+	OutboundTraffic   map[string]*outboundTraffic `json:"outboundTraffic,omitempty"`
+}
+
+/*
+SnapshotState return the runtime state as versioned JSON: the config and domain in use,
+protocol actions, connection limits, network policies with the last reported network,
+traffic counters by protocol and by outbound, and the server IP found working.
+Left out: routing rules edited at runtime through the xray API, the router does not
+list them, so the config in use is all the snapshot knows of routing; health of server IPs
+beyond the one that worked, the dialer keeps no scores; observatory results, the restarted
+core probes its outbounds again. Learned domains of smart routing are kept in their own file.
+Keep it on disk and pass it to RestoreState after the process is restarted.
+*/
+func (v *V2RayPoint) SnapshotState() string {
+	s := &stateSnapshot{Version: stateVersion, Created: time.Now().Unix()}
+
+	v.v2rayOP.Lock()
+	s.Config = v.configContent()
+	s.DomainName = v.DomainName
+	s.BalancerOverrides = v.balancerOverrides()
+	s.OutboundTraffic = v.outboundTraffic()
+	v.v2rayOP.Unlock()
+
+	v.protocols.Lock()
+	s.ProtocolActions = v.protocols.actions
+	v.protocols.Unlock()
+	json.Unmarshal([]byte(v.GetProtocolStats(false)), &s.ProtocolStats)
+
+	v.admission.Lock()
+	s.ConnectionLimits = v.admission.limits
+	v.admission.Unlock()
+
+	v.policy.Lock()
+	if len(v.policy.policies) > 0 || v.policy.facts != nil {
+		s.Policy = &policySnapshot{
+			Policies:   v.policy.policies,
+			Base:       v.policy.base,
+			BaseDomain: v.policy.baseDomain,
+			Facts:      v.policy.facts,
+			Fired:      v.policy.fired,
+		}
+	}
+	v.policy.Unlock()
+
+	if v.dialer != nil {
+		if domain, server, _ := v.dialer.server(); server != nil {
+			if ip := server.currentIP(); ip != nil {
+				s.Server = &serverState{Domain: domain, IP: ip.String()}
+			}
+		}
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return string(b)
+}
+
+/*
+RestoreState bring back a state taken by SnapshotState. Call it before RunLoop,
+a running core is reloaded with the snapshot config. Counters add up to the current ones.
+*/
+func (v *V2RayPoint) RestoreState(snapshot string) error {
+	var s stateSnapshot
+	if err := json.Unmarshal([]byte(snapshot), &s); err != nil {
+		return err
+	}
+	if s.Version < 1 || s.Version > stateVersion {
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+	if len(s.Config) > 0 {
+		if _, err := loadCoreConfig(s.Config); err != nil {
+			return fmt.Errorf("invalid config in state: %v", err)
+		}
+	}
+
+	v.protocols.Lock()
+	v.protocols.actions = s.ProtocolActions
+	if v.protocols.counters == nil {
+		v.protocols.counters = make(map[string]*protocolCounters)
+	}
+	for protocol, restored := range s.ProtocolStats {
+		c, found := v.protocols.counters[protocol]
+		if !found {
+			c = &protocolCounters{}
+			v.protocols.counters[protocol] = c
+		}
+		// active connections died with the old process
+		atomic.AddInt64(&c.Connections, restored.Connections)
+		atomic.AddInt64(&c.Uplink, restored.Uplink)
+		atomic.AddInt64(&c.Downlink, restored.Downlink)
+		atomic.AddInt64(&c.Blocked, restored.Blocked)
+		atomic.AddInt64(&c.Redirected, restored.Redirected)
+	}
+	v.protocols.Unlock()
+
+	v.admission.Lock()
+	v.admission.limits = s.ConnectionLimits
+	v.admission.Unlock()
+
+	if p := s.Policy; p != nil {
+		v.policy.Lock()
+		v.policy.policies = p.Policies
+		v.policy.base = p.Base
+		v.policy.baseDomain = p.BaseDomain
+		v.policy.facts = p.Facts
+		v.policy.fired = p.Fired
+		v.policy.Unlock()
+	}
+
+	if server := s.Server; server != nil && v.dialer != nil {
+		if ip := net.ParseIP(server.IP); ip != nil {
+			v.dialer.preferIP(server.Domain, ip)
+		}
+	}
+
+	log.Printf("state restored, taken at %s", time.Unix(s.Created, 0))
+	v.v2rayOP.Lock()
+	v.pendingOverrides = s.BalancerOverrides
+	v.pendingTraffic = s.OutboundTraffic
+	running := v.IsRunning
+	if running && len(s.Config) == 0 {
+		v.applyBalancerOverrides()
+		v.applyOutboundTraffic()
+	}
+	if !running && len(s.Config) > 0 {
+		v.setConfigContent(s.Config)
+		v.DomainName = s.DomainName
+	}
+	v.v2rayOP.Unlock()
+	// the reloaded core picks up the overrides and the traffic
+	if running && len(s.Config) > 0 {
+		return v.ReloadConfig(s.Config, s.DomainName)
+	}
+	return nil
+}
+
+// balancerOverrides return outbounds balancers of the running core are pinned to, v2rayOP must be held
+func (v *V2RayPoint) balancerOverrides() map[string]string {
+	if v.Vpoint == nil || v.config == nil || v.config.json.RouterConfig == nil {
+		return nil
+	}
+	bo, ok := v.Vpoint.GetFeature(routing.RouterType()).(routing.BalancerOverrider)
+	if !ok {
+		return nil
+	}
+	overrides := make(map[string]string)
+	for _, b := range v.config.json.RouterConfig.Balancers {
+		if target, err := bo.GetOverrideTarget(b.Tag); err == nil && len(target) > 0 {
+			overrides[b.Tag] = target
+		}
+	}
+	if len(overrides) == 0 {
+		return nil
+	}
+	return overrides
+}
+
+// applyBalancerOverrides pin balancers of the running core to the restored outbounds,
+// overrides of balancers not in this core wait for the next one, v2rayOP must be held
+func (v *V2RayPoint) applyBalancerOverrides() {
+	if len(v.pendingOverrides) == 0 || v.Vpoint == nil {
+		return
+	}
+	bo, ok := v.Vpoint.GetFeature(routing.RouterType()).(routing.BalancerOverrider)
+	if !ok {
+		return
+	}
+	for tag, target := range v.pendingOverrides {
+		if err := bo.SetOverrideTarget(tag, target); err == nil {
+			log.Printf("balancer %s restored to %s", tag, target)
+			delete(v.pendingOverrides, tag)
+		}
+	}
+}
+
+// outboundTraffic return outbound traffic counters of the running core with what is
+// still pending for the next one, v2rayOP must be held
+func (v *V2RayPoint) outboundTraffic() map[string]*outboundTraffic {
+	traffic := make(map[string]*outboundTraffic)
+	for tag, t := range v.pendingTraffic {
+		traffic[tag] = &outboundTraffic{Uplink: t.Uplink, Downlink: t.Downlink}
+	}
+	if visitor, ok := v.statsManager.(interface {
+		VisitCounters(func(string, v2stats.Counter) bool)
+	}); ok {
+		visitor.VisitCounters(func(name string, c v2stats.Counter) bool {
+			// outbound>>>tag>>>traffic>>>uplink
+			parts := strings.Split(name, ">>>")
+			if len(parts) != 4 || parts[0] != "outbound" || parts[2] != "traffic" || c.Value() == 0 {
+				return true
+			}
+			t, found := traffic[parts[1]]
+			if !found {
+				t = &outboundTraffic{}
+				traffic[parts[1]] = t
+			}
+			switch parts[3] {
+			case "uplink":
+				t.Uplink += c.Value()
+			case "downlink":
+				t.Downlink += c.Value()
+			}
+			return true
+		})
+	}
+	if len(traffic) == 0 {
+		return nil
+	}
+	return traffic
+}
+
+// applyOutboundTraffic add the restored traffic to the counters of the running core,
+// so QueryStats reports it, v2rayOP must be held
+func (v *V2RayPoint) applyOutboundTraffic() {
+	if len(v.pendingTraffic) == 0 || v.statsManager == nil {
+		return
+	}
+	for tag, t := range v.pendingTraffic {
+		for direct, n := range map[string]int64{"uplink": t.Uplink, "downlink": t.Downlink} {
+			if n == 0 {
+				continue
+			}
+			c, err := v2stats.GetOrRegisterCounter(v.statsManager, fmt.Sprintf("outbound>>>%s>>>traffic>>>%s", tag, direct))
+			if err != nil {
+				log.Printf("restore traffic of %s: %v", tag, err)
+				continue
+			}
+			c.Add(n)
+		}
+	}
+	v.pendingTraffic = nil
+}
+
+// preferIP start from ip when server is resolved, it is the one that worked last time
+func (d *ProtectedDialer) preferIP(server string, ip net.IP) {
+	d.serverLock.Lock()
+	defer d.serverLock.Unlock()
+	d.preferred = &serverState{Domain: server, IP: ip.String()}
+	if d.currentServer == server && d.vServer != nil {
+		d.vServer.selectIP(ip)
+	}
+}
+
+// selectIP switch to ip if it is one of the resolved
+func (r *resolved) selectIP(ip net.IP) {
+	r.ipLock.Lock()
+	defer r.ipLock.Unlock()
+	for i, candidate := range r.IPs {
+		if candidate.Equal(ip) {
+			r.ipIdx = uint8(i)
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/xtls/xray-core/features/routing"
+)
+
+func TestSnapshotState(t *testing.T) {
+	v := &V2RayPoint{dialer: NewPreotectedDialer(fakeSupportSet{})}
+	v.ConfigureFileContent = `{
+		"outbounds": [{"tag": "direct", "protocol": "freedom"}, {"tag": "proxy-a", "protocol": "freedom"}, {"tag": "proxy-b", "protocol": "freedom"}],
+		"routing": {"balancers": [{"tag": "proxy", "selector": ["proxy"], "strategy": {"type": "random"}}]},
+		"stats": {},
+		"policy": {"system": {"statsOutboundUplink": true, "statsOutboundDownlink": true}}
+	}`
+	v.DomainName = "a.example.com:443"
+	if err := v.SetProtocolActions(`{"bittorrent": "block"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.SetConnectionLimits(`{"global": 10}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.SetNetworkPolicies(`[{"name": "cell", "match": {"type": ["cellular"]}, "action": "stop"}]`); err != nil {
+		t.Fatal(err)
+	}
+	v.protocols.filter(sniffedContext("bittorrent"), "direct", testLink())
+	v.dialer.currentServer = v.DomainName
+	v.dialer.vServer = &resolved{domain: "a.example.com", Port: 443,
+		IPs: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}, ipIdx: 1}
+
+	// the balancer target picked at runtime
+	config, err := loadCoreConfig(v.ConfigureFileContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.startCore(config); err != nil {
+		t.Fatal(err)
+	}
+	router := v.Vpoint.GetFeature(routing.RouterType()).(routing.BalancerOverrider)
+	if err := router.SetOverrideTarget("proxy", "proxy-b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// traffic the app has not queried yet
+	v.statsManager.GetCounter("outbound>>>proxy-a>>>traffic>>>uplink").Add(100)
+	v.statsManager.GetCounter("outbound>>>proxy-a>>>traffic>>>downlink").Add(200)
+
+	snapshot := v.SnapshotState()
+	v.Vpoint.Close()
+
+	restored := &V2RayPoint{dialer: NewPreotectedDialer(fakeSupportSet{})}
+	if err := restored.RestoreState(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if restored.ConfigureFileContent != v.ConfigureFileContent || restored.DomainName != v.DomainName {
+		t.Error("config not restored")
+	}
+	if restored.protocols.actions["bittorrent"] != "block" || restored.admission.limits.Global != 10 {
+		t.Error("actions or limits not restored")
+	}
+	if len(restored.policy.policies) != 1 || restored.policy.base != v.ConfigureFileContent {
+		t.Errorf("policies not restored: %+v", restored.policy.policies)
+	}
+	var stats map[string]*protocolCounters
+	json.Unmarshal([]byte(restored.GetProtocolStats(false)), &stats)
+	if c := stats["bittorrent"]; c == nil || c.Blocked != 1 {
+		t.Errorf("counters not restored: %+v", c)
+	}
+
+	// the server IP that worked is tried first once resolved again
+	if p := restored.dialer.preferred; p == nil || p.Domain != v.DomainName || p.IP != "10.0.0.2" {
+		t.Fatalf("server not restored: %+v", p)
+	}
+	restored.dialer.currentServer = v.DomainName
+	restored.dialer.vServer = &resolved{IPs: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}}
+	restored.dialer.preferIP(v.DomainName, net.ParseIP("10.0.0.2"))
+	if ip := restored.dialer.vServer.currentIP(); !ip.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("current IP %v", ip)
+	}
+	var s stateSnapshot
+	json.Unmarshal([]byte(snapshot), &s)
+	if s.Version != stateVersion {
+		t.Errorf("version %d", s.Version)
+	}
+	if tr := s.OutboundTraffic["proxy-a"]; tr == nil || tr.Uplink != 100 || tr.Downlink != 200 || len(s.OutboundTraffic) != 1 {
+		t.Errorf("outbound traffic not in snapshot: %v", s.OutboundTraffic)
+	}
+
+	// the balancer is pinned again once the restored config runs
+	if s.BalancerOverrides["proxy"] != "proxy-b" {
+		t.Fatalf("override not in snapshot: %v", s.BalancerOverrides)
+	}
+	config, err = loadCoreConfig(restored.ConfigureFileContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.startCore(config); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Vpoint.Close()
+	router = restored.Vpoint.GetFeature(routing.RouterType()).(routing.BalancerOverrider)
+	if target, _ := router.GetOverrideTarget("proxy"); target != "proxy-b" {
+		t.Errorf("balancer override %q after restore", target)
+	}
+	if len(restored.pendingOverrides) > 0 {
+		t.Errorf("overrides still pending: %v", restored.pendingOverrides)
+	}
+	if up, down := restored.QueryStats("proxy-a", "uplink"), restored.QueryStats("proxy-a", "downlink"); up != 100 || down != 200 {
+		t.Errorf("outbound traffic %d/%d after restore", up, down)
+	}
+	if len(restored.pendingTraffic) > 0 {
+		t.Errorf("traffic still pending: %v", restored.pendingTraffic)
+	}
+}
+
+func TestRestoreStateRunning(t *testing.T) {
+	v := newTestPoint(&recordingSupportSet{})
+	if err := v.RunLoop(false); err != nil {
+		t.Fatal(err)
+	}
+	defer v.StopLoop()
+
+	// the config replaces the running core, the traffic goes to the new one
+	snapshot, _ := json.Marshal(&stateSnapshot{
+		Version: stateVersion,
+		Config: `{
+			"outbounds": [{"tag": "proxy", "protocol": "freedom"}],
+			"stats": {},
+			"policy": {"system": {"statsOutboundUplink": true, "statsOutboundDownlink": true}}
+		}`,
+		OutboundTraffic: map[string]*outboundTraffic{"proxy": {Uplink: 100, Downlink: 200}},
+	})
+	if err := v.RestoreState(string(snapshot)); err != nil {
+		t.Fatal(err)
+	}
+	if up, down := v.QueryStats("proxy", "uplink"), v.QueryStats("proxy", "downlink"); up != 100 || down != 200 {
+		t.Errorf("outbound traffic %d/%d after restore", up, down)
+	}
+}
+
+func TestRestoreStateInvalid(t *testing.T) {
+	v := &V2RayPoint{}
+	for _, snapshot := range []string{`{}`, `{"version": 99}`, `{"version": 1, "config": "{\"outbounds\": [{\"protocol\": \"nope\"}]}"}`, `nope`} {
+		if err := v.RestoreState(snapshot); err == nil {
+			t.Errorf("expect error of %s", snapshot)
+		}
+	}
+}
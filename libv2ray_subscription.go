@@ -0,0 +1,289 @@
+package libv2ray
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// publisherKeys holds the trusted subscription publisher keys, indexed by key id
+var publisherKeys struct {
+	sync.RWMutex
+	keys map[string]ed25519.PublicKey
+}
+
+// signedEnvelope is the JSON form of a subscription carrying its own signature
+type signedEnvelope struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+	KeyID     string `json:"keyId,omitempty"`
+}
+
+type subscriptionVerification struct {
+	Signed   bool   `json:"signed"`
+	Verified bool   `json:"verified"`
+	KeyID    string `json:"keyId,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// subscriptionProfile is a parsed share link, Fingerprint stays the same
+// as long as the server and its credential do
+type subscriptionProfile struct {
+	Fingerprint string `json:"fingerprint"`
+	Protocol    string `json:"protocol"`
+	Remarks     string `json:"remarks"`
+	Address     string `json:"address"`
+	Port        int    `json:"port"`
+	Link        string `json:"link"`
+}
+
+type subscriptionResult struct {
+	Verification subscriptionVerification `json:"verification"`
+	Profiles     []*subscriptionProfile   `json:"profiles"`
+}
+
+/*
+SetSubscriptionPublisherKeys set trusted ed25519 publisher keys,
+one base64 encoded public key per line.
+Once any key is set, unsigned or invalid subscriptions are refused.
+An empty string turns verification off.
+*/
+func SetSubscriptionPublisherKeys(keys string) error {
+	parsed := make(map[string]ed25519.PublicKey)
+	for _, line := range strings.Split(keys, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := decodeBase64(line)
+		if err != nil {
+			return fmt.Errorf("invalid publisher key %q: %v", line, err)
+		}
+		if len(raw) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid publisher key %q: bad length %d", line, len(raw))
+		}
+		pub := ed25519.PublicKey(raw)
+		parsed[publisherKeyID(pub)] = pub
+	}
+
+	publisherKeys.Lock()
+	publisherKeys.keys = parsed
+	publisherKeys.Unlock()
+	log.Printf("subscription publisher keys: %d", len(parsed))
+	return nil
+}
+
+/*
+ImportSubscription verify and parse a subscription payload.
+signature is an optional base64 detached ed25519 signature of content,
+leave it empty if content is a signed envelope or is not signed at all.
+The result is a JSON document with the verification result and the parsed profiles.
+*/
+func ImportSubscription(content string, signature string) (string, error) {
+	result, err := loadSubscription([]byte(content), signature)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// loadSubscription verify and parse content, refusing unverified content only if publisher keys are set
+func loadSubscription(content []byte, signature string) (*subscriptionResult, error) {
+	payload, verification, err := verifySubscription(content, signature)
+	if err != nil {
+		return nil, err
+	}
+	if verification.Error != "" && subscriptionKeysRequired() {
+		return nil, errors.New(verification.Error)
+	}
+
+	profiles, err := parseSubscription(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &subscriptionResult{
+		Verification: verification,
+		Profiles:     profiles,
+	}, nil
+}
+
+func publisherKeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+func subscriptionKeysRequired() bool {
+	publisherKeys.RLock()
+	defer publisherKeys.RUnlock()
+	return len(publisherKeys.keys) > 0
+}
+
+// verifySubscription unwraps a signed envelope if there is one,
+// and returns the payload to parse with the verification result.
+// Without configured keys the payload is never refused, an envelope
+// whose payload does not decode is an error as there is nothing to parse.
+func verifySubscription(content []byte, signature string) ([]byte, subscriptionVerification, error) {
+	var result subscriptionVerification
+	payload := content
+	keyID := ""
+
+	if len(signature) == 0 {
+		var env signedEnvelope
+		if err := json.Unmarshal(content, &env); err == nil && len(env.Signature) > 0 {
+			raw, err := decodeBase64(env.Payload)
+			if err != nil {
+				return nil, result, fmt.Errorf("invalid envelope payload: %v", err)
+			}
+			payload = raw
+			signature = env.Signature
+			keyID = env.KeyID
+		}
+	}
+
+	if len(signature) == 0 {
+		result.Error = "subscription is not signed"
+		return payload, result, nil
+	}
+	result.Signed = true
+
+	sig, err := decodeBase64(strings.TrimSpace(signature))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		result.Error = "malformed subscription signature"
+		return payload, result, nil
+	}
+
+	publisherKeys.RLock()
+	defer publisherKeys.RUnlock()
+	if len(publisherKeys.keys) == 0 {
+		result.Error = "no publisher keys configured"
+		return payload, result, nil
+	}
+	for id, pub := range publisherKeys.keys {
+		if len(keyID) > 0 && id != keyID {
+			continue
+		}
+		if ed25519.Verify(pub, payload, sig) {
+			result.Verified = true
+			result.KeyID = id
+			return payload, result, nil
+		}
+	}
+	result.Error = "subscription signature does not match any publisher key"
+	return payload, result, nil
+}
+
+// parseSubscription accept either plain or base64 encoded share links, one per line.
+func parseSubscription(payload []byte) ([]*subscriptionProfile, error) {
+	text := strings.TrimSpace(string(payload))
+	if !strings.Contains(text, "://") {
+		if raw, err := decodeBase64(strings.Join(strings.Fields(text), "")); err == nil {
+			text = string(raw)
+		}
+	}
+
+	profiles := make([]*subscriptionProfile, 0)
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		p, err := parseShareLink(line)
+		if err != nil {
+			log.Printf("skip share link: %v", err)
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+func parseShareLink(link string) (*subscriptionProfile, error) {
+	scheme, rest, found := strings.Cut(link, "://")
+	if !found {
+		return nil, fmt.Errorf("not a share link: %.32s", link)
+	}
+	scheme = strings.ToLower(scheme)
+	p := &subscriptionProfile{Protocol: scheme, Link: link}
+
+	// vmess links carry a base64 encoded json instead of an url
+	if scheme == "vmess" {
+		raw, err := decodeBase64(rest)
+		if err == nil {
+			var v struct {
+				Ps   string      `json:"ps"`
+				Add  string      `json:"add"`
+				Port json.Number `json:"port"`
+				ID   string      `json:"id"`
+			}
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return nil, fmt.Errorf("invalid vmess link: %v", err)
+			}
+			port, _ := v.Port.Int64()
+			p.Remarks, p.Address, p.Port = v.Ps, v.Add, int(port)
+			p.Fingerprint = profileFingerprint(p, v.ID)
+			return p, nil
+		}
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	p.Remarks = u.Fragment
+	p.Address = u.Hostname()
+	if port := u.Port(); len(port) > 0 {
+		p.Port, _ = strconv.Atoi(port)
+	}
+	credential := u.User.String()
+	if len(p.Address) == 0 {
+		// ss://base64(method:password@host:port)
+		if raw, err := decodeBase64(u.Host); err == nil {
+			if userinfo, hostport, ok := strings.Cut(string(raw), "@"); ok {
+				if host, port, err := net.SplitHostPort(hostport); err == nil {
+					p.Address = host
+					p.Port, _ = strconv.Atoi(port)
+					credential = userinfo
+				}
+			}
+		}
+	}
+	p.Fingerprint = profileFingerprint(p, credential)
+	return p, nil
+}
+
+// profileFingerprint identify a server by protocol, address, port and credential,
+// transport settings and remarks may change without changing it
+func profileFingerprint(p *subscriptionProfile, credential string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%s", p.Protocol, strings.ToLower(p.Address), p.Port, credential)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// decodeBase64 accept std and url encoding, with or without padding
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
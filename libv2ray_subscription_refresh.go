@@ -0,0 +1,442 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	v2net "github.com/xtls/xray-core/common/net"
+	v2core "github.com/xtls/xray-core/core"
+)
+
+const (
+	defaultRefreshInterval = 24 * time.Hour
+	minRefreshInterval     = time.Minute
+	maxSubscriptionSize    = 8 << 20
+	maxDelayHistory        = 10
+)
+
+// subscriptionSource is a subscription refreshed every Interval seconds,
+// fetched through the running core if ViaTunnel, otherwise by the protected dialer.
+// A detached signature is fetched from SignatureURL or read from the response
+// header SignatureHeader, without either the content may be a signed envelope.
+type subscriptionSource struct {
+	ID              string `json:"id"`
+	URL             string `json:"url"`
+	Interval        int64  `json:"interval"`
+	ViaTunnel       bool   `json:"viaTunnel"`
+	SignatureURL    string `json:"signatureUrl,omitempty"`
+	SignatureHeader string `json:"signatureHeader,omitempty"`
+}
+
+// storedProfile is a subscription profile with what the user added to it,
+// which survives refreshes as long as the fingerprint stays the same
+type storedProfile struct {
+	subscriptionProfile
+	Subscription string  `json:"subscription"`
+	UserRemarks  string  `json:"userRemarks,omitempty"`
+	Delays       []int64 `json:"delays,omitempty"`
+}
+
+type profileStore struct {
+	Profiles  []*storedProfile `json:"profiles"`
+	Refreshed map[string]int64 `json:"refreshed"`
+}
+
+type refreshSummary struct {
+	Subscription string   `json:"subscription"`
+	Added        []string `json:"added"`
+	Removed      []string `json:"removed"`
+	Modified     []string `json:"modified"`
+	Error        string   `json:"error,omitempty"`
+	RetryIn      int64    `json:"retryIn,omitempty"`
+}
+
+type subscriptionScheduler struct {
+	sync.Mutex
+	sources   []*subscriptionSource
+	storePath string
+	stop      chan struct{}
+	// store serializes read-modify-write of the store file
+	store sync.Mutex
+}
+
+/*
+SetSubscriptions schedule refresh of subscriptions, given as a JSON array of
+{id, url, interval (seconds), viaTunnel, signatureUrl, signatureHeader}, merging profiles
+into the JSON store at storePath. signatureUrl or signatureHeader tell where the detached
+signature of a subscription is, see ImportSubscription.
+Previous schedules are cancelled, an empty array stops refreshing.
+*/
+func (v *V2RayPoint) SetSubscriptions(subscriptionsJSON string, storePath string) error {
+	var sources []*subscriptionSource
+	if len(subscriptionsJSON) > 0 {
+		if err := json.Unmarshal([]byte(subscriptionsJSON), &sources); err != nil {
+			return err
+		}
+	}
+	ids := make(map[string]bool)
+	for _, src := range sources {
+		if len(src.ID) == 0 || ids[src.ID] {
+			return fmt.Errorf("subscription id %q missing or duplicated", src.ID)
+		}
+		ids[src.ID] = true
+		u, err := url.Parse(src.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("subscription %s: invalid url %q", src.ID, src.URL)
+		}
+		if len(src.SignatureURL) > 0 {
+			u, err := url.Parse(src.SignatureURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("subscription %s: invalid signature url %q", src.ID, src.SignatureURL)
+			}
+		}
+		if src.Interval == 0 {
+			src.Interval = int64(defaultRefreshInterval / time.Second)
+		}
+		if time.Duration(src.Interval)*time.Second < minRefreshInterval {
+			return fmt.Errorf("subscription %s: interval below %v", src.ID, minRefreshInterval)
+		}
+	}
+	if len(sources) > 0 && len(storePath) == 0 {
+		return errors.New("no profile store path")
+	}
+
+	v.subs.Lock()
+	defer v.subs.Unlock()
+	if v.subs.stop != nil {
+		close(v.subs.stop)
+		v.subs.stop = nil
+	}
+	v.subs.sources = sources
+	v.subs.storePath = storePath
+	if len(sources) == 0 {
+		return nil
+	}
+
+	store, err := loadProfileStore(storePath)
+	if err != nil {
+		return err
+	}
+	v.subs.stop = make(chan struct{})
+	for _, src := range sources {
+		last := time.Unix(store.Refreshed[src.ID], 0)
+		go v.refreshLoop(src, last, v.subs.stop)
+	}
+	log.Printf("subscriptions scheduled: %d", len(sources))
+	return nil
+}
+
+/*
+RefreshSubscription refresh a scheduled subscription now,
+return the JSON summary of added, removed and modified profile fingerprints.
+*/
+func (v *V2RayPoint) RefreshSubscription(id string) (string, error) {
+	v.subs.Lock()
+	var src *subscriptionSource
+	for _, s := range v.subs.sources {
+		if s.ID == id {
+			src = s
+		}
+	}
+	v.subs.Unlock()
+	if src == nil {
+		return "", fmt.Errorf("subscription %s is not scheduled", id)
+	}
+
+	summary := v.refreshSubscription(src)
+	v.emitRefreshSummary(summary)
+	if len(summary.Error) > 0 {
+		return "", errors.New(summary.Error)
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+/*GetStoredProfiles return the profile store as JSON*/
+func (v *V2RayPoint) GetStoredProfiles() (string, error) {
+	v.subs.store.Lock()
+	defer v.subs.store.Unlock()
+	store, err := loadProfileStore(v.profileStorePath())
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(store)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+/*SetProfileRemarks set user remarks of a stored profile, kept over refreshes*/
+func (v *V2RayPoint) SetProfileRemarks(fingerprint string, remarks string) error {
+	return v.updateStoredProfile(fingerprint, func(p *storedProfile) {
+		p.UserRemarks = remarks
+	})
+}
+
+/*AddProfileDelay add a delay test result to the history of a stored profile*/
+func (v *V2RayPoint) AddProfileDelay(fingerprint string, delayMs int64) error {
+	return v.updateStoredProfile(fingerprint, func(p *storedProfile) {
+		p.Delays = append(p.Delays, delayMs)
+		if len(p.Delays) > maxDelayHistory {
+			p.Delays = p.Delays[len(p.Delays)-maxDelayHistory:]
+		}
+	})
+}
+
+func (v *V2RayPoint) updateStoredProfile(fingerprint string, update func(p *storedProfile)) error {
+	v.subs.store.Lock()
+	defer v.subs.store.Unlock()
+	path := v.profileStorePath()
+	store, err := loadProfileStore(path)
+	if err != nil {
+		return err
+	}
+	for _, p := range store.Profiles {
+		if p.Fingerprint == fingerprint {
+			update(p)
+			return saveProfileStore(path, store)
+		}
+	}
+	return fmt.Errorf("no stored profile %s", fingerprint)
+}
+
+func (v *V2RayPoint) refreshLoop(src *subscriptionSource, last time.Time, stop chan struct{}) {
+	interval := time.Duration(src.Interval) * time.Second
+	wait := interval - time.Since(last)
+	failures := 0
+	for {
+		if wait < 0 {
+			wait = 0
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+
+		summary := v.refreshSubscription(src)
+		if len(summary.Error) == 0 {
+			failures = 0
+			wait = interval
+		} else {
+			// 1m, 2m, 4m ... but never later than the next regular refresh
+			wait = minRefreshInterval << failures
+			if wait > interval || wait <= 0 {
+				wait = interval
+			} else {
+				failures++
+			}
+			summary.RetryIn = int64(wait / time.Second)
+		}
+		select {
+		case <-stop:
+			return
+		default:
+			v.emitRefreshSummary(summary)
+		}
+	}
+}
+
+func (v *V2RayPoint) refreshSubscription(src *subscriptionSource) *refreshSummary {
+	summary := &refreshSummary{Subscription: src.ID}
+	result, err := v.fetchSubscription(src)
+	if err != nil {
+		log.Printf("subscription %s refresh failed: %v", src.ID, err)
+		summary.Error = err.Error()
+		return summary
+	}
+
+	v.subs.store.Lock()
+	defer v.subs.store.Unlock()
+	path := v.profileStorePath()
+	store, err := loadProfileStore(path)
+	if err == nil {
+		summary = mergeProfiles(store, src.ID, result.Profiles)
+		store.Refreshed[src.ID] = time.Now().Unix()
+		err = saveProfileStore(path, store)
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	return summary
+}
+
+func (v *V2RayPoint) emitRefreshSummary(summary *refreshSummary) {
+	if len(summary.Error) == 0 && len(summary.Added)+len(summary.Removed)+len(summary.Modified) == 0 {
+		return
+	}
+	b, _ := json.Marshal(summary)
+	v.SupportSet.OnEmitStatus(0, fmt.Sprintf("Subscription %s: %s", summary.Subscription, b))
+}
+
+func (v *V2RayPoint) fetchSubscription(src *subscriptionSource) (*subscriptionResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var inst *v2core.Instance
+	if src.ViaTunnel {
+		if inst, _ = v.runningCore(); inst == nil {
+			return nil, errors.New("tunnel is not running")
+		}
+	}
+	tr := &http.Transport{
+		TLSHandshakeTimeout: 10 * time.Second,
+		DisableKeepAlives:   true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dest, err := v2net.ParseDestination(fmt.Sprintf("%s:%s", network, addr))
+			if err != nil {
+				return nil, err
+			}
+			if !src.ViaTunnel {
+				return v.dialer.Dial(ctx, nil, dest, nil)
+			}
+			return v2core.Dial(ctx, inst, dest)
+		},
+	}
+	get := func(u string) (http.Header, []byte, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := (&http.Client{Transport: tr}).Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil, fmt.Errorf("status != 200: %s", resp.Status)
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxSubscriptionSize))
+		return resp.Header, body, err
+	}
+	header, body, err := get(src.URL)
+	if err != nil {
+		return nil, err
+	}
+	signature := ""
+	if len(src.SignatureHeader) > 0 {
+		signature = header.Get(src.SignatureHeader)
+	}
+	if len(src.SignatureURL) > 0 {
+		_, sig, err := get(src.SignatureURL)
+		if err != nil {
+			return nil, fmt.Errorf("signature: %v", err)
+		}
+		signature = string(sig)
+	}
+
+	result, err := loadSubscription(body, signature)
+	if err != nil {
+		return nil, err
+	}
+	// an empty list is much more likely a broken response than a real one
+	if len(result.Profiles) == 0 {
+		return nil, errors.New("no profiles in subscription")
+	}
+	return result, nil
+}
+
+// mergeProfiles replace profiles of subscription subID with fetched ones,
+// profiles keeping their fingerprint keep user remarks and delay history
+func mergeProfiles(store *profileStore, subID string, fetched []*subscriptionProfile) *refreshSummary {
+	summary := &refreshSummary{
+		Subscription: subID,
+		Added:        make([]string, 0),
+		Removed:      make([]string, 0),
+		Modified:     make([]string, 0),
+	}
+
+	old := make(map[string]*storedProfile)
+	profiles := make([]*storedProfile, 0, len(store.Profiles)+len(fetched))
+	for _, p := range store.Profiles {
+		if p.Subscription == subID {
+			old[p.Fingerprint] = p
+		} else {
+			profiles = append(profiles, p)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, f := range fetched {
+		if seen[f.Fingerprint] {
+			continue
+		}
+		seen[f.Fingerprint] = true
+		if p, ok := old[f.Fingerprint]; ok {
+			if p.subscriptionProfile != *f {
+				p.subscriptionProfile = *f
+				summary.Modified = append(summary.Modified, f.Fingerprint)
+			}
+			profiles = append(profiles, p)
+		} else {
+			profiles = append(profiles, &storedProfile{subscriptionProfile: *f, Subscription: subID})
+			summary.Added = append(summary.Added, f.Fingerprint)
+		}
+	}
+	for _, p := range store.Profiles {
+		if p.Subscription == subID && !seen[p.Fingerprint] {
+			summary.Removed = append(summary.Removed, p.Fingerprint)
+		}
+	}
+
+	store.Profiles = profiles
+	return summary
+}
+
+// profileStorePath return the store path set by SetSubscriptions
+func (v *V2RayPoint) profileStorePath() string {
+	v.subs.Lock()
+	defer v.subs.Unlock()
+	return v.subs.storePath
+}
+
+// loadProfileStore read the store at path, a missing file is an empty store
+func loadProfileStore(path string) (*profileStore, error) {
+	if len(path) == 0 {
+		return nil, errors.New("no profile store path")
+	}
+	store := &profileStore{}
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, store); err != nil {
+			return nil, err
+		}
+	}
+	if store.Profiles == nil {
+		store.Profiles = make([]*storedProfile, 0)
+	}
+	if store.Refreshed == nil {
+		store.Refreshed = make(map[string]int64)
+	}
+	return store, nil
+}
+
+// saveProfileStore write the store through a temp file, so a crash never leaves half of it
+func saveProfileStore(path string, store *profileStore) error {
+	b, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,156 @@
+package libv2ray
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportSubscription(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+
+	links := "vless://uuid@example.com:443?security=tls#node1\ntrojan://pass@1.2.3.4:8443#node2\n"
+	content := base64.StdEncoding.EncodeToString([]byte(links))
+	sign := func(k ed25519.PrivateKey, msg string) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(k, []byte(msg)))
+	}
+	envelope, _ := json.Marshal(&signedEnvelope{
+		Payload:   base64.StdEncoding.EncodeToString([]byte(content)),
+		Signature: sign(priv, content),
+	})
+
+	tests := []struct {
+		name      string
+		keys      string
+		content   string
+		signature string
+		wantErr   bool
+		verified  bool
+	}{
+		{"no keys, unsigned", "", content, "", false, false},
+		{"detached", base64.StdEncoding.EncodeToString(pub), content, sign(priv, content), false, true},
+		{"envelope", base64.StdEncoding.EncodeToString(pub), string(envelope), "", false, true},
+		{"unsigned", base64.StdEncoding.EncodeToString(pub), content, "", true, false},
+		{"wrong key", base64.StdEncoding.EncodeToString(pub), content, sign(otherPriv, content), true, false},
+		{"tampered", base64.StdEncoding.EncodeToString(pub), content + "Cg==", sign(priv, content), true, false},
+		// nothing to parse, even when unsigned content is taken
+		{"malformed envelope", "", `{"payload": "%%%", "signature": "x"}`, "", true, false},
+	}
+	defer SetSubscriptionPublisherKeys("")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetSubscriptionPublisherKeys(tt.keys); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ImportSubscription(tt.content, tt.signature)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ImportSubscription() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var result subscriptionResult
+			if err := json.Unmarshal([]byte(got), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Verification.Verified != tt.verified {
+				t.Errorf("verified = %v, want %v", result.Verification.Verified, tt.verified)
+			}
+			if len(result.Profiles) != 2 || result.Profiles[1].Address != "1.2.3.4" || result.Profiles[1].Port != 8443 {
+				t.Errorf("unexpected profiles: %s", got)
+			}
+		})
+	}
+}
+
+func TestRefreshSubscription(t *testing.T) {
+	links := "vless://uuid@example.com:443?security=tls#node1\ntrojan://pass@1.2.3.4:8443#node2\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(base64.StdEncoding.EncodeToString([]byte(links))))
+	}))
+	defer server.Close()
+
+	v := &V2RayPoint{dialer: NewPreotectedDialer(fakeSupportSet{})}
+	v.subs.storePath = filepath.Join(t.TempDir(), "profiles.json")
+	src := &subscriptionSource{ID: "sub", URL: server.URL}
+
+	summary := v.refreshSubscription(src)
+	if len(summary.Error) > 0 || len(summary.Added) != 2 {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+	vless, trojan := summary.Added[0], summary.Added[1]
+	if err := v.SetProfileRemarks(vless, "mine"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.AddProfileDelay(vless, 120); err != nil {
+		t.Fatal(err)
+	}
+
+	// transport and remarks change, the trojan server is gone, a vmess one is new
+	links = "vless://uuid@example.com:443?security=reality#renamed\n" +
+		"vmess://" + base64.StdEncoding.EncodeToString([]byte(`{"ps":"node3","add":"5.6.7.8","port":"443","id":"uuid"}`)) + "\n"
+	summary = v.refreshSubscription(src)
+	if len(summary.Added) != 1 || len(summary.Modified) != 1 || summary.Modified[0] != vless ||
+		len(summary.Removed) != 1 || summary.Removed[0] != trojan {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+
+	store, err := loadProfileStore(v.subs.storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := store.Profiles[0]
+	if p.Fingerprint != vless || p.Remarks != "renamed" || p.UserRemarks != "mine" || len(p.Delays) != 1 {
+		t.Errorf("user data not kept: %+v", p)
+	}
+
+	// a broken response must not wipe the store
+	links = ""
+	if summary = v.refreshSubscription(src); len(summary.Error) == 0 {
+		t.Error("expect error on empty subscription")
+	}
+	if store, _ = loadProfileStore(v.subs.storePath); len(store.Profiles) != 2 {
+		t.Errorf("store changed on failed refresh: %d profiles", len(store.Profiles))
+	}
+}
+
+func TestRefreshSubscriptionSigned(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	content := base64.StdEncoding.EncodeToString([]byte("trojan://pass@1.2.3.4:8443#node\n"))
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(content)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sig" {
+			w.Write([]byte(signature + "\n"))
+			return
+		}
+		w.Header().Set("X-Signature", signature)
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	if err := SetSubscriptionPublisherKeys(base64.StdEncoding.EncodeToString(pub)); err != nil {
+		t.Fatal(err)
+	}
+	defer SetSubscriptionPublisherKeys("")
+	v := &V2RayPoint{dialer: NewPreotectedDialer(fakeSupportSet{})}
+	v.subs.storePath = filepath.Join(t.TempDir(), "profiles.json")
+
+	sources := []*subscriptionSource{
+		{ID: "header", URL: server.URL, SignatureHeader: "X-Signature"},
+		{ID: "url", URL: server.URL, SignatureURL: server.URL + "/sig"},
+	}
+	for _, src := range sources {
+		if summary := v.refreshSubscription(src); len(summary.Error) > 0 || len(summary.Added) != 1 {
+			t.Errorf("%s: unexpected summary: %+v", src.ID, summary)
+		}
+	}
+	if summary := v.refreshSubscription(&subscriptionSource{ID: "unsigned", URL: server.URL}); len(summary.Error) == 0 {
+		t.Error("expect error on unsigned subscription")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -83,26 +84,61 @@ func NewPreotectedDialer(p protectSet) *ProtectedDialer {
 
 // ProtectedDialer ...
 type ProtectedDialer struct {
+	// server fields are swapped by Reset while dials are in flight
+	serverLock    sync.Mutex
 	currentServer string
 	resolveChan   chan struct{}
 	preferIPv6    bool
+	vServer       *resolved
 
-	vServer  *resolved
 	resolver *net.Resolver
 
+	// server IP that worked before a restart, tried first
+	preferred *serverState
+
+	// connections dialed, to be closed when network changed
+	conns     map[net.Conn]struct{}
+	connsLock sync.Mutex
+	pruneAt   int
+
 	protectSet
 }
 
 func (d *ProtectedDialer) IsVServerReady() bool {
-	return (d.vServer != nil)
+	_, vServer, _ := d.server()
+	return (vServer != nil)
 }
 
 func (d *ProtectedDialer) PrepareResolveChan() {
+	d.serverLock.Lock()
+	defer d.serverLock.Unlock()
 	d.resolveChan = make(chan struct{})
 }
 
 func (d *ProtectedDialer) ResolveChan() chan struct{} {
-	return d.resolveChan
+	_, _, ch := d.server()
+	return ch
+}
+
+// server return a snapshot of the server domain, its prepared result and the chan closed once prepared
+func (d *ProtectedDialer) server() (string, *resolved, chan struct{}) {
+	d.serverLock.Lock()
+	defer d.serverLock.Unlock()
+	return d.currentServer, d.vServer, d.resolveChan
+}
+
+// prefersIPv6 tell if IPv6 addresses of the server are tried first
+func (d *ProtectedDialer) prefersIPv6() bool {
+	d.serverLock.Lock()
+	defer d.serverLock.Unlock()
+	return d.preferIPv6
+}
+
+// setServer change the server domain, it is prepared by the next Reset
+func (d *ProtectedDialer) setServer(domainName string) {
+	d.serverLock.Lock()
+	defer d.serverLock.Unlock()
+	d.currentServer = domainName
 }
 
 // simplicated version of golang: internetAddrList in src/net/ipsock.go
@@ -135,10 +171,14 @@ func (d *ProtectedDialer) lookupAddr(addr string) (*resolved, error) {
 		return nil, fmt.Errorf("domain %s Failed to resolve", addr)
 	}
 
+	d.serverLock.Lock()
+	preferIPv6 := d.preferIPv6
+	d.serverLock.Unlock()
+
 	IPs := make([]net.IP, 0)
 	//ipv6 is prefer, append ipv6 then ipv4
 	//ipv6 is not prefer, append ipv4 then ipv6
-	if(d.preferIPv6) {
+	if(preferIPv6) {
 		for _, ia := range addrs {
 			if(ia.IP.To4() == nil) {
 				IPs = append(IPs, ia.IP)			 
@@ -150,7 +190,7 @@ func (d *ProtectedDialer) lookupAddr(addr string) (*resolved, error) {
 			IPs = append(IPs, ia.IP)	
 		}
 	}
-	if(!d.preferIPv6) {
+	if(!preferIPv6) {
 		for _, ia := range addrs {
 			if(ia.IP.To4() == nil) {
 				IPs = append(IPs, ia.IP)			 
@@ -171,8 +211,10 @@ func (d *ProtectedDialer) lookupAddr(addr string) (*resolved, error) {
 // PrepareDomain caches direct v2ray server host
 func (d *ProtectedDialer) PrepareDomain(domainName string, closeCh <-chan struct{}, prefIPv6 bool) {
 	log.Printf("Preparing Domain: %s", domainName)
+	d.serverLock.Lock()
 	d.currentServer = domainName
 	d.preferIPv6 = prefIPv6
+	d.serverLock.Unlock()
 
 	maxRetry := 10
 	for {
@@ -194,7 +236,15 @@ func (d *ProtectedDialer) PrepareDomain(domainName string, closeCh <-chan struct
 			continue
 		}
 
-		d.vServer = resolved
+		d.serverLock.Lock()
+		if p := d.preferred; p != nil && p.Domain == domainName {
+			resolved.selectIP(net.ParseIP(p.IP))
+		}
+		// the server may have changed while resolving
+		if d.currentServer == domainName {
+			d.vServer = resolved
+		}
+		d.serverLock.Unlock()
 		log.Printf("Prepare Result:\n Domain: %s\n Port: %d\n IPs: %v\n",
 			resolved.domain, resolved.Port, resolved.IPs)
 		return
@@ -224,21 +274,36 @@ func (d *ProtectedDialer) Dial(ctx context.Context,
 
 	network := dest.Network.SystemString()
 	Address := dest.NetAddr()
+	ctx, trace := startDialTrace(ctx, network, Address)
+
+	// sendThrough of the outbound, the default is left to the system
+	var local net.IP
+	if src != nil && src.Family().IsIP() && !src.IP().IsUnspecified() {
+		local = src.IP()
+	}
 
 	// v2ray server address,
 	// try to connect fixed IP if multiple IP parsed from domain,
 	// and switch to next IP if error occurred
-	if Address == d.currentServer {
-		if d.vServer == nil {
+	server, vServer, resolveChan := d.server()
+	if Address == server {
+		for vServer == nil {
 			log.Println("Dial pending prepare  ...", Address)
-			<-d.resolveChan
+			<-resolveChan
 
 			// user may close connection during PrepareDomain,
 			// fast return release resources.
-			if d.vServer == nil {
-				return nil, fmt.Errorf("fail to prepare domain %s", d.currentServer)
+			// wait again if the dialer was reset in the meantime
+			var next chan struct{}
+			server, vServer, next = d.server()
+			if vServer == nil && (next == resolveChan || server != Address) {
+				err := fmt.Errorf("fail to prepare domain %s", Address)
+				trace.fail(err)
+				return nil, err
 			}
+			resolveChan = next
 		}
+		trace.prepared()
 
 		// if time.Since(d.vServer.lastResolved) > time.Minute*30 {
 		// 	go d.PrepareDomain(Address, nil, d.preferIPv6)
@@ -249,10 +314,10 @@ func (d *ProtectedDialer) Dial(ctx context.Context,
 			return nil, err
 		}
 
-		curIP := d.vServer.currentIP()
-		conn, err := d.fdConn(ctx, curIP, d.vServer.Port, fd)
+		curIP := vServer.currentIP()
+		conn, err := d.fdConn(ctx, local, curIP, vServer.Port, fd)
 		if err != nil {
-			d.vServer.NextIP()
+			vServer.NextIP()
 			return nil, err
 		}
 		log.Printf("Using Prepared: %s", curIP)
@@ -263,8 +328,10 @@ func (d *ProtectedDialer) Dial(ctx context.Context,
 	log.Printf("Not Using Prepared: %s,%s", network, Address)
 	resolved, err := d.lookupAddr(Address)
 	if err != nil {
+		trace.fail(err)
 		return nil, err
 	}
+	trace.resolved(resolved.IPs)
 
 	fd, err := d.getFd(dest.Network)
 	if err != nil {
@@ -273,21 +340,99 @@ func (d *ProtectedDialer) Dial(ctx context.Context,
 
 	// use the first resolved address.
 	// the result IP may vary, eg: IPv6 addrs comes first if client has ipv6 address
-	return d.fdConn(ctx, resolved.IPs[0], resolved.Port, fd)
+	return d.fdConn(ctx, local, resolved.IPs[0], resolved.Port, fd)
+}
+
+// Reset flush the prepared server and close connections dialed on the old network,
+// then prepare the server domain again.
+func (d *ProtectedDialer) Reset(closeCh <-chan struct{}) {
+	ch := make(chan struct{})
+	d.serverLock.Lock()
+	d.resolveChan = ch
+	d.vServer = nil
+	server, preferIPv6 := d.currentServer, d.preferIPv6
+	d.serverLock.Unlock()
+	d.closeConns()
+
+	go func() {
+		d.PrepareDomain(server, closeCh, preferIPv6)
+		close(ch)
+	}()
+}
+
+func (d *ProtectedDialer) trackConn(conn net.Conn) {
+	d.connsLock.Lock()
+	defer d.connsLock.Unlock()
+
+	if d.conns == nil {
+		d.conns = make(map[net.Conn]struct{})
+	}
+	d.conns[conn] = struct{}{}
+
+	// conns are not wrapped, which keeps splice working,
+	// so closed ones are found by asking the fd from time to time
+	if len(d.conns) < d.pruneAt {
+		return
+	}
+	for c := range d.conns {
+		if sc, ok := c.(syscall.Conn); ok {
+			rc, err := sc.SyscallConn()
+			if err == nil {
+				err = rc.Control(func(uintptr) {})
+			}
+			if err != nil {
+				delete(d.conns, c)
+			}
+		}
+	}
+	d.pruneAt = 2 * len(d.conns)
+	if d.pruneAt < 64 {
+		d.pruneAt = 64
+	}
+}
+
+func (d *ProtectedDialer) closeConns() {
+	d.connsLock.Lock()
+	conns := d.conns
+	d.conns = nil
+	d.pruneAt = 0
+	d.connsLock.Unlock()
+
+	for c := range conns {
+		c.Close()
+	}
+	log.Printf("closed %d stale connections", len(conns))
 }
 
 func (d *ProtectedDialer) DestIpAddress() net.IP {
-	return d.vServer.currentIP()
+	_, vServer, _ := d.server()
+	if vServer == nil {
+		return nil
+	}
+	return vServer.currentIP()
 }
 
-func (d *ProtectedDialer) fdConn(ctx context.Context, ip net.IP, port int, fd int) (net.Conn, error) {
+func (d *ProtectedDialer) fdConn(ctx context.Context, local net.IP, ip net.IP, port int, fd int) (net.Conn, error) {
 
 	defer unix.Close(fd)
 
+	trace := dialTraceFromContext(ctx)
+
 	// call android VPN service to "protect" the fd connecting straight out
 	if !d.Protect(fd) {
 		log.Printf("fdConn fail to protect, Close Fd: %d", fd)
-		return nil, errors.New("fail to protect")
+		err := errors.New("fail to protect")
+		trace.fail(err)
+		return nil, err
+	}
+	trace.protected()
+
+	if local != nil {
+		if err := bindFd(fd, local, ip); err != nil {
+			log.Printf("fdConn bind err, Close Fd: %d Err: %v", fd, err)
+			trace.fail(err)
+			return nil, err
+		}
 	}
 
 	sa := &unix.SockaddrInet6{
@@ -295,10 +440,13 @@ func (d *ProtectedDialer) fdConn(ctx context.Context, ip net.IP, port int, fd in
 	}
 	copy(sa.Addr[:], ip.To16())
 
+	start := time.Now()
 	if err := unix.Connect(fd, sa); err != nil {
 		log.Printf("fdConn unix.Connect err, Close Fd: %d Err: %v", fd, err)
+		trace.fail(err)
 		return nil, err
 	}
+	trace.connected(ip, time.Since(start))
 
 	file := os.NewFile(uintptr(fd), "Socket")
 	if file == nil {
@@ -314,5 +462,23 @@ func (d *ProtectedDialer) fdConn(ctx context.Context, ip net.IP, port int, fd in
 		return nil, err
 	}
 
+	d.trackConn(conn)
 	return conn, nil
 }
+
+// bindFd bind the dual stack socket to a local address before connecting to ip,
+// IPv4 addresses are bound as IPv4-mapped IPv6 ones
+func bindFd(fd int, local net.IP, ip net.IP) error {
+	if (local.To4() == nil) != (ip.To4() == nil) {
+		return fmt.Errorf("sendThrough %s can not reach %s of another IP family", local, ip)
+	}
+	sa := &unix.SockaddrInet6{}
+	copy(sa.Addr[:], local.To16())
+	if err := unix.Bind(fd, sa); err != nil {
+		if errors.Is(err, unix.EADDRNOTAVAIL) {
+			return fmt.Errorf("sendThrough %s is not an address of this host", local)
+		}
+		return fmt.Errorf("sendThrough %s: %v", local, err)
+	}
+	return nil
+}
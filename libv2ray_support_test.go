@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"net"
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -149,3 +151,124 @@ func Test_resolved_NextIP(t *testing.T) {
 		})
 	}
 }
+
+func TestProtectedDialer_DialSendThrough(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn.RemoteAddr()
+			conn.Close()
+		}
+	}()
+	dest, _ := v2net.ParseDestination("tcp:" + l.Addr().String())
+
+	tests := []struct {
+		name    string
+		src     v2net.Address
+		want    string
+		wantErr bool
+	}{
+		{"loopback alias", v2net.ParseAddress("127.0.0.2"), "127.0.0.2", false},
+		{"another loopback alias", v2net.ParseAddress("127.1.2.3"), "127.1.2.3", false},
+		{"unspecified", v2net.AnyIP, "127.0.0.1", false},
+		{"not on host", v2net.ParseAddress("192.0.2.1"), "", true},
+		{"other family", v2net.ParseAddress("::1"), "", true},
+	}
+	d := NewPreotectedDialer(fakeSupportSet{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := d.Dial(context.Background(), tt.src, dest, nil)
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("expect error")
+				}
+				t.Log(err)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			remote := (<-accepted).(*net.TCPAddr)
+			if remote.IP.String() != tt.want {
+				t.Errorf("connected from %v, want %s", remote.IP, tt.want)
+			}
+		})
+	}
+}
+
+func TestProtectedDialer_Reset(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	server := l.Addr().String()
+	dest, _ := v2net.ParseDestination("tcp:" + server)
+
+	closeCh := make(chan struct{})
+	defer close(closeCh)
+	d := NewPreotectedDialer(fakeSupportSet{})
+	d.PrepareResolveChan()
+	d.PrepareDomain(server, closeCh, false)
+	close(d.ResolveChan())
+
+	conn, err := d.Dial(context.Background(), nil, dest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Reset(closeCh)
+	// connections of the old network are closed
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Errorf("connection still open after reset: %v", err)
+	}
+
+	// dials in flight while resetting wait for the server to be prepared again
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 10; n++ {
+				conn, err := d.Dial(context.Background(), nil, dest, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.Close()
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		d.Reset(closeCh)
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	<-d.ResolveChan()
+	if ip := d.DestIpAddress(); !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("prepared %v", ip)
+	}
+}
@@ -0,0 +1,518 @@
+package libv2ray
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	v2net "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	v2core "github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/dns"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/features/routing"
+	routing_session "github.com/xtls/xray-core/features/routing/session"
+)
+
+// dialTrace records what ProtectedDialer did for a traced request,
+// it is written by dialing goroutines, read a copy from snapshot
+type dialTrace struct {
+	mu sync.Mutex
+
+	Network   string   `json:"network"`
+	Address   string   `json:"address"`
+	Prepared  bool     `json:"prepared"`
+	Resolved  []string `json:"resolved,omitempty"`
+	IP        string   `json:"ip,omitempty"`
+	Protected bool     `json:"protected"`
+	ConnectMs int64    `json:"connectMs"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type dialTracer struct {
+	sync.Mutex
+	dials []*dialTrace
+}
+
+type dialTracerKey struct{}
+type dialTraceKey struct{}
+
+// startDialTrace return a context carrying a new dialTrace if dials of ctx are traced
+func startDialTrace(ctx context.Context, network string, address string) (context.Context, *dialTrace) {
+	tracer, _ := ctx.Value(dialTracerKey{}).(*dialTracer)
+	if tracer == nil {
+		return ctx, nil
+	}
+	t := &dialTrace{Network: network, Address: address}
+	tracer.Lock()
+	tracer.dials = append(tracer.dials, t)
+	tracer.Unlock()
+	return context.WithValue(ctx, dialTraceKey{}, t), t
+}
+
+func dialTraceFromContext(ctx context.Context) *dialTrace {
+	t, _ := ctx.Value(dialTraceKey{}).(*dialTrace)
+	return t
+}
+
+func (t *dialTrace) prepared() {
+	if t != nil {
+		t.mu.Lock()
+		t.Prepared = true
+		t.mu.Unlock()
+	}
+}
+
+func (t *dialTrace) resolved(ips []net.IP) {
+	if t != nil {
+		t.mu.Lock()
+		for _, ip := range ips {
+			t.Resolved = append(t.Resolved, ip.String())
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *dialTrace) protected() {
+	if t != nil {
+		t.mu.Lock()
+		t.Protected = true
+		t.mu.Unlock()
+	}
+}
+
+func (t *dialTrace) connected(ip net.IP, elapsed time.Duration) {
+	if t != nil {
+		t.mu.Lock()
+		t.IP = ip.String()
+		t.ConnectMs = elapsed.Milliseconds()
+		t.mu.Unlock()
+	}
+}
+
+func (t *dialTrace) fail(err error) {
+	if t != nil {
+		t.mu.Lock()
+		t.Error = err.Error()
+		t.mu.Unlock()
+	}
+}
+
+// snapshot copy what was traced so far, the dial may still be going on
+func (t *dialTrace) snapshot() *dialTrace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &dialTrace{
+		Network:   t.Network,
+		Address:   t.Address,
+		Prepared:  t.Prepared,
+		Resolved:  append([]string(nil), t.Resolved...),
+		IP:        t.IP,
+		Protected: t.Protected,
+		ConnectMs: t.ConnectMs,
+		Error:     t.Error,
+	}
+}
+
+// outboundTrace records what outbounds and their filters did with a traced request,
+// it is written by dispatching goroutines
+type outboundTrace struct {
+	sync.Mutex
+	tags       []string
+	route      routing.Route
+	routed     bool
+	expression *expressionRule
+	smart      map[string]interface{}
+}
+
+type outboundTraceKey struct{}
+
+// tracedRequests map the outbound session of traced requests to their traces,
+// routers see no context.Context to find them in
+var tracedRequests sync.Map
+
+// tracedRequest return the trace of a request being routed, nil if it is not traced
+func tracedRequest(ctx *routing_session.Context) *outboundTrace {
+	if ctx == nil || ctx.Outbound == nil {
+		return nil
+	}
+	t, _ := tracedRequests.Load(ctx.Outbound)
+	trace, _ := t.(*outboundTrace)
+	return trace
+}
+
+func outboundTraceFromContext(ctx context.Context) *outboundTrace {
+	t, _ := ctx.Value(outboundTraceKey{}).(*outboundTrace)
+	return t
+}
+
+// dispatched record the outbound the request is handed to
+func (t *outboundTrace) dispatched(tag string) {
+	if t != nil {
+		t.Lock()
+		t.tags = append(t.tags, tag)
+		t.Unlock()
+	}
+}
+
+// picked record the route the dispatcher picked, nil if no rule matched
+func (t *outboundTrace) picked(route routing.Route) {
+	if t != nil {
+		t.Lock()
+		t.route, t.routed = route, true
+		t.Unlock()
+	}
+}
+
+// tracingRouter is the router the dispatcher picks routes from,
+// it records them for traced requests
+type tracingRouter struct {
+	routing.Router
+}
+
+// PickRoute implements routing.Router.
+func (r *tracingRouter) PickRoute(ctx routing.Context) (routing.Route, error) {
+	route, err := r.Router.PickRoute(ctx)
+	if sc, ok := ctx.(*routing_session.Context); ok {
+		tracedRequest(sc).picked(route)
+	}
+	return route, err
+}
+
+// expressionRouted record the expression rule that routed the request
+func (t *outboundTrace) expressionRouted(rule *expressionRule) {
+	if t != nil {
+		t.Lock()
+		t.expression = rule
+		t.Unlock()
+	}
+}
+
+// smartRouted record where smart routing sent the request, and why
+func (t *outboundTrace) smartRouted(tag string, reason string) {
+	if t != nil {
+		t.Lock()
+		t.smart = map[string]interface{}{"outboundTag": tag, "reason": reason}
+		t.Unlock()
+	}
+}
+
+// outboundErrors collects errors outbounds submit for the traced request
+type outboundErrors struct {
+	sync.Mutex
+	errs []string
+}
+
+func (e *outboundErrors) SubmitError(err error) {
+	e.Lock()
+	e.errs = append(e.errs, err.Error())
+	e.Unlock()
+}
+
+type traceOptions struct {
+	InboundTag string `json:"inboundTag"`
+	TLS        *bool  `json:"tls"`
+	SNI        string `json:"sni"`
+	Insecure   bool   `json:"insecure"`
+	Path       string `json:"path"`
+	Sniffing   *bool  `json:"sniffing"`
+	RouteOnly  bool   `json:"routeOnly"`
+	TimeoutMs  int64  `json:"timeoutMs"`
+}
+
+type traceStep struct {
+	Step      string                 `json:"step"`
+	OK        bool                   `json:"ok"`
+	ElapsedMs int64                  `json:"elapsedMs,omitempty"`
+	Detail    map[string]interface{} `json:"detail,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+}
+
+type requestTrace struct {
+	Destination string       `json:"destination"`
+	Steps       []*traceStep `json:"steps"`
+	Outcome     string       `json:"outcome"`
+	OK          bool         `json:"ok"`
+	TotalMs     int64        `json:"totalMs"`
+}
+
+func (r *requestTrace) add(step string, err error, elapsed time.Duration, detail map[string]interface{}) {
+	s := &traceStep{Step: step, OK: err == nil, ElapsedMs: elapsed.Milliseconds(), Detail: detail}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	r.Steps = append(r.Steps, s)
+}
+
+/*
+TraceRequest Run a synthetic request to destination (host:port) through the running core,
+and return a JSON trace of sniffing, DNS, routing, outbound, protected dial,
+TLS handshake and the HTTP outcome.
+optionsJSON may set inboundTag, tls, sni, insecure, path, sniffing, routeOnly and timeoutMs.
+*/
+func (v *V2RayPoint) TraceRequest(destination string, optionsJSON string) string {
+	trace := &requestTrace{Destination: destination, Steps: make([]*traceStep, 0)}
+	finish := func(err error, outcome string) string {
+		if err != nil {
+			trace.Outcome = err.Error()
+		} else {
+			trace.OK = true
+			trace.Outcome = outcome
+		}
+		b, _ := json.Marshal(trace)
+		return string(b)
+	}
+
+	inst, config := v.runningCore()
+	if inst == nil || config == nil {
+		return finish(errors.New("core not running"), "")
+	}
+
+	opts := &traceOptions{Path: "/", TimeoutMs: 10000}
+	if len(optionsJSON) > 0 {
+		if err := json.Unmarshal([]byte(optionsJSON), opts); err != nil {
+			return finish(err, "")
+		}
+	}
+	if !strings.HasPrefix(destination, "tcp:") && !strings.HasPrefix(destination, "udp:") {
+		destination = "tcp:" + destination
+	}
+	dest, err := v2net.ParseDestination(destination)
+	if err != nil {
+		return finish(err, "")
+	}
+	if dest.Network != v2net.Network_TCP {
+		return finish(errors.New("only tcp destinations can be traced"), "")
+	}
+	useTLS := dest.Port == 443
+	if opts.TLS != nil {
+		useTLS = *opts.TLS
+	}
+	trace.Destination = dest.String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.TimeoutMs)*time.Millisecond)
+	defer cancel()
+
+	ob := &session.Outbound{}
+	content := &session.Content{
+		SniffingRequest: session.SniffingRequest{
+			Enabled:                        opts.Sniffing == nil || *opts.Sniffing,
+			OverrideDestinationForProtocol: []string{"http", "tls"},
+			RouteOnly:                      opts.RouteOnly,
+		},
+	}
+	ctx = session.ContextWithOutbound(ctx, ob)
+	ctx = session.ContextWithContent(ctx, content)
+	if len(opts.InboundTag) > 0 {
+		ctx = session.ContextWithInbound(ctx, &session.Inbound{
+			Tag:    opts.InboundTag,
+			Source: v2net.TCPDestination(v2net.LocalHostIP, 0),
+		})
+	}
+	tracer := &dialTracer{}
+	ctx = context.WithValue(ctx, dialTracerKey{}, tracer)
+	obTrace := &outboundTrace{}
+	ctx = context.WithValue(ctx, outboundTraceKey{}, obTrace)
+	tracedRequests.Store(ob, obTrace)
+	defer tracedRequests.Delete(ob)
+	obErrs := &outboundErrors{}
+	ctx = session.TrackedConnectionError(ctx, obErrs)
+
+	// the request goes first, the steps before it are known only after sniffing
+	start := time.Now()
+	conn, dialErr := v2core.Dial(ctx, inst, dest)
+	if dialErr == nil {
+		go func() {
+			<-ctx.Done()
+			conn.Close()
+		}()
+	}
+
+	var handshakeErr error
+	var handshakeElapsed time.Duration
+	handshakeDetail := map[string]interface{}{"tls": useTLS}
+	host := dest.Address.String()
+	if useTLS && dialErr == nil {
+		sni := opts.SNI
+		if len(sni) == 0 && dest.Address.Family().IsDomain() {
+			sni = host
+		}
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: opts.Insecure || len(sni) == 0,
+			NextProtos:         []string{"http/1.1"},
+		})
+		hsStart := time.Now()
+		handshakeErr = tlsConn.HandshakeContext(ctx)
+		handshakeElapsed = time.Since(hsStart)
+		if handshakeErr == nil {
+			state := tlsConn.ConnectionState()
+			handshakeDetail["version"] = tls.VersionName(state.Version)
+			handshakeDetail["alpn"] = state.NegotiatedProtocol
+			handshakeDetail["cipher"] = tls.CipherSuiteName(state.CipherSuite)
+		}
+		conn = tlsConn
+	}
+
+	var resp *http.Response
+	respErr := dialErr
+	if respErr == nil {
+		respErr = handshakeErr
+	}
+	if respErr == nil {
+		req, _ := http.NewRequest("HEAD", opts.Path, nil)
+		req.Host = host
+		req.Close = true
+		if respErr = req.Write(conn); respErr == nil {
+			resp, respErr = http.ReadResponse(bufio.NewReader(conn), req)
+		}
+	}
+	total := time.Since(start)
+	if conn != nil {
+		conn.Close()
+	}
+	// the steps traced so far are told even if the request never got out
+
+	// sniffing
+	sniffDetail := map[string]interface{}{
+		"protocol": content.Protocol,
+		"target":   ob.Target.String(),
+	}
+	if ob.RouteTarget.IsValid() {
+		sniffDetail["routeTarget"] = ob.RouteTarget.String()
+	}
+	var sniffErr error
+	if content.SniffingRequest.Enabled && len(content.Protocol) == 0 {
+		sniffErr = errors.New("nothing sniffed")
+	}
+	trace.add("sniff", sniffErr, 0, sniffDetail)
+
+	// dns, as xray itself would resolve the domain
+	domain := ""
+	if ob.RouteTarget.IsValid() && ob.RouteTarget.Address.Family().IsDomain() {
+		domain = ob.RouteTarget.Address.Domain()
+	} else if ob.Target.Address != nil && ob.Target.Address.Family().IsDomain() {
+		domain = ob.Target.Address.Domain()
+	}
+	if len(domain) > 0 {
+		if client, ok := inst.GetFeature(dns.ClientType()).(dns.Client); ok {
+			dnsStart := time.Now()
+			ips, err := client.LookupIP(domain, dns.IPOption{IPv4Enable: true, IPv6Enable: true})
+			addrs := make([]string, 0, len(ips))
+			for _, ip := range ips {
+				addrs = append(addrs, ip.String())
+			}
+			trace.add("dns", err, time.Since(dnsStart), map[string]interface{}{"domain": domain, "ips": addrs})
+		}
+	}
+
+	// routing, as the dispatch went through expression rules, xray rules and smart routing
+	obTrace.Lock()
+	route, routed, expression, smart := obTrace.route, obTrace.routed, obTrace.expression, obTrace.smart
+	tags := append([]string(nil), obTrace.tags...)
+	obTrace.Unlock()
+	if routed {
+		trace.add(traceRoute(config, route, expression, smart))
+	}
+
+	// outbound, the last one handed the request carried it
+	outDetail := map[string]interface{}{}
+	var outErr error
+	ohm := inst.GetFeature(outbound.ManagerType()).(outbound.Manager)
+	if len(tags) > 0 {
+		outDetail["tag"] = tags[len(tags)-1]
+		if len(tags) > 1 {
+			outDetail["path"] = tags
+		}
+	} else if h := ohm.GetDefaultHandler(); h != nil && routed {
+		// an untagged default outbound has no filters to tell
+		outDetail["tag"] = h.Tag()
+		outDetail["default"] = true
+	}
+	for _, tag := range tags {
+		if b, ok := unfiltered(ohm.GetHandler(tag)).(*libBalancer); ok {
+			outDetail["strategy"] = b.strategyTyp
+			outDetail["candidates"] = b.Candidates()
+			break
+		}
+	}
+	if tag, _ := outDetail["tag"].(string); len(tag) > 0 {
+		for _, o := range config.json.OutboundConfigs {
+			if o.Tag == tag {
+				outDetail["protocol"] = o.Protocol
+			}
+		}
+	}
+	obErrs.Lock()
+	if len(obErrs.errs) > 0 {
+		outDetail["errors"] = obErrs.errs
+		outErr = errors.New(obErrs.errs[0])
+	}
+	obErrs.Unlock()
+	trace.add("outbound", outErr, 0, outDetail)
+
+	// protected dials, a proxy outbound dials its server, freedom dials the destination
+	tracer.Lock()
+	for _, traced := range tracer.dials {
+		d := traced.snapshot()
+		var err error
+		if len(d.Error) > 0 {
+			err = errors.New(d.Error)
+		}
+		trace.add("dial", err, time.Duration(d.ConnectMs)*time.Millisecond, map[string]interface{}{
+			"network":   d.Network,
+			"address":   d.Address,
+			"prepared":  d.Prepared,
+			"resolved":  d.Resolved,
+			"ip":        d.IP,
+			"protected": d.Protected,
+		})
+	}
+	tracer.Unlock()
+
+	if useTLS && dialErr == nil {
+		trace.add("handshake", handshakeErr, handshakeElapsed, handshakeDetail)
+	}
+
+	trace.TotalMs = total.Milliseconds()
+	if respErr != nil {
+		return finish(respErr, "")
+	}
+	resp.Body.Close()
+	return finish(nil, fmt.Sprintf("HTTP %s", resp.Status))
+}
+
+// traceRoute tell the route the dispatcher picked, by an expression rule if one did,
+// else where smart routing sent a request no rule matched
+func traceRoute(config *coreConfig, route routing.Route, expression *expressionRule, smart map[string]interface{}) (string, error, time.Duration, map[string]interface{}) {
+	if expression != nil {
+		return "route", nil, 0, map[string]interface{}{
+			"matched":     true,
+			"expression":  true,
+			"ruleTag":     expression.ruleTag,
+			"outboundTag": expression.outboundTag,
+		}
+	}
+	if route != nil {
+		return "route", nil, 0, map[string]interface{}{
+			"matched":     true,
+			"outboundTag": route.GetOutboundTag(),
+		}
+	}
+	detail := map[string]interface{}{"matched": false}
+	if rc := config.json.RouterConfig; rc != nil && rc.DomainStrategy != nil {
+		detail["domainStrategy"] = *rc.DomainStrategy
+	}
+	if smart != nil {
+		detail["smart"] = smart
+	}
+	return "route", nil, 0, detail
+}
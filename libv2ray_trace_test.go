@@ -0,0 +1,218 @@
+package libv2ray
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v2net "github.com/xtls/xray-core/common/net"
+)
+
+func TestDialTrace(t *testing.T) {
+	// untraced dials cost nothing and must not panic
+	ctx, trace := startDialTrace(context.Background(), "tcp", "example.com:443")
+	if trace != nil || dialTraceFromContext(ctx) != nil {
+		t.Fatal("expect no trace")
+	}
+	trace.prepared()
+	trace.fail(errors.New("x"))
+
+	tracer := &dialTracer{}
+	ctx = context.WithValue(context.Background(), dialTracerKey{}, tracer)
+	ctx, trace = startDialTrace(ctx, "tcp", "example.com:443")
+	if dialTraceFromContext(ctx) != trace {
+		t.Fatal("trace not in context")
+	}
+	trace.prepared()
+	trace.resolved([]net.IP{net.ParseIP("1.2.3.4")})
+	trace.protected()
+	trace.connected(net.ParseIP("1.2.3.4"), 20*time.Millisecond)
+
+	if len(tracer.dials) != 1 {
+		t.Fatalf("expect 1 dial, got %d", len(tracer.dials))
+	}
+	d := tracer.dials[0].snapshot()
+	if !d.Prepared || !d.Protected || d.IP != "1.2.3.4" || d.ConnectMs != 20 || len(d.Error) > 0 {
+		t.Errorf("unexpected trace: %+v", d)
+	}
+}
+
+func TestTraceRequestNotRunning(t *testing.T) {
+	v := &V2RayPoint{}
+	var result requestTrace
+	if err := json.Unmarshal([]byte(v.TraceRequest("example.com:443", "")), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.OK || result.Outcome != "core not running" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+func TestDialTraceProtectedDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	tracer := &dialTracer{}
+	ctx := context.WithValue(context.Background(), dialTracerKey{}, tracer)
+	d := NewPreotectedDialer(fakeSupportSet{})
+	var wg sync.WaitGroup
+	for _, address := range []string{l.Addr().String(), fmt.Sprintf("127.0.0.1:%d", closedPort(t))} {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			dest, _ := v2net.ParseDestination("tcp:" + address)
+			if conn, err := d.Dial(ctx, nil, dest, nil); err == nil {
+				conn.Close()
+			}
+		}(address)
+	}
+	// traces are read while dials write them
+	dialed := waitGroupDone(&wg)
+	for done := false; !done; {
+		select {
+		case <-dialed:
+			done = true
+		default:
+		}
+		tracer.Lock()
+		for _, d := range tracer.dials {
+			d := d.snapshot()
+			json.Marshal(d)
+		}
+		tracer.Unlock()
+	}
+
+	if len(tracer.dials) != 2 {
+		t.Fatalf("expect 2 dials, got %d", len(tracer.dials))
+	}
+	for _, traced := range tracer.dials {
+		d := traced.snapshot()
+		if d.Address == l.Addr().String() {
+			if !d.Protected || d.IP != "127.0.0.1" || len(d.Resolved) != 1 || len(d.Error) > 0 {
+				t.Errorf("dial %+v", d)
+			}
+		} else if !d.Protected || len(d.IP) > 0 || !strings.Contains(d.Error, "refused") {
+			t.Errorf("dial to closed port %+v", d)
+		}
+	}
+}
+
+func waitGroupDone(wg *sync.WaitGroup) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+func TestTraceRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	support := &recordingSupportSet{}
+	v := newTestPoint(support)
+	// an expression rule for the traced inbound, a balancer for the rest
+	v.ConfigureFileContent = fmt.Sprintf(`{
+		"outbounds": [
+			{"tag": "block", "protocol": "blackhole"},
+			{"tag": "proxy-a", "protocol": "freedom"},
+			{"tag": "proxy-b", "protocol": "freedom"},
+			{"tag": "dead", "protocol": "freedom", "settings": {"redirect": "127.0.0.1:%d"}},
+			{"tag": "auto", "protocol": "fallback", "settings": {"outbounds": ["dead", "proxy-a"]}}
+		],
+		"routing": {
+			"balancers": [{"tag": "bal", "selector": ["proxy-"]}],
+			"rules": [
+				{"type": "expression", "expression": "inbound == 'trace' && port == %s", "outboundTag": "proxy-b", "ruleTag": "traced"},
+				{"type": "field", "inboundTag": ["retry"], "outboundTag": "auto"},
+				{"type": "field", "inboundTag": ["blocked"], "outboundTag": "block"},
+				{"type": "field", "port": "%s", "balancerTag": "bal"}
+			]
+		}
+	}`, closedPort(t), port, port)
+	if err := v.RunLoop(false); err != nil {
+		t.Fatal(err)
+	}
+	defer v.StopLoop()
+
+	traceRequest := func(options string) map[string]*traceStep {
+		t.Helper()
+		var result requestTrace
+		if err := json.Unmarshal([]byte(v.TraceRequest(server.Listener.Addr().String(), options)), &result); err != nil {
+			t.Fatal(err)
+		}
+		if !result.OK || result.Outcome != "HTTP 200 OK" {
+			t.Fatalf("unexpected result: %+v", result)
+		}
+		steps := make(map[string]*traceStep)
+		for _, step := range result.Steps {
+			steps[step.Step] = step
+		}
+		if steps["route"] == nil || steps["outbound"] == nil {
+			t.Fatalf("steps missing: %+v", result.Steps)
+		}
+		return steps
+	}
+
+	steps := traceRequest(`{"inboundTag": "trace", "sniffing": false}`)
+	if route := steps["route"].Detail; route["expression"] != true || route["ruleTag"] != "traced" {
+		t.Errorf("route %v", route)
+	}
+	if out := steps["outbound"].Detail; out["tag"] != "proxy-b" || out["protocol"] != "freedom" {
+		t.Errorf("outbound %v", out)
+	}
+
+	// without an inbound expressions do not apply, the balancer picks
+	steps = traceRequest(`{"sniffing": false}`)
+	if route := steps["route"].Detail; route["expression"] != nil || route["outboundTag"] != steps["outbound"].Detail["tag"] {
+		t.Errorf("route %v", route)
+	}
+	if out := steps["outbound"].Detail; out["tag"] != "proxy-a" && out["tag"] != "proxy-b" {
+		t.Errorf("outbound %v", out)
+	}
+
+	// the outbound is the one that carried the request, after the fallback group retried
+	steps = traceRequest(`{"inboundTag": "retry", "sniffing": false}`)
+	if route := steps["route"].Detail; route["outboundTag"] != "auto" {
+		t.Errorf("route %v", route)
+	}
+	out := steps["outbound"].Detail
+	if path := fmt.Sprint(out["path"]); out["tag"] != "proxy-a" || path != "[auto dead proxy-a]" {
+		t.Errorf("outbound %v", out)
+	}
+
+	// a failed request still tells how far it went
+	var result requestTrace
+	if err := json.Unmarshal([]byte(v.TraceRequest(server.Listener.Addr().String(), `{"inboundTag": "blocked", "sniffing": false}`)), &result); err != nil {
+		t.Fatal(err)
+	}
+	steps = make(map[string]*traceStep)
+	for _, step := range result.Steps {
+		steps[step.Step] = step
+	}
+	if result.OK || steps["route"] == nil || steps["route"].Detail["outboundTag"] != "block" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
@@ -0,0 +1,121 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// sun_path of sockaddr_un, including the terminating zero
+const maxUnixPathLen = 108
+
+/*
+AddUnixSocketInbound add a local socks or http inbound listening on a Unix domain socket,
+reachable only by who can open path, no TCP port to conflict over or to leak.
+path is absolute for the filesystem, or "@name" for the Linux abstract namespace.
+perm is the octal mode of the socket file like 0600, 0 keeps the umask default;
+abstract sockets have no permission. The inbound is tagged "<protocol>-unix" and
+sniffs as the first inbound of content does.
+*/
+func AddUnixSocketInbound(content string, protocol string, path string, perm int) (string, error) {
+	protocol = strings.ToLower(protocol)
+	var settings map[string]interface{}
+	switch protocol {
+	case "socks":
+		// UDP ASSOCIATE needs an IP address to relay from
+		settings = map[string]interface{}{"auth": "noauth", "udp": false}
+	case "http":
+		settings = map[string]interface{}{}
+	default:
+		return "", fmt.Errorf("unsupported local inbound protocol %q", protocol)
+	}
+	if err := checkUnixSocketPath(path, perm); err != nil {
+		return "", err
+	}
+
+	m, err := decodeConfigMap(content)
+	if err != nil {
+		return "", err
+	}
+	inbounds, _ := m["inbounds"].([]interface{})
+	listen := path
+	if perm != 0 {
+		listen = fmt.Sprintf("%s,%04o", path, perm)
+	}
+	tag := protocol + "-unix"
+	inbound := map[string]interface{}{
+		"tag":      tag,
+		"listen":   listen,
+		"protocol": protocol,
+		"settings": settings,
+	}
+	if len(inbounds) > 0 {
+		if first, ok := inbounds[0].(map[string]interface{}); ok && first["sniffing"] != nil {
+			inbound["sniffing"] = first["sniffing"]
+		}
+	}
+	m["inbounds"] = mergeTagged(inbounds, []interface{}{inbound}, true)
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func checkUnixSocketPath(path string, perm int) error {
+	switch {
+	case len(path) < 2:
+		return fmt.Errorf("invalid unix socket path %q", path)
+	case len(path) >= maxUnixPathLen:
+		return fmt.Errorf("unix socket path longer than %d bytes", maxUnixPathLen-1)
+	case strings.Contains(path, ","):
+		return fmt.Errorf("unix socket path %q contains comma", path)
+	case perm < 0 || perm > 0o777:
+		return fmt.Errorf("invalid permission %o", perm)
+	case path[0] == '@':
+		if perm != 0 {
+			return errors.New("abstract unix socket has no permission")
+		}
+		return nil
+	case !filepath.IsAbs(path):
+		return fmt.Errorf("unix socket path %q is not absolute", path)
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+		return fmt.Errorf("no directory for unix socket %q", path)
+	}
+	return nil
+}
+
+// removeStaleSockets delete socket files of filesystem unix inbounds nobody listens on,
+// left behind when the process was killed, or listening on them fails
+func (c *coreConfig) removeStaleSockets() {
+	for _, ib := range c.json.InboundConfigs {
+		if ib.ListenOn == nil || !ib.ListenOn.Family().IsDomain() {
+			continue
+		}
+		path := strings.Split(ib.ListenOn.Domain(), ",")[0]
+		if !filepath.IsAbs(path) {
+			continue
+		}
+		if info, err := os.Lstat(path); err != nil || info.Mode()&os.ModeSocket == 0 {
+			continue
+		}
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			continue
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			log.Printf("remove stale unix socket %s", path)
+			os.Remove(path)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package libv2ray
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	v2core "github.com/xtls/xray-core/core"
+)
+
+func TestAddUnixSocketInbound(t *testing.T) {
+	base := `{"inbounds": [{"tag": "socks", "port": 10808, "listen": "127.0.0.1", "protocol": "socks",
+		"sniffing": {"enabled": true, "destOverride": ["http", "tls"]}}],
+		"outbounds": [{"tag": "direct", "protocol": "freedom"}]}`
+	content, err := AddUnixSocketInbound(base, "SOCKS", "/tmp/xray.sock", 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// adding again replaces it
+	if content, err = AddUnixSocketInbound(content, "socks", "/tmp/xray.sock", 0o660); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadCoreConfig(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ibs := config.json.InboundConfigs
+	if len(ibs) != 2 || ibs[1].Tag != "socks-unix" || ibs[1].ListenOn.Domain() != "/tmp/xray.sock,0660" {
+		t.Fatalf("unexpected inbounds: %+v", ibs)
+	}
+	if ibs[1].SniffingConfig == nil || !ibs[1].SniffingConfig.Enabled {
+		t.Error("sniffing not copied")
+	}
+
+	invalid := []struct {
+		protocol string
+		path     string
+		perm     int
+	}{
+		{"vmess", "/tmp/xray.sock", 0},
+		{"http", "xray.sock", 0},
+		{"http", "@xray", 0o600},
+		{"http", "/no/such/dir/xray.sock", 0},
+		{"http", "/tmp/" + string(make([]byte, maxUnixPathLen)), 0},
+	}
+	for _, tt := range invalid {
+		if _, err := AddUnixSocketInbound(base, tt.protocol, tt.path, tt.perm); err == nil {
+			t.Errorf("expect error for %s %q %o", tt.protocol, tt.path, tt.perm)
+		}
+	}
+}
+
+func TestUnixSocketInbound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	t.Run("filesystem", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "proxy.sock")
+		// a socket file left by a killed process
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		l.Close()
+
+		inst := startUnixProxy(t, path, 0o600)
+		defer inst.Close()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0o600 {
+			t.Errorf("socket mode %o", info.Mode().Perm())
+		}
+		getThroughUnixProxy(t, path, server.URL)
+	})
+
+	t.Run("abstract", func(t *testing.T) {
+		if runtime.GOOS != "linux" && runtime.GOOS != "android" {
+			t.Skip("abstract namespace is Linux only")
+		}
+		path := "@libv2ray-test-" + filepath.Base(t.TempDir())
+		inst := startUnixProxy(t, path, 0)
+		defer inst.Close()
+		getThroughUnixProxy(t, path, server.URL)
+	})
+}
+
+func startUnixProxy(t *testing.T, path string, perm int) *v2core.Instance {
+	t.Helper()
+	content, err := AddUnixSocketInbound(`{"outbounds": [{"protocol": "freedom"}]}`, "http", path, perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadCoreConfig(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.removeStaleSockets()
+	inst, err := config.newInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return inst
+}
+
+func getThroughUnixProxy(t *testing.T, path string, target string) {
+	t.Helper()
+	proxy, _ := url.Parse("http://unix")
+	c := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxy),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := c.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, _ := io.ReadAll(resp.Body); string(b) != "ok" {
+		t.Errorf("unexpected response %q", b)
+	}
+}
@@ -0,0 +1,241 @@
+package libv2ray
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type wireguardPeer struct {
+	PublicKey    string   `json:"publicKey"`
+	PreSharedKey string   `json:"preSharedKey,omitempty"`
+	Endpoint     string   `json:"endpoint"`
+	KeepAlive    uint32   `json:"keepAlive,omitempty"`
+	AllowedIPs   []string `json:"allowedIPs,omitempty"`
+}
+
+type wireguardSettings struct {
+	SecretKey string           `json:"secretKey"`
+	Address   []string         `json:"address,omitempty"`
+	Peers     []*wireguardPeer `json:"peers"`
+	MTU       int32            `json:"mtu,omitempty"`
+	Reserved  []byte           `json:"reserved,omitempty"`
+}
+
+type wireguardOutbound struct {
+	Tag      string             `json:"tag,omitempty"`
+	Protocol string             `json:"protocol"`
+	Settings *wireguardSettings `json:"settings"`
+}
+
+// wireguardHints are [Interface] values xray does not use,
+// but the VPN service needs when setting up the tun device
+type wireguardHints struct {
+	DNS []string `json:"dns,omitempty"`
+	MTU int32    `json:"mtu,omitempty"`
+}
+
+type wireguardImport struct {
+	Outbound *wireguardOutbound `json:"outbound"`
+	Hints    *wireguardHints    `json:"hints"`
+}
+
+/*
+ImportWireGuardConf convert a WireGuard .conf file to a xray wireguard outbound.
+Returns JSON with "outbound" and the DNS/MTU "hints" for VPN setup.
+*/
+func ImportWireGuardConf(conf string, tag string) (string, error) {
+	result, err := parseWireGuardConf(conf)
+	if err != nil {
+		return "", err
+	}
+	result.Outbound.Tag = tag
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+/*
+ExportWireGuardConf convert a xray wireguard outbound back to a WireGuard .conf file.
+Accept either the outbound itself or the JSON returned by ImportWireGuardConf.
+*/
+func ExportWireGuardConf(outboundJSON string) (string, error) {
+	var doc wireguardImport
+	if err := json.Unmarshal([]byte(outboundJSON), &doc); err != nil {
+		return "", err
+	}
+	if doc.Outbound == nil {
+		doc.Outbound = &wireguardOutbound{}
+		if err := json.Unmarshal([]byte(outboundJSON), doc.Outbound); err != nil {
+			return "", err
+		}
+	}
+	if doc.Outbound.Protocol != "wireguard" || doc.Outbound.Settings == nil {
+		return "", errors.New("not a wireguard outbound")
+	}
+	return formatWireGuardConf(doc.Outbound.Settings, doc.Hints), nil
+}
+
+func parseWireGuardConf(conf string) (*wireguardImport, error) {
+	settings := &wireguardSettings{}
+	hints := &wireguardHints{}
+	var peer *wireguardPeer
+	section := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(conf))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				peer = &wireguardPeer{}
+				settings.Peers = append(settings.Peers, peer)
+			default:
+				return nil, fmt.Errorf("line %d: unknown section %s", n, line)
+			}
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("line %d: expect key = value", n)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch section + "." + key {
+		case "interface.privatekey":
+			settings.SecretKey, err = checkWireGuardKey(value)
+		case "interface.address":
+			settings.Address = append(settings.Address, splitList(value)...)
+		case "interface.dns":
+			hints.DNS = append(hints.DNS, splitList(value)...)
+		case "interface.mtu":
+			var mtu int64
+			mtu, err = strconv.ParseInt(value, 10, 32)
+			settings.MTU, hints.MTU = int32(mtu), int32(mtu)
+		case "peer.publickey":
+			peer.PublicKey, err = checkWireGuardKey(value)
+		case "peer.presharedkey":
+			peer.PreSharedKey, err = checkWireGuardKey(value)
+		case "peer.endpoint":
+			_, _, err = net.SplitHostPort(value)
+			peer.Endpoint = value
+		case "peer.allowedips":
+			peer.AllowedIPs = append(peer.AllowedIPs, splitList(value)...)
+		case "peer.persistentkeepalive":
+			if value != "off" {
+				var ka uint64
+				ka, err = strconv.ParseUint(value, 10, 16)
+				peer.KeepAlive = uint32(ka)
+			}
+		default:
+			// ListenPort, Table, PostUp ... mean nothing to a userspace outbound
+			if len(section) == 0 {
+				return nil, fmt.Errorf("line %d: %s outside of any section", n, key)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid %s: %v", n, key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(settings.SecretKey) == 0 {
+		return nil, errors.New("missing PrivateKey in [Interface]")
+	}
+	if len(settings.Peers) == 0 {
+		return nil, errors.New("missing [Peer]")
+	}
+	for _, p := range settings.Peers {
+		if len(p.PublicKey) == 0 || len(p.Endpoint) == 0 {
+			return nil, errors.New("[Peer] without PublicKey or Endpoint")
+		}
+	}
+
+	return &wireguardImport{
+		Outbound: &wireguardOutbound{Protocol: "wireguard", Settings: settings},
+		Hints:    hints,
+	}, nil
+}
+
+func formatWireGuardConf(settings *wireguardSettings, hints *wireguardHints) string {
+	var sb strings.Builder
+	sb.WriteString("[Interface]\n")
+	fmt.Fprintf(&sb, "PrivateKey = %s\n", settings.SecretKey)
+	if len(settings.Address) > 0 {
+		fmt.Fprintf(&sb, "Address = %s\n", strings.Join(settings.Address, ", "))
+	}
+	if hints != nil && len(hints.DNS) > 0 {
+		fmt.Fprintf(&sb, "DNS = %s\n", strings.Join(hints.DNS, ", "))
+	}
+	mtu := settings.MTU
+	if mtu == 0 && hints != nil {
+		mtu = hints.MTU
+	}
+	if mtu > 0 {
+		fmt.Fprintf(&sb, "MTU = %d\n", mtu)
+	}
+
+	for _, p := range settings.Peers {
+		sb.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&sb, "PublicKey = %s\n", p.PublicKey)
+		if len(p.PreSharedKey) > 0 {
+			fmt.Fprintf(&sb, "PresharedKey = %s\n", p.PreSharedKey)
+		}
+		allowed := p.AllowedIPs
+		if len(allowed) == 0 {
+			// same default as xray
+			allowed = []string{"0.0.0.0/0", "::/0"}
+		}
+		fmt.Fprintf(&sb, "AllowedIPs = %s\n", strings.Join(allowed, ", "))
+		fmt.Fprintf(&sb, "Endpoint = %s\n", p.Endpoint)
+		if p.KeepAlive > 0 {
+			fmt.Fprintf(&sb, "PersistentKeepalive = %d\n", p.KeepAlive)
+		}
+	}
+	return sb.String()
+}
+
+// checkWireGuardKey accept base64 keys only, which is what .conf files use
+func checkWireGuardKey(key string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", err
+	}
+	if len(raw) != 32 {
+		return "", fmt.Errorf("bad key length %d", len(raw))
+	}
+	return key, nil
+}
+
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); len(s) > 0 {
+			items = append(items, s)
+		}
+	}
+	return items
+}
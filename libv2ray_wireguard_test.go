@@ -0,0 +1,95 @@
+package libv2ray
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	v2conf "github.com/xtls/xray-core/infra/conf"
+)
+
+const testWireGuardConf = `
+[Interface]
+# laptop
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.0.0.2/32, fd00::2/128
+DNS = 1.1.1.1, 2606:4700:4700::1111
+MTU = 1280
+ListenPort = 51820
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+PresharedKey = /UwcSPg38hW/D9Y3tcS1FOV0K1wuURMbS0sesJEP5ak=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = demo.wireguard.com:51820
+PersistentKeepalive = 25
+`
+
+func TestImportWireGuardConf(t *testing.T) {
+	got, err := ImportWireGuardConf(testWireGuardConf, "wg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result wireguardImport
+	if err := json.Unmarshal([]byte(got), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Hints.DNS) != 2 || result.Hints.MTU != 1280 {
+		t.Errorf("unexpected hints: %+v", result.Hints)
+	}
+	peer := result.Outbound.Settings.Peers[0]
+	if peer.Endpoint != "demo.wireguard.com:51820" || peer.KeepAlive != 25 || len(peer.AllowedIPs) != 2 {
+		t.Errorf("unexpected peer: %+v", peer)
+	}
+
+	// xray must accept what we generate
+	outbound, _ := json.Marshal(result.Outbound)
+	var detour v2conf.OutboundDetourConfig
+	if err := json.Unmarshal(outbound, &detour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := detour.Build(); err != nil {
+		t.Errorf("xray rejected outbound: %v", err)
+	}
+
+	exported, err := ExportWireGuardConf(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ImportWireGuardConf(exported, "wg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != got {
+		t.Errorf("round trip mismatch:\n%s\n%s", got, again)
+	}
+
+	// bare outbound loses DNS only
+	exported, err = ExportWireGuardConf(string(outbound))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(exported, "DNS") || !strings.Contains(exported, "MTU = 1280") {
+		t.Errorf("unexpected export:\n%s", exported)
+	}
+}
+
+func TestImportWireGuardConfInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+	}{
+		{"no peer", "[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\n"},
+		{"bad key", "[Interface]\nPrivateKey = abc\n[Peer]\nPublicKey = abc\nEndpoint = 1.2.3.4:1\n"},
+		{"no endpoint", "[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\n[Peer]\nPublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=\n"},
+		{"unknown section", "[Foo]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ImportWireGuardConf(tt.conf, ""); err == nil {
+				t.Error("expect error")
+			}
+		})
+	}
+}